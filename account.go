@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+type DeleteAccountRequest struct {
+	// UniqueName the unique name of the user, confirms the deletion
+	UniqueName string `json:"uniqueName"`
+}
+
+// exportData stream a zip archive of all data of the session user
+func exportData(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	u := state.UserByID(ssion.ID)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="lln-%s-%s.zip"`,
+		u.ID, time.Now().Format("20060102")))
+	zw := zip.NewWriter(w)
+	if err := state.ExportUser(u, zw); err != nil {
+		// the response is partially written, the archive is left broken
+		logrus.Errorf("export user %s error: %s", u.ID, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logrus.Errorf("export user %s error: %s", u.ID, err)
+	}
+}
+
+// deleteAccount log out the session user and delete all the data in the
+// background
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	if !ssion.Fresh(time.Now()) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "log in again to delete the account")
+		return
+	}
+	req := &DeleteAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	u := state.UserByID(ssion.ID)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.UniqueName != u.UniqueName {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "uniqueName does not match")
+		return
+	}
+	d, err := state.DeleteAccount(u)
+	if err != nil {
+		if errors.Is(err, state.ErrAccountDeleting) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(R{V: d})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -21,7 +22,8 @@ func userVerified(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err.Error())
 		return
 	}
-	err = u.SetVerified(code)
+	err = u.SetVerified(code, audit(r, "userVerified", "user", u.ID,
+		map[string]int64{"verifiedCode": u.VerifiedCode}, map[string]int64{"verifiedCode": code}))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
@@ -32,16 +34,24 @@ func userVerified(w http.ResponseWriter, r *http.Request) {
 }
 
 func recommendStatus(w http.ResponseWriter, r *http.Request) {
-	if err := state.RecommendStatus(chi.URLParam(r, tools.StatusID)); err != nil {
+	statusID := chi.URLParam(r, tools.StatusID)
+	err := state.RecommendStatus(statusID, audit(r, "recommendStatus", "status", statusID,
+		map[string]bool{"recommended": state.Recommended(statusID)}, map[string]bool{"recommended": true}))
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err.Error())
+		return
 	}
 }
 
 func notRecommendStatus(w http.ResponseWriter, r *http.Request) {
-	if err := state.NotRecommendStatus(chi.URLParam(r, tools.StatusID)); err != nil {
+	statusID := chi.URLParam(r, tools.StatusID)
+	err := state.NotRecommendStatus(statusID, audit(r, "notRecommendStatus", "status", statusID,
+		map[string]bool{"recommended": state.Recommended(statusID)}, map[string]bool{"recommended": false}))
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err.Error())
+		return
 	}
 }
 
@@ -51,10 +61,12 @@ func disableUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	err := u.Disable()
+	err := u.Disable(audit(r, "disableUser", "user", u.ID,
+		map[string]bool{"disabled": u.Disabled()}, map[string]bool{"disabled": true}))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
+		return
 	}
 }
 
@@ -64,9 +76,35 @@ func enableUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	err := u.Enable()
+	err := u.Enable(audit(r, "enableUser", "user", u.ID,
+		map[string]bool{"disabled": u.Disabled()}, map[string]bool{"disabled": false}))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatusCode(err))
 		fmt.Fprint(w, err.Error())
+		return
+	}
+}
+
+// audit the audit log entry of an admin action, it's committed along with
+// the action so the action fails if the entry can't be written
+func audit(r *http.Request, action, targetType, targetID string, before, after any) *state.AuditOptions {
+	return &state.AuditOptions{
+		Admin:      currentSessionUser(r),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     before,
+		After:      after,
+	}
+}
+
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
 	}
+	entries, more := state.ListAudit(opts)
+	json.NewEncoder(w).Encode(L{V: entries, More: more})
 }
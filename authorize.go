@@ -3,17 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
-	"github.com/decred/base58"
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5"
 	"github.com/rkonfj/lln/config"
 	"github.com/rkonfj/lln/state"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 )
 
+// authStateCookie binds the oauth2 state to the browser that started the login
+const authStateCookie = "lln_oauth_state"
+
 func authorize(w http.ResponseWriter, r *http.Request) {
 	providerName := chi.URLParam(r, tools.Provider)
 	provider := config.GetOIDCProvider(providerName)
@@ -23,13 +32,38 @@ func authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	oauth2Token, err := provider.Config.Exchange(context.Background(), r.URL.Query().Get("code"))
+	stateID := r.URL.Query().Get("state")
+	http.SetCookie(w, authStateCookieOf(r, "", -1))
+	if c, err := r.Cookie(authStateCookie); err != nil || c.Value != stateID {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(state.ErrInvalidState.Error()))
+		return
+	}
+	authState, err := state.ConsumeAuthState(providerName, stateID)
+	if err != nil {
+		if errors.Is(err, state.ErrInvalidState) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	oauth2Token, err := provider.Config.Exchange(context.Background(), r.URL.Query().Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", authState.Verifier))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	if err := verifyIDToken(provider, oauth2Token, authState.Nonce); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "verify id_token error: %s", err.Error())
+		return
+	}
+
 	u, err := provider.Provider.UserInfo(context.Background(),
 		provider.Config.TokenSource(context.Background(), oauth2Token))
 	if err != nil {
@@ -78,21 +112,73 @@ func authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionObj, err := state.CreateSession(opts)
+	identity := &state.Identity{Provider: providerName, Email: opts.Email}
+	switch v := profile[provider.UserMeta.Subject].(type) {
+	case string:
+		identity.Subject = v
+	case float64:
+		identity.Subject = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if len(identity.Subject) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "subject is required")
+		return
+	}
+
+	if len(authState.LinkUID) > 0 {
+		if err := state.LinkIdentity(authState.LinkUID, identity); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		if r.Method == http.MethodPost {
+			w.Header().Add("X-Jump", authState.Jump)
+			json.NewEncoder(w).Encode(R{V: identity})
+		} else {
+			http.Redirect(w, r, authState.Jump, http.StatusFound)
+		}
+		return
+	}
+
+	sessionObj, err := state.CreateSession(identity, opts, &state.SessionClient{
+		IP:        r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatusCode(err))
 		fmt.Fprintf(w, "create session error: %s", err)
 		return
 	}
-	jump := string(base58.Decode(r.URL.Query().Get("state")))
 	if r.Method == http.MethodPost {
-		w.Header().Add("X-Jump", jump)
+		w.Header().Add("X-Jump", authState.Jump)
 		json.NewEncoder(w).Encode(R{V: sessionObj})
 	} else {
-		http.Redirect(w, r, jump, http.StatusFound)
+		http.Redirect(w, r, authState.Jump, http.StatusFound)
 	}
 }
 
+// verifyIDToken verify the id token and its nonce when the provider issues one
+func verifyIDToken(provider *config.OIDCProvider, token *oauth2.Token, nonce string) error {
+	if provider.Verifier == nil {
+		return nil
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || len(rawIDToken) == 0 {
+		if provider.IDTokenRequired {
+			return errors.New("id_token is missing")
+		}
+		return nil
+	}
+	idToken, err := provider.Verifier.Verify(context.Background(), rawIDToken)
+	if err != nil {
+		return err
+	}
+	if idToken.Nonce != nonce {
+		return errors.New("nonce mismatch")
+	}
+	return nil
+}
+
 func deleteAuthorize(w http.ResponseWriter, r *http.Request) {
 	if r.Context().Value(tools.KeySession) == nil {
 		return
@@ -101,17 +187,79 @@ func deleteAuthorize(w http.ResponseWriter, r *http.Request) {
 }
 
 func oidcRedirect(w http.ResponseWriter, r *http.Request) {
-	providerName := chi.URLParam(r, tools.Provider)
+	authCodeURL, ok := newAuthCodeURL(w, r, chi.URLParam(r, tools.Provider), "")
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
+}
+
+// newAuthCodeURL start an oauth2 login (or linking to user {linkUID}) at
+// the provider and return the url to redirect to. the `jump` query is
+// validated, errors are written to w
+func newAuthCodeURL(w http.ResponseWriter, r *http.Request, providerName, linkUID string) (string, bool) {
 	provider := config.GetOIDCProvider(providerName)
 	if provider == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("provider %s not supported", providerName)))
-		return
+		return "", false
 	}
 
 	jump := r.URL.Query().Get("jump")
 	if len(jump) == 0 {
 		jump = "/"
 	}
-	http.Redirect(w, r, provider.Config.AuthCodeURL(base58.Encode([]byte(jump))), http.StatusFound)
+	if !allowedJump(jump) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "jump target %s not allowed", jump)
+		return "", false
+	}
+
+	authState, err := state.NewAuthState(providerName, jump, linkUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return "", false
+	}
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", authState.CodeChallenge()),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+	if provider.Verifier != nil {
+		opts = append(opts, oidc.Nonce(authState.Nonce))
+	}
+	http.SetCookie(w, authStateCookieOf(r, authState.ID, 600))
+	return provider.Config.AuthCodeURL(authState.ID, opts...), true
+}
+
+func authStateCookieOf(r *http.Request, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     authStateCookie,
+		Value:    value,
+		Path:     "/o/authorize",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// allowedJump relative paths or urls of origins in the jump allowlist
+func allowedJump(jump string) bool {
+	for _, c := range jump {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+	u, err := url.Parse(jump)
+	if err != nil || u.User != nil {
+		return false
+	}
+	if len(u.Scheme) == 0 && len(u.Host) == 0 {
+		return strings.HasPrefix(jump, "/") && !strings.HasPrefix(jump, "//")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	return slices.Contains(config.Conf.Server.JumpAllowlist, fmt.Sprintf("%s://%s", u.Scheme, u.Host))
 }
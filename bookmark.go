@@ -13,7 +13,7 @@ import (
 func bookmarkStatus(w http.ResponseWriter, r *http.Request) {
 	err := state.BookmarkStatus(currentSessionUser(r), chi.URLParam(r, tools.StatusID))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatusCode(err))
 		w.Write([]byte(err.Error()))
 	}
 }
@@ -29,11 +29,11 @@ func listBookmarks(w http.ResponseWriter, r *http.Request) {
 	user := currentSessionUser(r)
 	ss, more := state.ListBookmarks(user, opts)
 	var ret []*Status
-	for _, s := range ss {
+	for _, s := range filterInvisible(ss, user) {
 		status := castStatus(s, user)
 		if len(s.RefStatus) > 0 {
 			prev := state.GetStatus(s.RefStatus)
-			if prev != nil {
+			if prev != nil && prev.VisibleTo(user) {
 				status.RefStatus = castStatus(prev, user)
 			}
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/rkonfj/lln/state"
@@ -14,14 +15,27 @@ func currentSessionUser(r *http.Request) (user *state.ActUser) {
 	return
 }
 
+// embedDepth reposted and quoted statuses are embedded up to the depth,
+// so a repost of a quote shows the quoted status too
+const embedDepth = 2
+
 func castStatus(s *state.Status, sessionUser *state.ActUser) *Status {
-	var liked, bookmarked, followed bool
+	return castStatusEmbedded(s, sessionUser, embedDepth)
+}
+
+func castStatusEmbedded(s *state.Status, sessionUser *state.ActUser, depth int) *Status {
+	var liked, bookmarked, followed, reposted bool
+	var voted []int
 	if sessionUser != nil {
+		if s.Poll() != nil {
+			voted = state.PollChoices(s.ID, sessionUser.ID)
+		}
 		liked = state.Liked(s.ID, sessionUser.ID)
 		bookmarked = state.Bookmarked(s.ID, sessionUser.ID)
 		followed = state.Followed(sessionUser.ID, s.User.ID)
+		reposted = state.Reposted(s.ID, sessionUser.ID)
 	}
-	return &Status{
+	status := &Status{
 		ID:         s.ID,
 		Content:    s.Content,
 		User:       s.User,
@@ -32,8 +46,91 @@ func castStatus(s *state.Status, sessionUser *state.ActUser) *Status {
 		LikeCount:  s.LikeCount,
 		Bookmarks:  s.Bookmarks,
 		Disabled:   s.Disabled,
+		Removed:    s.Removed,
+		Visibility: s.Visibility,
+		EditTime:   s.EditTime,
+		Edited:     s.EditTime != nil,
 		Liked:      liked,
 		Bookmarked: bookmarked,
 		Followed:   followed,
+		Reposts:    s.Reposts,
+		Quotes:     s.Quotes,
+		Reposted:   reposted,
+		Voted:      voted,
+	}
+	if depth > 0 {
+		status.Repost = embedStatus(s.RepostOf, sessionUser, depth-1)
+		status.Quote = embedStatus(s.Quote, sessionUser, depth-1)
+	}
+	return status
+}
+
+// embedStatus the reposted or quoted status if the session user can see it
+func embedStatus(statusID string, sessionUser *state.ActUser, depth int) *Status {
+	if len(statusID) == 0 {
+		return nil
+	}
+	s := state.GetStatus(statusID)
+	if s == nil || !s.VisibleTo(sessionUser) {
+		return nil
+	}
+	return castStatusEmbedded(s, sessionUser, depth)
+}
+
+// errorStatusCode http status code for errors returned from state
+func errorStatusCode(err error) int {
+	if errors.Is(err, state.ErrBlocked) || errors.Is(err, state.ErrWrongOldPassword) ||
+		errors.Is(err, state.ErrPrivateAccount) || errors.Is(err, state.ErrAccountDeleting) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, state.ErrStatusNotFound) || errors.Is(err, state.ErrNoFollowRequest) ||
+		errors.Is(err, state.ErrDraftNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, state.ErrWrongPassword) {
+		return http.StatusUnauthorized
+	}
+	if errors.Is(err, state.ErrInvalidToken) || errors.Is(err, state.ErrInvalidPassword) ||
+		errors.Is(err, state.ErrWrongCode) || errors.Is(err, state.ErrTOTPNotEnrolled) {
+		return http.StatusBadRequest
 	}
+	if errors.Is(err, state.ErrNotRepostable) || errors.Is(err, state.ErrNoPoll) ||
+		errors.Is(err, state.ErrInvalidChoices) || errors.Is(err, state.ErrPollEdit) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, state.ErrTOTPEnabled) || errors.Is(err, state.ErrVoted) ||
+		errors.Is(err, state.ErrPollClosed) || errors.Is(err, state.ErrIdentityLinked) ||
+		errors.Is(err, state.ErrIdentityNotLinked) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, state.ErrTooManyAttempts) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// filterInvisible drop statuses the session user can not see and reposts
+// of deleted statuses
+func filterInvisible(ss []*state.Status, user *state.ActUser) (ret []*state.Status) {
+	for _, s := range filterHidden(ss, state.InvisibleUsers(user, ss)) {
+		if s.InAudience(user) && !orphanRepost(s) {
+			ret = append(ret, s)
+		}
+	}
+	return
+}
+
+// orphanRepost determine if the status is a repost of a deleted status
+func orphanRepost(s *state.Status) bool {
+	return len(s.RepostOf) > 0 && state.GetStatus(s.RepostOf) == nil
+}
+
+// filterHidden drop statuses of users hidden from the session user
+func filterHidden(ss []*state.Status, hidden map[string]bool) (ret []*state.Status) {
+	for _, s := range ss {
+		if !hidden[s.User.ID] {
+			ret = append(ret, s)
+		}
+	}
+	return
 }
@@ -15,16 +15,20 @@ var (
 )
 
 type Config struct {
-	Admins  []string      `yaml:"admins"`
-	Model   ModelConfig   `yaml:"model"`
-	OIDC    []*OIDC       `yaml:"oidc"`
-	Server  ServerConfig  `yaml:"server"`
-	State   StateConfig   `yaml:"state"`
-	Storage StorageConfig `yaml:"storage"`
+	Admins  []string         `yaml:"admins"`
+	Local   *LocalAuthConfig `yaml:"local"`
+	Mail    MailConfig       `yaml:"mail"`
+	Model   ModelConfig      `yaml:"model"`
+	OIDC    []*OIDC          `yaml:"oidc"`
+	Server  ServerConfig     `yaml:"server"`
+	Session SessionConfig    `yaml:"session"`
+	State   StateConfig      `yaml:"state"`
+	Storage StorageConfig    `yaml:"storage"`
 }
 
 type StateConfig struct {
 	Etcd *EtcdConfig `yaml:"etcd"`
+	Bolt *BoltConfig `yaml:"bolt"`
 }
 
 type EtcdConfig struct {
@@ -34,6 +38,22 @@ type EtcdConfig struct {
 	TrustedCAFile string   `yaml:"trustedCAFile,omitempty"`
 }
 
+// BoltConfig embedded single-node state, used instead of etcd when configured
+type BoltConfig struct {
+	Path string `yaml:"path"`
+}
+
+// SessionConfig lifetime of login sessions, 30 days and 7 days idle when
+// absent, zero means never expire
+type SessionConfig struct {
+	// TTL sessions expire after TTL since login regardless of activity
+	TTL time.Duration `yaml:"ttl"`
+	// IdleTimeout sessions expire when not used for IdleTimeout
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// HashKey key of the hash api keys are stored as, generated if empty
+	HashKey string `yaml:"hashKey"`
+}
+
 type StorageConfig struct {
 	S3 S3Config `yaml:"s3"`
 }
@@ -41,6 +61,9 @@ type StorageConfig struct {
 type ServerConfig struct {
 	Listen    string          `yaml:"listen"`
 	Ratelimit RatelimitConfig `yaml:"ratelimit"`
+	// JumpAllowlist origins users may be redirected to after login,
+	// relative paths are always allowed
+	JumpAllowlist []string `yaml:"jumpAllowlist"`
 }
 
 type RatelimitConfig struct {
@@ -51,7 +74,7 @@ type RatelimitConfig struct {
 // LoadConfig init config package and export `config.Conf`
 func LoadConfig(configPath string) error {
 	logrus.Info("loading config from ", configPath)
-	Conf = &Config{}
+	Conf = &Config{Session: SessionConfig{TTL: 30 * 24 * time.Hour, IdleTimeout: 7 * 24 * time.Hour}}
 	b, err := os.ReadFile(configPath)
 	if err != nil {
 		return err
@@ -74,7 +97,11 @@ func LoadConfig(configPath string) error {
 		Conf.Server.Ratelimit.Requests = 20
 	}
 
-	if Conf.State.Etcd == nil {
+	if Conf.State.Bolt != nil && len(Conf.State.Bolt.Path) == 0 {
+		Conf.State.Bolt.Path = "lln.db"
+	}
+
+	if Conf.State.Etcd == nil && Conf.State.Bolt == nil {
 		Conf.State.Etcd = &EtcdConfig{Endpoints: []string{"http://127.0.0.1:2379"}}
 	}
 
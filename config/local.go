@@ -0,0 +1,10 @@
+package config
+
+// LocalAuthConfig local password and magic link authentication, disabled when nil
+type LocalAuthConfig struct {
+	// Signup users can sign up by magic links, otherwise only existing users can log in
+	Signup bool `yaml:"signup"`
+	// LinkURL page of the web app magic and password reset links point to,
+	// the `token` query is appended
+	LinkURL string `yaml:"linkURL"`
+}
@@ -0,0 +1,14 @@
+package config
+
+// MailConfig how mails are sent, mails can't be sent when no sender is configured
+type MailConfig struct {
+	SMTP *SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	// Addr host:port of the smtp server, STARTTLS is used when supported
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
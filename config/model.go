@@ -1,20 +1,38 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 	"unicode/utf8"
 )
 
 type ModelConfig struct {
-	Status   StatusConfig `yaml:"status"`
-	Media    MediaConfig  `yaml:"media"`
-	Keywords []string     `yaml:"keywords"`
+	Status   StatusConfig   `yaml:"status"`
+	Media    MediaConfig    `yaml:"media"`
+	Timeline TimelineConfig `yaml:"timeline"`
+	Keywords []string       `yaml:"keywords"`
 }
 
 type StatusConfig struct {
 	ContentListLimit int `yaml:"contentListLimit" json:"contentListLimit"`
 	ContentLimit     int `yaml:"contentLimit" json:"contentLimit"`
 	OverviewLimit    int `yaml:"overviewLimit" json:"overviewLimit"`
+	// PollOptionsLimit maximum options of a poll
+	PollOptionsLimit int `yaml:"pollOptionsLimit" json:"pollOptionsLimit"`
+	// PollOptionLimit maximum unicode characters of a poll option
+	PollOptionLimit int `yaml:"pollOptionLimit" json:"pollOptionLimit"`
+	// PollDurationLimit maximum time a poll is open for, seconds in json
+	PollDurationLimit time.Duration `yaml:"pollDurationLimit" json:"-"`
+}
+
+// MarshalJSON the restriction exposed to clients, durations are in seconds
+func (c StatusConfig) MarshalJSON() ([]byte, error) {
+	type restriction StatusConfig
+	return json.Marshal(struct {
+		restriction
+		PollDurationLimit int64 `json:"pollDurationLimit"`
+	}{restriction(c), int64(c.PollDurationLimit.Seconds())})
 }
 
 func (c *StatusConfig) RestrictContent(content string) error {
@@ -43,10 +61,33 @@ func (c *StatusConfig) RestrictOverview(content string) error {
 	return nil
 }
 
+func (c *StatusConfig) RestrictPoll(options []string, duration time.Duration) error {
+	if len(options) < 2 || len(options) > c.PollOptionsLimit {
+		return fmt.Errorf("poll: 2 to %d options, %d", c.PollOptionsLimit, len(options))
+	}
+	for _, o := range options {
+		count := utf8.RuneCountInString(o)
+		if count == 0 || count > c.PollOptionLimit {
+			return fmt.Errorf("poll: 1 to %d unicode characters per option, %d",
+				c.PollOptionLimit, count)
+		}
+	}
+	if duration < time.Minute || duration > c.PollDurationLimit {
+		return fmt.Errorf("poll: open for 1m to %s, %s", c.PollDurationLimit, duration)
+	}
+	return nil
+}
+
 type MediaConfig struct {
 	CountPerDayLimit int64 `yaml:"countPerDayLimit"`
 }
 
+type TimelineConfig struct {
+	// statuses of users with more followers are fanned in on read
+	// instead of fanned out to each follower's inbox on write
+	FanOutFollowersLimit int64 `yaml:"fanOutFollowersLimit"`
+}
+
 func initModel() {
 	if Conf.Model.Status.OverviewLimit == 0 {
 		Conf.Model.Status.OverviewLimit = 256
@@ -60,10 +101,26 @@ func initModel() {
 		Conf.Model.Status.ContentListLimit = 20
 	}
 
+	if Conf.Model.Status.PollOptionsLimit == 0 {
+		Conf.Model.Status.PollOptionsLimit = 4
+	}
+
+	if Conf.Model.Status.PollOptionLimit == 0 {
+		Conf.Model.Status.PollOptionLimit = 64
+	}
+
+	if Conf.Model.Status.PollDurationLimit == 0 {
+		Conf.Model.Status.PollDurationLimit = 7 * 24 * time.Hour
+	}
+
 	if Conf.Model.Media.CountPerDayLimit == 0 {
 		Conf.Model.Media.CountPerDayLimit = 20
 	}
 
+	if Conf.Model.Timeline.FanOutFollowersLimit == 0 {
+		Conf.Model.Timeline.FanOutFollowersLimit = 1000
+	}
+
 	Conf.Model.Keywords =
 		append(Conf.Model.Keywords,
 			"explore",
@@ -77,5 +134,6 @@ func initModel() {
 			"news",
 			"probe",
 			"verified",
+			"timeline",
 		)
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"context"
+	"slices"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -26,6 +27,8 @@ type OIDC struct {
 }
 
 type UserMeta struct {
+	// Subject claim identifying the user at the provider
+	Subject string `yaml:"subject"`
 	Email   string `yaml:"email"`
 	Name    string `yaml:"name"`
 	Picture string `yaml:"picture"`
@@ -34,10 +37,14 @@ type UserMeta struct {
 }
 
 type OIDCProvider struct {
-	Provider   *oidc.Provider
-	Config     *oauth2.Config
-	TrustEmail bool
-	UserMeta   *UserMeta
+	Provider *oidc.Provider
+	Config   *oauth2.Config
+	// Verifier id token verifier, nil for plain oauth2 providers
+	Verifier *oidc.IDTokenVerifier
+	// IDTokenRequired the `openid` scope is requested so an id token must be issued
+	IDTokenRequired bool
+	TrustEmail      bool
+	UserMeta        *UserMeta
 }
 
 func initOpenIDConnect() {
@@ -46,12 +53,14 @@ func initOpenIDConnect() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		var provider *oidc.Provider
+		var verifier *oidc.IDTokenVerifier
 		if len(o.Issuer) > 0 {
 			provider, err = oidc.NewProvider(ctx, o.Issuer)
 			if err != nil {
 				logrus.Error("oidc component error: ", err)
 				continue
 			}
+			verifier = provider.Verifier(&oidc.Config{ClientID: o.ClientID})
 		} else {
 			provider = (&oidc.ProviderConfig{
 				AuthURL:     o.AuthURL,
@@ -60,6 +69,10 @@ func initOpenIDConnect() {
 			}).NewProvider(ctx)
 		}
 
+		if len(o.UserMeta.Subject) == 0 {
+			o.UserMeta.Subject = "sub"
+		}
+
 		if len(o.UserMeta.Picture) == 0 {
 			o.UserMeta.Picture = "picture"
 		}
@@ -89,8 +102,10 @@ func initOpenIDConnect() {
 				Endpoint:     provider.Endpoint(),
 				Scopes:       o.Scopes,
 			},
-			TrustEmail: o.TrustEmail,
-			UserMeta:   &o.UserMeta,
+			Verifier:        verifier,
+			IDTokenRequired: verifier != nil && slices.Contains(o.Scopes, oidc.ScopeOpenID),
+			TrustEmail:      o.TrustEmail,
+			UserMeta:        &o.UserMeta,
 		}
 	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+func listDrafts(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	drafts, more := state.ListDrafts(currentSessionUser(r), opts)
+	json.NewEncoder(w).Encode(L{V: drafts, More: more})
+}
+
+func createDraft(w http.ResponseWriter, r *http.Request) {
+	saveDraft(w, r, "")
+}
+
+func updateDraft(w http.ResponseWriter, r *http.Request) {
+	saveDraft(w, r, chi.URLParam(r, tools.DraftID))
+}
+
+func saveDraft(w http.ResponseWriter, r *http.Request, draftID string) {
+	opts, err := checkArgsStatus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	d, err := state.SaveDraft(opts.User, draftID, opts)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+func deleteDraft(w http.ResponseWriter, r *http.Request) {
+	err := state.DeleteDraft(currentSessionUser(r), chi.URLParam(r, tools.DraftID))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+	}
+}
+
+func publishDraft(w http.ResponseWriter, r *http.Request) {
+	user := currentSessionUser(r)
+	s, err := state.PublishDraft(user, chi.URLParam(r, tools.DraftID))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(castStatus(s, user))
+}
@@ -22,7 +22,7 @@ func explore(w http.ResponseWriter, r *http.Request) {
 	user := currentSessionUser(r)
 	ss, more := state.Recommendations(user, opts)
 	var ret []*Status
-	for _, s := range ss {
+	for _, s := range filterInvisible(ss, user) {
 		status := castStatus(s, user)
 		if s.Comments > 0 {
 			meta, err := state.NewCommentsRecommandMeta(s.ID)
@@ -31,7 +31,7 @@ func explore(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			next := meta.Recommand()
-			if next != nil {
+			if next != nil && next.VisibleTo(user) {
 				status.Next = castStatus(next, user)
 			}
 		}
@@ -69,6 +69,12 @@ func exploreNewsProbe(w http.ResponseWriter, r *http.Request) {
 }
 
 func exploreStatusComment(w http.ResponseWriter, r *http.Request) {
+	user := currentSessionUser(r)
+	parent := state.GetStatus(chi.URLParam(r, tools.StatusID))
+	if parent != nil && !parent.VisibleTo(user) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	meta, err := state.NewCommentsRecommandMeta(chi.URLParam(r, tools.StatusID))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -76,8 +82,8 @@ func exploreStatusComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s := meta.Recommand()
-	if s != nil {
-		json.NewEncoder(w).Encode(R{V: castStatus(s, currentSessionUser(r))})
+	if s != nil && s.VisibleTo(user) {
+		json.NewEncoder(w).Encode(R{V: castStatus(s, user)})
 		return
 	}
 	json.NewEncoder(w).Encode(R{})
@@ -88,6 +88,7 @@ func statusHTML(w http.ResponseWriter, r *http.Request) {
 		Ascend: true,
 	})
 
+	comments = filterInvisible(comments, nil)
 	for _, cur := range comments {
 		cur.Content = []*state.StatusFragment{
 			{Type: "text", Value: cur.Overview()},
@@ -113,11 +114,15 @@ func profileHTML(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ss, _ := u.ListStatus(&tools.PaginationOptions{Size: 100})
+	var ss []*state.Status
+	if !u.Private {
+		ss, _ = u.ListStatus(&tools.PaginationOptions{Size: 100})
+		ss = filterInvisible(ss, nil)
+	}
 
 	for _, cur := range ss {
 		cur.Content = []*state.StatusFragment{
-			{Type: "text", Value: cur.Overview()},
+			{Type: "text", Value: repostOverview(cur)},
 		}
 	}
 
@@ -134,6 +139,7 @@ func exploreHTML(w http.ResponseWriter, r *http.Request) {
 	ss, _ := state.Recommendations(nil, &tools.PaginationOptions{
 		Size: 100,
 	})
+	ss = filterInvisible(ss, nil)
 	if ss == nil {
 		return
 	}
@@ -156,7 +162,7 @@ func sitemap(w http.ResponseWriter, r *http.Request) {
 	ss, _ := state.Recommendations(nil, &tools.PaginationOptions{
 		Size: 1000,
 	})
-	for _, s := range ss {
+	for _, s := range filterInvisible(ss, nil) {
 		fmt.Fprintln(w, `<url>`)
 		fmt.Fprintf(w, `<loc>https://%s/%s/status/%s</loc>`, r.Host, s.User.UniqueName, s.ID)
 		fmt.Fprintln(w)
@@ -177,3 +183,15 @@ func friendsHTML(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err.Error())
 	}
 }
+
+// repostOverview overview of the status, reposts show the original status
+func repostOverview(s *state.Status) string {
+	if len(s.RepostOf) == 0 {
+		return s.Overview()
+	}
+	orig := state.GetStatus(s.RepostOf)
+	if orig == nil || !orig.VisibleTo(nil) {
+		return ""
+	}
+	return fmt.Sprintf("RT @%s: %s", orig.User.UniqueName, orig.Overview())
+}
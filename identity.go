@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+func listIdentities(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	json.NewEncoder(w).Encode(R{V: state.ListIdentities(ssion.ID)})
+}
+
+// linkIdentity start linking a provider account to the session user, the
+// returned url is where the browser goes to authorize at the provider
+func linkIdentity(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	authCodeURL, ok := newAuthCodeURL(w, r, chi.URLParam(r, tools.Provider), ssion.ID)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: authCodeURL})
+}
+
+func unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	if err := state.UnlinkIdentity(ssion.ID, chi.URLParam(r, tools.Provider)); err != nil {
+		if errors.Is(err, state.ErrLastIdentity) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, err.Error())
+	}
+}
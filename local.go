@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/mail"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+type LocalAuthRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Old the current password when changing it
+	Old   string `json:"old"`
+	Token string `json:"token"`
+}
+
+func decodeLocalAuthRequest(w http.ResponseWriter, r *http.Request) *LocalAuthRequest {
+	req := &LocalAuthRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return nil
+	}
+	return req
+}
+
+func sessionClient(r *http.Request) *state.SessionClient {
+	return &state.SessionClient{IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+}
+
+func passwordLogin(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	s, err := state.PasswordLogin(req.Email, req.Password, sessionClient(r))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: s})
+}
+
+// sendMagicLink mail a magic link to the email. it responds the same
+// whether the user exists or not
+func sendMagicLink(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	token, err := state.NewMagicLink(req.Email)
+	if errors.Is(err, state.ErrSignupDisabled) {
+		logrus.Debugf("magic link to %s not sent: %s", req.Email, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	err = mail.SendMagicLink(req.Email, localLink("magic", token))
+	if err != nil {
+		logrus.Error("send magic link error: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "send mail failed")
+	}
+}
+
+func magicLogin(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	s, err := state.MagicLogin(req.Token, sessionClient(r))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: s})
+}
+
+// sendPasswordReset mail a password reset link to the email. it responds
+// the same whether the user exists or not
+func sendPasswordReset(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	u, token, err := state.NewPasswordReset(req.Email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	if u == nil {
+		logrus.Debugf("password reset to %s not sent: user not found", req.Email)
+		return
+	}
+	err = mail.SendPasswordReset(req.Email, u.Name, localLink("reset", token))
+	if err != nil {
+		logrus.Error("send password reset error: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "send mail failed")
+	}
+}
+
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	if err := state.ResetPassword(req.Token, req.Password); err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+	}
+}
+
+func putPassword(w http.ResponseWriter, r *http.Request) {
+	req := decodeLocalAuthRequest(w, r)
+	if req == nil {
+		return
+	}
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	if err := state.SetPassword(ssion.ID, req.Old, req.Password); err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+	}
+}
+
+// localLink url of the web app page handling magic and password reset links
+func localLink(kind, token string) string {
+	u, err := url.Parse(config.Conf.Local.LinkURL)
+	if err != nil {
+		logrus.Error("invalid local.linkURL: ", err)
+		return ""
+	}
+	q := u.Query()
+	q.Set("type", kind)
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/lln/config"
+)
+
+var (
+	// DefaultSender sender used by Send, replaceable for other transports
+	DefaultSender Sender = &nopSender{}
+
+	ErrNotConfigured error = errors.New("mail sender is not configured")
+)
+
+// Sender delivers plain text mails
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// Init choose the sender by the config
+func Init(c config.MailConfig) {
+	if c.SMTP != nil {
+		DefaultSender = &SMTPSender{Config: c.SMTP}
+	}
+}
+
+// Send send a mail through the DefaultSender
+func Send(to, subject, body string) error {
+	return DefaultSender.Send(to, subject, body)
+}
+
+type nopSender struct{}
+
+func (s *nopSender) Send(to, subject, body string) error {
+	return ErrNotConfigured
+}
+
+// SendMagicLink mail the magic link {link} logging in to {to}
+func SendMagicLink(to, link string) error {
+	return Send(to, "Log in to lln", fmt.Sprintf(
+		"Open the link below to log in, it expires in 15 minutes.\n\n%s\n\n"+
+			"If you did not request it, ignore this mail.\n", link))
+}
+
+// SendPasswordReset mail the password reset link {link} to user {name}
+func SendPasswordReset(to, name, link string) error {
+	return Send(to, "Reset your lln password", fmt.Sprintf(
+		"Hi %s, open the link below to reset your password, it expires in 15 minutes.\n\n%s\n\n"+
+			"If you did not request it, ignore this mail.\n", name, link))
+}
+
+// SMTPSender send mails to an smtp server
+type SMTPSender struct {
+	Config *config.SMTPConfig
+}
+
+func (s *SMTPSender) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid mail header")
+	}
+	from, err := mail.ParseAddress(s.Config.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+	var auth smtp.Auth
+	if len(s.Config.Username) > 0 {
+		host := s.Config.Addr
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Config.Username, s.Config.Password, host)
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", rcpt.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return smtp.SendMail(s.Config.Addr, auth, from.Address, []string{rcpt.Address}, []byte(msg.String()))
+}
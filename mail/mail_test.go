@@ -0,0 +1,129 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/rkonfj/lln/config"
+)
+
+// envelope a mail received by the fake smtp server
+type envelope struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// fakeSMTP accept one smtp session on a local port and send the mail it
+// received to the returned channel
+func fakeSMTP(t *testing.T) (string, <-chan *envelope) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan *envelope, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		e := &envelope{}
+		tp.PrintfLine("220 lln.test ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250-lln.test")
+				tp.PrintfLine("250 8BITMIME")
+			case "MAIL":
+				e.from = strings.Fields(strings.TrimPrefix(line, "MAIL FROM:"))[0]
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				e.rcpt = append(e.rcpt, strings.TrimPrefix(line, "RCPT TO:"))
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				b, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				e.data = string(b)
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				ch <- e
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+// header value of header {key} in the mail data
+func header(data, key string) string {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	h, _ := r.ReadMIMEHeader()
+	return h.Get(key)
+}
+
+func TestSendMails(t *testing.T) {
+	cases := []struct {
+		name    string
+		send    func() error
+		subject string
+		body    []string
+	}{
+		{"magic link", func() error {
+			return SendMagicLink("alice@lln.test", "https://lln.test/login?type=magic&token=t1")
+		}, "Log in to lln", []string{"https://lln.test/login?type=magic&token=t1", "expires in 15 minutes"}},
+		{"password reset", func() error {
+			return SendPasswordReset("alice@lln.test", "Alice", "https://lln.test/login?type=reset&token=t2")
+		}, "Reset your lln password", []string{"Hi Alice", "https://lln.test/login?type=reset&token=t2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, ch := fakeSMTP(t)
+			Init(config.MailConfig{SMTP: &config.SMTPConfig{Addr: addr, From: "lln <noreply@lln.test>"}})
+			t.Cleanup(func() { DefaultSender = &nopSender{} })
+			if err := c.send(); err != nil {
+				t.Fatal(err)
+			}
+			e := <-ch
+			if e.from != "<noreply@lln.test>" || len(e.rcpt) != 1 || e.rcpt[0] != "<alice@lln.test>" {
+				t.Fatalf("unexpected envelope from %s to %v", e.from, e.rcpt)
+			}
+			if got := header(e.data, "To"); got != "<alice@lln.test>" {
+				t.Errorf("unexpected To header %q", got)
+			}
+			if got := header(e.data, "Subject"); got != c.subject {
+				t.Errorf("unexpected Subject header %q", got)
+			}
+			_, body, _ := strings.Cut(e.data, "\n\n")
+			for _, s := range c.body {
+				if !strings.Contains(body, s) {
+					t.Errorf("body %q does not contain %q", body, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	s := &SMTPSender{Config: &config.SMTPConfig{Addr: "127.0.0.1:0", From: "noreply@lln.test"}}
+	if err := s.Send("alice@lln.test\r\nBcc: eve@lln.test", "hi", "body"); err == nil {
+		t.Fatal("recipient with line breaks should be rejected")
+	}
+}
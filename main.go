@@ -9,7 +9,9 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httprate"
 	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/mail"
 	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -55,14 +57,27 @@ func initDaemon(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	mail.Init(config.Conf.Mail)
+
 	// init state
-	err = state.InitState(state.EtcdOptions{
-		Endpoints:     config.Conf.State.Etcd.Endpoints,
-		CertFile:      config.Conf.State.Etcd.CertFile,
-		KeyFile:       config.Conf.State.Etcd.KeyFile,
-		TrustedCAFile: config.Conf.State.Etcd.TrustedCAFile,
+	backend, err := newStateBackend(config.Conf.State)
+	if err != nil {
+		return err
+	}
+	return state.InitState(backend)
+}
+
+func newStateBackend(c config.StateConfig) (store.Backend, error) {
+	if c.Bolt != nil {
+		logrus.Info("using embedded state backend ", c.Bolt.Path)
+		return store.NewBoltBackend(c.Bolt.Path)
+	}
+	return store.NewEtcdBackend(store.EtcdOptions{
+		Endpoints:     c.Etcd.Endpoints,
+		CertFile:      c.Etcd.CertFile,
+		KeyFile:       c.Etcd.KeyFile,
+		TrustedCAFile: c.Etcd.TrustedCAFile,
 	})
-	return err
 }
 
 func startDeamon(cmd *cobra.Command, args []string) error {
@@ -15,8 +15,17 @@ func listMessages(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	msgs, more := state.ListMessages(currentSessionUser(r), opts)
-	json.NewEncoder(w).Encode(L{V: msgs, More: more})
+	user := currentSessionUser(r)
+	msgs, more := state.ListMessages(user, opts)
+	hidden := state.HiddenUsers(user)
+	var ret []*state.Message
+	for _, msg := range msgs {
+		if msg.From != nil && hidden[msg.From.ID] {
+			continue
+		}
+		ret = append(ret, msg)
+	}
+	json.NewEncoder(w).Encode(L{V: ret, More: more})
 }
 
 func deleteMessages(w http.ResponseWriter, r *http.Request) {
@@ -5,28 +5,58 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/rkonfj/lln/config"
 	"github.com/rkonfj/lln/state"
 	"github.com/rkonfj/lln/tools"
 )
 
-func admin(h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("Authorization")
-		if len(apiKey) == 0 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+// permit allow the session user with permission {perm} only, the session
+// must be verified by two-factor authentication
+func permit(perm string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			apiKey := r.Header.Get("Authorization")
+			if len(apiKey) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			ssion := state.DefaultSessionManager.Load(apiKey)
+			if ssion == nil || ssion.IsToken() || !state.HasPermission(ssion.ID, perm) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if !ssion.MFA {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, "two-factor authentication required")
+				return
+			}
+			h.ServeHTTP(w, r)
 		}
-		ssion := state.DefaultSessionManager.Load(apiKey)
-		if ssion == nil || !tools.Contains(config.Conf.Admins, ssion.ID) {
-			w.WriteHeader(http.StatusForbidden)
-			return
+		return http.HandlerFunc(fn)
+	}
+}
+
+// scope allow personal access tokens with scope {s} only, login sessions
+// are always allowed. it must be used after `security`
+func scope(s string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ssion := r.Context().Value(tools.KeySession).(*state.Session)
+			if !ssion.HasScope(s) {
+				w.WriteHeader(http.StatusForbidden)
+				if len(s) > 0 {
+					fmt.Fprintf(w, "scope %s required", s)
+				}
+				return
+			}
+			h.ServeHTTP(w, r)
 		}
-		h.ServeHTTP(w, r)
+		return http.HandlerFunc(fn)
 	}
-	return http.HandlerFunc(fn)
 }
 
+// sessionOnly deny personal access tokens
+var sessionOnly = scope("")
+
 func security(h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.Header.Get("Authorization")
@@ -35,7 +65,7 @@ func security(h http.Handler) http.Handler {
 			return
 		}
 		ssion := state.DefaultSessionManager.Load(apiKey)
-		if ssion == nil {
+		if ssion == nil || ssion.MFAPending {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -47,9 +77,12 @@ func security(h http.Handler) http.Handler {
 func common(h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.Header.Get("Authorization")
-		w.Header().Add("X-Session-Valid", fmt.Sprintf("%t", len(apiKey) > 0 &&
-			state.DefaultSessionManager.Load(apiKey) != nil))
 		ssion := state.DefaultSessionManager.Load(apiKey)
+		// pre-sessions are not logged in until verified
+		if ssion != nil && ssion.MFAPending {
+			ssion = nil
+		}
+		w.Header().Add("X-Session-Valid", fmt.Sprintf("%t", len(apiKey) > 0 && ssion != nil))
 		ctx := r.Context()
 		if ssion != nil {
 			ctx = context.WithValue(ctx, tools.KeySession, ssion)
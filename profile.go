@@ -16,12 +16,15 @@ import (
 
 type User struct {
 	state.User
-	Following  bool  `json:"following"`
-	Followers  int64 `json:"followers"`
-	Followings int64 `json:"followings"`
-	Tweets     int64 `json:"tweets"`
-	Disabled   bool  `json:"disabled"`
-	Admin      bool  `json:"admin"`
+	Following       bool  `json:"following"`
+	FollowRequested bool  `json:"followRequested"`
+	Followers       int64 `json:"followers"`
+	Followings      int64 `json:"followings"`
+	Tweets          int64 `json:"tweets"`
+	Disabled        bool  `json:"disabled"`
+	Admin           bool  `json:"admin"`
+	Blocking        bool  `json:"blocking"`
+	Muting          bool  `json:"muting"`
 }
 
 func profile(w http.ResponseWriter, r *http.Request) {
@@ -43,14 +46,83 @@ func profile(w http.ResponseWriter, r *http.Request) {
 		u.Locale = ""
 	}
 
+	var blocking, muting, followRequested bool
+	if user != nil {
+		blocking = state.Blocked(user.ID, u.ID)
+		muting = state.Muted(user.ID, u.ID)
+		followRequested = state.FollowRequested(user.ID, u.ID)
+	}
+
 	json.NewEncoder(w).Encode(User{
-		User:       *u,
-		Followers:  u.Followers(),
-		Followings: u.Followings(),
-		Tweets:     u.Tweets(),
-		Disabled:   u.Disabled(),
-		Admin:      tools.Contains(config.Conf.Admins, u.ID),
-		Following:  u.FollowingBy(user)})
+		User:            *u,
+		Followers:       u.Followers(),
+		Followings:      u.Followings(),
+		Tweets:          u.Tweets(),
+		Disabled:        u.Disabled(),
+		Admin:           state.HasRole(u.ID, state.RoleAdmin),
+		Following:       u.FollowingBy(user),
+		FollowRequested: followRequested,
+		Blocking:        blocking,
+		Muting:          muting})
+}
+
+// UserRelation a user in followers or followings list with its relation to the session user
+type UserRelation struct {
+	*state.ActUser
+	CreateRev  int64 `json:"createRev"`
+	Following  bool  `json:"following"`
+	FollowedBy bool  `json:"followedBy"`
+	Mutual     bool  `json:"mutual"`
+}
+
+func followers(w http.ResponseWriter, r *http.Request) {
+	abstractListFollows(w, r, (*state.User).ListFollowers)
+}
+
+func followings(w http.ResponseWriter, r *http.Request) {
+	abstractListFollows(w, r, (*state.User).ListFollowings)
+}
+
+func abstractListFollows(w http.ResponseWriter, r *http.Request,
+	list func(*state.User, *tools.PaginationOptions) ([]*state.Follow, bool)) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	uniqueName, err := url.PathUnescape(chi.URLParam(r, tools.UniqueName))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	u := state.UserByUniqueName(uniqueName)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user := currentSessionUser(r)
+	if !state.CanView(user, u.ID) {
+		w.WriteHeader(errorStatusCode(state.ErrPrivateAccount))
+		fmt.Fprint(w, state.ErrPrivateAccount.Error())
+		return
+	}
+	follows, more := list(u, opts)
+	var ret []*UserRelation
+	for _, f := range follows {
+		rel := &UserRelation{ActUser: f.User, CreateRev: f.CreateRev}
+		if user != nil {
+			rel.Following = state.Followed(user.ID, f.User.ID)
+			rel.FollowedBy = state.Followed(f.User.ID, user.ID)
+			rel.Mutual = rel.Following && rel.FollowedBy
+		}
+		ret = append(ret, rel)
+	}
+	json.NewEncoder(w).Encode(L{V: ret, More: more})
 }
 
 func followUser(w http.ResponseWriter, r *http.Request) {
@@ -62,7 +134,54 @@ func followUser(w http.ResponseWriter, r *http.Request) {
 	}
 	err = state.FollowUser(currentSessionUser(r), uniqueName)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatusCode(err))
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func listFollowRequests(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	user := currentSessionUser(r)
+	follows, more := state.ListFollowRequests(user, opts)
+	var ret []*UserRelation
+	for _, f := range follows {
+		ret = append(ret, &UserRelation{ActUser: f.User, CreateRev: f.CreateRev,
+			Following: state.Followed(user.ID, f.User.ID)})
+	}
+	json.NewEncoder(w).Encode(L{V: ret, More: more})
+}
+
+func approveFollowRequest(w http.ResponseWriter, r *http.Request) {
+	abstractUserAction(w, r, state.ApproveFollowRequest)
+}
+
+func rejectFollowRequest(w http.ResponseWriter, r *http.Request) {
+	abstractUserAction(w, r, state.RejectFollowRequest)
+}
+
+func blockUser(w http.ResponseWriter, r *http.Request) {
+	abstractUserAction(w, r, state.BlockUser)
+}
+
+func muteUser(w http.ResponseWriter, r *http.Request) {
+	abstractUserAction(w, r, state.MuteUser)
+}
+
+func abstractUserAction(w http.ResponseWriter, r *http.Request, action func(*state.ActUser, string) error) {
+	uniqueName, err := url.PathUnescape(chi.URLParam(r, tools.UniqueName))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	err = action(currentSessionUser(r), uniqueName)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
 		w.Write([]byte(err.Error()))
 	}
 }
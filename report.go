@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+type ReportOptions struct {
+	Category string `json:"category"`
+	Reason   string `json:"reason"`
+}
+
+type ResolveOptions struct {
+	Action string `json:"action"`
+	Note   string `json:"note"`
+}
+
+func reportStatus(w http.ResponseWriter, r *http.Request) {
+	abstractReport(w, r, state.ReportTargetStatus, chi.URLParam(r, tools.StatusID))
+}
+
+func reportUser(w http.ResponseWriter, r *http.Request) {
+	uniqueName, err := url.PathUnescape(chi.URLParam(r, tools.UniqueName))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	u := state.UserByUniqueName(uniqueName)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	abstractReport(w, r, state.ReportTargetUser, u.ID)
+}
+
+func abstractReport(w http.ResponseWriter, r *http.Request, targetType, targetID string) {
+	req := &ReportOptions{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(req.Reason) > 1024 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("reason is too long"))
+		return
+	}
+	report, err := state.NewReport(&state.ReportOptions{
+		Reporter:   currentSessionUser(r),
+		TargetType: targetType,
+		TargetID:   targetID,
+		Category:   req.Category,
+		Reason:     req.Reason,
+	})
+	if err != nil {
+		if errors.Is(err, state.ErrReported) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func listReports(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	reportState := r.URL.Query().Get("state")
+	if len(reportState) == 0 {
+		reportState = state.ReportStateOpen
+	}
+	reports, more := state.ListReports(reportState, opts)
+	json.NewEncoder(w).Encode(L{V: reports, More: more})
+}
+
+func claimReport(w http.ResponseWriter, r *http.Request) {
+	report := state.GetReport(chi.URLParam(r, tools.ReportID))
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	before := *report
+	if err := report.Claim(currentSessionUser(r),
+		audit(r, "claimReport", "report", report.ID, before, report)); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func resolveReport(w http.ResponseWriter, r *http.Request) {
+	req := &ResolveOptions{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	report := state.GetReport(chi.URLParam(r, tools.ReportID))
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// resolving must not bypass permissions of the action
+	perm, ok := map[string]string{
+		state.ReportActionDeleteStatus: state.PermDeleteStatus,
+		state.ReportActionDisableUser:  state.PermDisableUser,
+		state.ReportActionNotRecommend: state.PermRecommendStatus,
+	}[req.Action]
+	if ok && !state.HasPermission(currentSessionUser(r).ID, perm) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission %s required", perm)
+		return
+	}
+	before := *report
+	if err := report.Resolve(currentSessionUser(r), req.Action, req.Note,
+		audit(r, "resolveReport", "report", report.ID, before, report)); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
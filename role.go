@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+func listRoles(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(R{V: state.ListRoles()})
+}
+
+func putRole(w http.ResponseWriter, r *http.Request) {
+	role := &state.Role{}
+	if err := json.NewDecoder(r.Body).Decode(role); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	role.Name = chi.URLParam(r, tools.Role)
+	before := state.GetRole(role.Name)
+	if err := state.PutRole(role, audit(r, "putRole", "role", role.Name, before, role)); err != nil {
+		if errors.Is(err, state.ErrBuiltinRole) {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprint(w, err.Error())
+		return
+	}
+}
+
+func deleteRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, tools.Role)
+	before := state.GetRole(name)
+	if before == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := state.DeleteRole(name, audit(r, "deleteRole", "role", name, before, nil)); err != nil {
+		if errors.Is(err, state.ErrBuiltinRole) {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, err.Error())
+		return
+	}
+}
+
+func userRoles(w http.ResponseWriter, r *http.Request) {
+	u := state.UserByID(chi.URLParam(r, tools.UID))
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: state.UserRoles(u.ID)})
+}
+
+func putUserRoles(w http.ResponseWriter, r *http.Request) {
+	u := state.UserByID(chi.URLParam(r, tools.UID))
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var roles []string
+	if err := json.NewDecoder(r.Body).Decode(&roles); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	before := state.UserRoles(u.ID)
+	if err := state.SetUserRoles(u.ID, roles,
+		audit(r, "putUserRoles", "user", u.ID, before, roles)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	state.DefaultSessionManager.Expire(u.ID)
+}
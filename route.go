@@ -5,39 +5,81 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/state"
 	"github.com/rkonfj/lln/tools"
 )
 
 func routeAdmin(r *chi.Mux) {
 	r.Route("/v", func(r chi.Router) {
-		r.Use(common, admin)
-		r.Put(fmt.Sprintf("/user/{%s}/verified", tools.UID), userVerified)
-		r.Put("/settings", putSettings)
-		r.Post(fmt.Sprintf("/status/{%s}/recommend", tools.StatusID), recommendStatus)
-		r.Delete(fmt.Sprintf("/status/{%s}/recommend", tools.StatusID), notRecommendStatus)
-		r.Delete(fmt.Sprintf("/status/{%s}", tools.StatusID), deleteStatus)
-		r.Post(fmt.Sprintf("/user/{%s}/disabled", tools.UID), disableUser)
-		r.Delete(fmt.Sprintf("/user/{%s}/disabled", tools.UID), enableUser)
+		r.Use(common)
+		r.With(permit(state.PermVerifyUser)).Put(fmt.Sprintf("/user/{%s}/verified", tools.UID), userVerified)
+		r.With(permit(state.PermManageSettings)).Put("/settings", putSettings)
+		r.With(permit(state.PermRecommendStatus)).Post(fmt.Sprintf("/status/{%s}/recommend", tools.StatusID), recommendStatus)
+		r.With(permit(state.PermRecommendStatus)).Delete(fmt.Sprintf("/status/{%s}/recommend", tools.StatusID), notRecommendStatus)
+		r.With(permit(state.PermDeleteStatus)).Delete(fmt.Sprintf("/status/{%s}", tools.StatusID), removeStatus)
+		r.With(permit(state.PermDisableUser)).Post(fmt.Sprintf("/user/{%s}/disabled", tools.UID), disableUser)
+		r.With(permit(state.PermDisableUser)).Delete(fmt.Sprintf("/user/{%s}/disabled", tools.UID), enableUser)
+		r.With(permit(state.PermReadAudit)).Get("/audit", listAudit)
+		r.With(permit(state.PermModerateReport)).Get("/reports", listReports)
+		r.With(permit(state.PermModerateReport)).Post(fmt.Sprintf("/report/{%s}/claim", tools.ReportID), claimReport)
+		r.With(permit(state.PermModerateReport)).Post(fmt.Sprintf("/report/{%s}/resolve", tools.ReportID), resolveReport)
+		r.With(permit(state.PermManageRoles)).Get("/roles", listRoles)
+		r.With(permit(state.PermManageRoles)).Put(fmt.Sprintf("/role/{%s}", tools.Role), putRole)
+		r.With(permit(state.PermManageRoles)).Delete(fmt.Sprintf("/role/{%s}", tools.Role), deleteRole)
+		r.With(permit(state.PermManageRoles)).Get(fmt.Sprintf("/user/{%s}/roles", tools.UID), userRoles)
+		r.With(permit(state.PermManageRoles)).Put(fmt.Sprintf("/user/{%s}/roles", tools.UID), putUserRoles)
 	})
 }
 
 func routeMustLogin(r *chi.Mux) {
 	r.Route("/i", func(r chi.Router) {
 		r.Use(common, security)
-		r.Post(fmt.Sprintf("/like/status/{%s}", tools.StatusID), likeStatus)
-		r.Post(fmt.Sprintf("/follow/user/{%s}", tools.UniqueName), followUser)
-		r.Post(fmt.Sprintf("/bookmark/status/{%s}", tools.StatusID), bookmarkStatus)
-		r.Post("/status", newStatus)
-		r.Put("/profile", modifyProfile)
-		r.Get("/bookmarks", listBookmarks)
-		r.Get("/messages", listMessages)
-		r.Get("/messages/tips", getNewTipMessages)
+		r.With(scope(state.ScopeLikesWrite)).Post(fmt.Sprintf("/like/status/{%s}", tools.StatusID), likeStatus)
+		r.With(scope(state.ScopeFollowsWrite)).Post(fmt.Sprintf("/follow/user/{%s}", tools.UniqueName), followUser)
+		r.With(scope(state.ScopeFollowsWrite)).Get("/follow-requests", listFollowRequests)
+		r.With(scope(state.ScopeFollowsWrite)).Post(fmt.Sprintf("/follow-request/{%s}/approve", tools.UniqueName), approveFollowRequest)
+		r.With(scope(state.ScopeFollowsWrite)).Delete(fmt.Sprintf("/follow-request/{%s}", tools.UniqueName), rejectFollowRequest)
+		r.With(scope(state.ScopeFollowsWrite)).Post(fmt.Sprintf("/block/user/{%s}", tools.UniqueName), blockUser)
+		r.With(scope(state.ScopeFollowsWrite)).Post(fmt.Sprintf("/mute/user/{%s}", tools.UniqueName), muteUser)
+		r.With(scope(state.ScopeBookmarksWrite)).Post(fmt.Sprintf("/bookmark/status/{%s}", tools.StatusID), bookmarkStatus)
+		r.With(scope(state.ScopeReportsWrite)).Post(fmt.Sprintf("/report/status/{%s}", tools.StatusID), reportStatus)
+		r.With(scope(state.ScopeReportsWrite)).Post(fmt.Sprintf("/report/user/{%s}", tools.UniqueName), reportUser)
+		r.With(scope(state.ScopeStatusWrite)).Post("/status", newStatus)
+		r.With(scope(state.ScopeStatusWrite)).Get("/drafts", listDrafts)
+		r.With(scope(state.ScopeStatusWrite)).Post("/drafts", createDraft)
+		r.With(scope(state.ScopeStatusWrite)).Put(fmt.Sprintf("/draft/{%s}", tools.DraftID), updateDraft)
+		r.With(scope(state.ScopeStatusWrite)).Delete(fmt.Sprintf("/draft/{%s}", tools.DraftID), deleteDraft)
+		r.With(scope(state.ScopeStatusWrite)).Post(fmt.Sprintf("/draft/{%s}/publish", tools.DraftID), publishDraft)
+		r.With(scope(state.ScopeStatusWrite)).Post(fmt.Sprintf("/repost/status/{%s}", tools.StatusID), repostStatus)
+		r.With(scope(state.ScopePollsWrite)).Post(fmt.Sprintf("/vote/status/{%s}", tools.StatusID), votePoll)
+		r.With(scope(state.ScopeProfileWrite)).Put("/profile", modifyProfile)
+		r.With(scope(state.ScopeBookmarksRead)).Get("/bookmarks", listBookmarks)
+		r.With(scope(state.ScopeTimelineRead)).Get("/timeline", timeline)
+		r.With(scope(state.ScopeMessagesRead)).Get("/messages", listMessages)
+		r.With(scope(state.ScopeMessagesRead)).Get("/messages/tips", getNewTipMessages)
 		r.Get("/restriction", config.GetRestriction)
-		r.Get("/signed-upload-url", signRequest)
-		r.Delete("/messages", deleteMessages)
-		r.Delete("/messages/tips", deleteTipMessages)
-		r.Delete("/authorize", deleteAuthorize)
-		r.Delete(fmt.Sprintf("/status/{%s}", tools.StatusID), deleteStatus)
+		r.With(scope(state.ScopeMediaWrite)).Get("/signed-upload-url", signRequest)
+		r.With(scope(state.ScopeMessagesWrite)).Delete("/messages", deleteMessages)
+		r.With(scope(state.ScopeMessagesWrite)).Delete("/messages/tips", deleteTipMessages)
+		r.With(sessionOnly).Delete("/authorize", deleteAuthorize)
+		r.With(sessionOnly).Get("/sessions", listSessions)
+		r.With(sessionOnly).Delete(fmt.Sprintf("/sessions/{%s}", tools.SessionID), deleteSession)
+		r.With(sessionOnly).Get("/export", exportData)
+		r.With(sessionOnly).Delete("/account", deleteAccount)
+		r.With(sessionOnly).Put("/password", putPassword)
+		r.With(sessionOnly).Get("/2fa", twoFactorStatus)
+		r.With(sessionOnly).Post("/2fa/totp", enrollTOTP)
+		r.With(sessionOnly).Post("/2fa/totp/enable", enableTOTP)
+		r.With(sessionOnly).Delete("/2fa/totp", disableTOTP)
+		r.With(sessionOnly).Post("/2fa/recovery-codes", regenerateRecoveryCodes)
+		r.With(sessionOnly).Get("/identities", listIdentities)
+		r.With(sessionOnly).Post(fmt.Sprintf("/identity/{%s}", tools.Provider), linkIdentity)
+		r.With(sessionOnly).Delete(fmt.Sprintf("/identity/{%s}", tools.Provider), unlinkIdentity)
+		r.With(sessionOnly).Get("/tokens", listTokens)
+		r.With(sessionOnly).Post("/tokens", createToken)
+		r.With(sessionOnly).Delete(fmt.Sprintf("/tokens/{%s}", tools.SessionID), deleteToken)
+		r.With(scope(state.ScopeStatusWrite)).Delete(fmt.Sprintf("/status/{%s}", tools.StatusID), deleteStatus)
+		r.With(scope(state.ScopeStatusWrite)).Put(fmt.Sprintf("/status/{%s}", tools.StatusID), editStatus)
 	})
 }
 
@@ -47,12 +89,24 @@ func routeAnonymous(r *chi.Mux) {
 		r.Post(fmt.Sprintf("/authorize/{%s}", tools.Provider), authorize)
 		r.Get(fmt.Sprintf("/authorize/{%s}", tools.Provider), authorize)
 		r.Get(fmt.Sprintf("/oidc/{%s}", tools.Provider), oidcRedirect)
+		r.Post("/2fa/verify", verifyLogin)
+		if config.Conf.Local != nil {
+			r.Post("/local/login", passwordLogin)
+			r.Post("/local/magic", sendMagicLink)
+			r.Post("/local/magic/login", magicLogin)
+			r.Post("/local/reset", sendPasswordReset)
+			r.Post("/local/reset/password", resetPassword)
+		}
 		r.Get(fmt.Sprintf("/user/{%s}", tools.UniqueName), profile)
 		r.Get(fmt.Sprintf("/user/{%s}/status", tools.UniqueName), userStatus)
+		r.Get(fmt.Sprintf("/user/{%s}/followers", tools.UniqueName), followers)
+		r.Get(fmt.Sprintf("/user/{%s}/following", tools.UniqueName), followings)
 		r.Get(fmt.Sprintf("/status/{%s}", tools.StatusID), status)
 		r.Get(fmt.Sprintf("/status/{%s}/comments", tools.StatusID), statusComments)
+		r.Get(fmt.Sprintf("/status/{%s}/revisions", tools.StatusID), statusRevisions)
 		r.Get(fmt.Sprintf("/explore/status/{%s}/comment", tools.StatusID), exploreStatusComment)
 		r.Get("/search", search)
+		r.Get("/search/user", searchUser)
 		r.Get("/explore", explore)
 		r.Get("/explore/news-probe", exploreNewsProbe)
 		r.Get("/labels", labels)
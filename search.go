@@ -24,16 +24,16 @@ func search(w http.ResponseWriter, r *http.Request) {
 	if t == "label" {
 		ss, more = state.ListStatusByLabel(value, opts)
 	} else {
-		ss = state.ListStatusByKeyword(value, opts)
+		ss, more = state.ListStatusByKeyword(currentSessionUser(r), value, opts)
 	}
 
 	user := currentSessionUser(r)
 	var ret []*Status
-	for _, s := range ss {
+	for _, s := range filterInvisible(ss, user) {
 		status := castStatus(s, user)
 		if len(s.RefStatus) > 0 {
 			prev := state.GetStatus(s.RefStatus)
-			if prev != nil {
+			if prev != nil && prev.VisibleTo(user) {
 				status.RefStatus = castStatus(prev, user)
 			}
 		}
@@ -41,3 +41,17 @@ func search(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(L{V: ret, More: more})
 }
+
+func searchUser(w http.ResponseWriter, r *http.Request) {
+	size, err := tools.URLQueryInt64Default(r, "size", 10)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if size > 50 {
+		size = 50
+	}
+	users := state.SearchUsers(r.URL.Query().Get("value"), size)
+	json.NewEncoder(w).Encode(L{V: users})
+}
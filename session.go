@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+// Session a login session or token of the session user, the api key is
+// never exposed except when a token is created
+type Session struct {
+	SID        string    `json:"sid"`
+	ApiKey     string    `json:"apiKey,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	CreateTime time.Time `json:"createTime"`
+	ExpireTime time.Time `json:"expireTime,omitempty"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Current    bool      `json:"current"`
+}
+
+type TokenOptions struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn seconds the token is valid for, never expires when 0
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+func castSession(s *state.Session, current *state.Session) *Session {
+	ret := &Session{
+		SID:        s.SID,
+		CreateTime: s.CreateTime,
+		LastSeen:   s.LastSeen,
+		Current:    s.SID == current.SID,
+	}
+	if s.IsToken() {
+		ret.Name = s.TokenName
+		ret.Scopes = s.Scopes
+		ret.ExpireTime = s.ExpireTime
+	} else {
+		ret.IP = s.IP
+		ret.UserAgent = s.UserAgent
+	}
+	return ret
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	abstractListSessions(w, r, false)
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	abstractListSessions(w, r, true)
+}
+
+func abstractListSessions(w http.ResponseWriter, r *http.Request, token bool) {
+	current := r.Context().Value(tools.KeySession).(*state.Session)
+	var ret []*Session
+	for _, s := range state.DefaultSessionManager.List(current.ID) {
+		if s.IsToken() == token {
+			ret = append(ret, castSession(s, current))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].LastSeen.After(ret[j].LastSeen) })
+	json.NewEncoder(w).Encode(R{V: ret})
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	abstractRevoke(w, r, false)
+}
+
+func deleteToken(w http.ResponseWriter, r *http.Request) {
+	abstractRevoke(w, r, true)
+}
+
+func abstractRevoke(w http.ResponseWriter, r *http.Request, token bool) {
+	current := r.Context().Value(tools.KeySession).(*state.Session)
+	sid := chi.URLParam(r, tools.SessionID)
+	for _, s := range state.DefaultSessionManager.List(current.ID) {
+		if s.SID != sid || s.IsToken() != token {
+			continue
+		}
+		if err := state.DefaultSessionManager.Revoke(s.SID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func createToken(w http.ResponseWriter, r *http.Request) {
+	current := r.Context().Value(tools.KeySession).(*state.Session)
+	req := &TokenOptions{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	s, err := state.CreateToken(current.ID, &state.TokenOptions{
+		Name:   req.Name,
+		Scopes: req.Scopes,
+		TTL:    time.Duration(req.ExpiresIn) * time.Second,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	token := castSession(s, current)
+	token.ApiKey = s.ApiKey
+	json.NewEncoder(w).Encode(R{V: token})
+}
@@ -13,6 +13,7 @@ type Settings struct {
 	state.Settings
 	Status        config.StatusConfig `json:"status"`
 	OIDCProviders []string            `json:"oidcProviders"`
+	LocalAuth     bool                `json:"localAuth"`
 }
 
 func settings(w http.ResponseWriter, r *http.Request) {
@@ -29,6 +30,7 @@ func settings(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(R{V: Settings{
 		Settings:      *s,
 		OIDCProviders: config.OIDCProviders(),
+		LocalAuth:     config.Conf.Local != nil,
 		Status:        config.Conf.Model.Status,
 	}})
 	if err != nil {
@@ -45,9 +47,16 @@ func putSettings(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err.Error())
 		return
 	}
-	err = state.UpdateSettings(&s)
+	before, err := state.GetSettings()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
+		return
+	}
+	err = state.UpdateSettings(&s, audit(r, "putSettings", "settings", "", before, s))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
 	}
 }
@@ -0,0 +1,372 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tAccountDeletion string = "/account-deletion/%s"
+
+	// phases of the account deletion, each phase is idempotent so that an
+	// interrupted job is resumed from its phase
+	accountDeletionPhases []string = []string{
+		"login", "likes", "bookmarks", "votes", "follows", "statuses", "messages", "user", "done"}
+
+	// accountDeletionBatch keys deleted in one txn
+	accountDeletionBatch int64 = 32
+	// accountDeletionRetry unfinished jobs are retried at this interval
+	accountDeletionRetry time.Duration = time.Minute
+
+	// DeletedUser author of statuses kept after their author is deleted
+	DeletedUser *ActUser = &ActUser{Name: "[deleted]"}
+)
+
+// AccountDeletion background job deleting all data of a user
+type AccountDeletion struct {
+	UserID string `json:"uid"`
+	// Email and UniqueName are needed when the user is gone, they are
+	// cleared when the job is done
+	Email      string    `json:"email,omitempty"`
+	UniqueName string    `json:"uniqueName,omitempty"`
+	Phase      string    `json:"phase"`
+	CreateTime time.Time `json:"createTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+func (d *AccountDeletion) key() string {
+	return stateKey(fmt.Sprintf(tAccountDeletion, d.UserID))
+}
+
+func (d *AccountDeletion) Done() bool {
+	return d.Phase == accountDeletionPhases[len(accountDeletionPhases)-1]
+}
+
+func (d *AccountDeletion) save() error {
+	d.UpdateTime = time.Now()
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return backend.Put(context.Background(), d.key(), string(b))
+}
+
+// DeleteAccount log out and disable user u, then schedule the deletion of
+// all the data of the user. the user can't login or write anything meanwhile
+func DeleteAccount(u *User) (*AccountDeletion, error) {
+	d := &AccountDeletion{
+		UserID:     u.ID,
+		Email:      u.Email,
+		UniqueName: u.UniqueName,
+		Phase:      accountDeletionPhases[0],
+		CreateTime: time.Now(),
+	}
+	d.UpdateTime = d.CreateTime
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(d.key()), "=", 0)).
+		Then(store.OpPut(d.key(), string(b)),
+			store.OpPut(stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)), "")).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, ErrAccountDeleting
+	}
+	// the worker may start later, the user is logged out right now
+	if err := revokeAllSessions(u.ID); err != nil {
+		logrus.Error("revoke sessions of deleting account error: ", err)
+	}
+	return d, nil
+}
+
+// accountDeleting determine if the account of {uid} is being deleted or
+// deleted already, user ids are never reused
+func accountDeleting(uid string) bool {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tAccountDeletion, uid)))
+	if err != nil {
+		logrus.Error(err)
+		return true
+	}
+	return len(resp.Kvs) > 0
+}
+
+func revokeAllSessions(uid string) error {
+	for _, s := range DefaultSessionManager.List(uid) {
+		if err := DefaultSessionManager.Revoke(s.SID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run the job from its phase until done
+func (d *AccountDeletion) run() error {
+	for !d.Done() {
+		logrus.Infof("[account-deletion] user %s phase %s", d.UserID, d.Phase)
+		if err := d.runPhase(); err != nil {
+			return fmt.Errorf("phase %s: %w", d.Phase, err)
+		}
+		for i, p := range accountDeletionPhases {
+			if p == d.Phase {
+				d.Phase = accountDeletionPhases[i+1]
+				break
+			}
+		}
+		if d.Done() {
+			d.Email = ""
+			d.UniqueName = ""
+		}
+		if err := d.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *AccountDeletion) runPhase() error {
+	uid := d.UserID
+	switch d.Phase {
+	case "login":
+		if err := revokeAllSessions(uid); err != nil {
+			return err
+		}
+		ops := []store.Op{
+			store.OpDelete(stateKey(fmt.Sprintf(tPassword, uid))),
+			store.OpDelete(stateKey(fmt.Sprintf(tTOTP, uid))),
+			store.OpDelete(stateKey(fmt.Sprintf(tUserRoles, uid))),
+		}
+		if len(d.Email) > 0 {
+			ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf("/email/%s", d.Email))))
+		}
+		if _, err := backend.Txn(context.Background()).Then(ops...).Commit(); err != nil {
+			return err
+		}
+		return deleteByPrefix(fmt.Sprintf(tUserIdentity, uid, ""), func(_ string, value []byte) ([]store.Op, error) {
+			i := &Identity{}
+			if err := json.Unmarshal(value, i); err != nil {
+				return nil, err
+			}
+			return []store.Op{store.OpDelete(i.key())}, nil
+		})
+	case "likes":
+		return deleteByPrefix(fmt.Sprintf("/like/%s/status/", uid), func(statusID string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(statusLikeKey(statusID, uid))}, nil
+		})
+	case "bookmarks":
+		return deleteByPrefix(fmt.Sprintf("/bookmark/%s/", uid), func(statusID string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf("/bookmark/status/%s/%s", statusID, uid)))}, nil
+		})
+	case "votes":
+		return deleteByPrefix(fmt.Sprintf(tUserVote, uid, ""), func(statusID string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tVote, statusID, uid)))}, nil
+		})
+	case "follows":
+		err := deleteByPrefix(fmt.Sprintf(tFollowUser, uid, ""), func(follower string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tFollowingUser, follower, uid)))}, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = deleteByPrefix(fmt.Sprintf(tFollowingUser, uid, ""), func(following string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tFollowUser, following, uid)))}, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = deleteByPrefix(fmt.Sprintf(tFollowRequest, uid, ""), func(requester string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tFollowRequested, requester, uid)))}, nil
+		})
+		if err != nil {
+			return err
+		}
+		return deleteByPrefix(fmt.Sprintf(tFollowRequested, uid, ""), func(target string, _ []byte) ([]store.Op, error) {
+			return []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tFollowRequest, target, uid)))}, nil
+		})
+	case "statuses":
+		return deleteByPrefix(fmt.Sprintf("/%s/status/", uid), func(statusID string, _ []byte) ([]store.Op, error) {
+			return deleteStatusOfAccount(uid, statusID)
+		})
+	case "messages":
+		for _, prefix := range []string{
+			fmt.Sprintf("/message/%s/", uid),
+			fmt.Sprintf("/tips/message/%s/", uid),
+			fmt.Sprintf(tTimeline, uid, ""),
+			fmt.Sprintf(tBlockUser, uid, ""),
+			fmt.Sprintf(tMuteUser, uid, ""),
+			fmt.Sprintf(tDraft, uid, ""),
+			fmt.Sprintf(tScheduled, uid, ""),
+		} {
+			if err := deleteByPrefix(prefix, nil); err != nil {
+				return err
+			}
+		}
+		if err := deleteMessagesFrom(uid); err != nil {
+			return err
+		}
+		return Del(fmt.Sprintf(tTimelineFanIn, uid))
+	case "user":
+		// the user is kept disabled, so leftover sessions can't write anything
+		ops := []store.Op{
+			store.OpDelete(stateKey(fmt.Sprintf(tUser, uid))),
+			store.OpDelete(stateKey(fmt.Sprintf(tPrivateUser, uid))),
+		}
+		if len(d.UniqueName) > 0 {
+			ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf("/uniqueName/%s", d.UniqueName))))
+		}
+		ops = append(ops, unindexUserOps(uid)...)
+		_, err := backend.Txn(context.Background()).Then(ops...).Commit()
+		return err
+	}
+	return fmt.Errorf("unknown phase %s", d.Phase)
+}
+
+// deleteStatusOfAccount delete the status, statuses with comments are
+// kept for the conversation but their content and author are removed
+func deleteStatusOfAccount(uid, statusID string) ([]store.Op, error) {
+	ops := []store.Op{
+		store.OpDelete(stateKey(fmt.Sprintf("/recommended/status/%s", statusID))),
+	}
+	s := GetStatus(statusID)
+	if s == nil || s.User.ID != uid {
+		return ops, nil
+	}
+	err := s.Delete(uid)
+	if err == nil {
+		return append(ops, store.OpDelete(stateKey(fmt.Sprintf("/recycle/status/%s", statusID)))), nil
+	}
+	if !errors.Is(err, ErrStatusQuotes) {
+		return nil, err
+	}
+	cmps, anonymizeOps, err := tombstoneStatusOps(statusID, DeletedUser)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := backend.Txn(context.Background()).If(cmps...).Then(anonymizeOps...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, ErrTryAgainLater
+	}
+	return ops, nil
+}
+
+// deleteMessagesFrom delete messages the user sent to other users by the
+// sender index
+func deleteMessagesFrom(uid string) error {
+	return deleteByPrefix(fmt.Sprintf(tMessageFrom, uid, ""), func(id string, _ []byte) ([]store.Op, error) {
+		return []store.Op{
+			store.OpDelete(stateKey("/message/" + id)),
+			store.OpDelete(stateKey("/tips/message/" + id)),
+		}, nil
+	})
+}
+
+// deleteByPrefix delete keys with the prefix in batches, ops returned by
+// {related} for each key suffix and value are committed in the same txn
+func deleteByPrefix(prefix string, related func(id string, value []byte) ([]store.Op, error)) error {
+	fullPrefix := stateKey(prefix)
+	for {
+		resp, err := backend.Get(context.Background(), fullPrefix,
+			store.WithPrefix(), store.WithLimit(accountDeletionBatch))
+		if err != nil {
+			return err
+		}
+		if resp.Count == 0 {
+			return nil
+		}
+		ops := []store.Op{}
+		for _, kv := range resp.Kvs {
+			ops = append(ops, store.OpDelete(string(kv.Key)))
+			if related == nil {
+				continue
+			}
+			relatedOps, err := related(strings.TrimPrefix(string(kv.Key), fullPrefix), kv.Value)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, relatedOps...)
+		}
+		if _, err := backend.Txn(context.Background()).Then(ops...).Commit(); err != nil {
+			return err
+		}
+		if !resp.More {
+			return nil
+		}
+	}
+}
+
+// runAccountDeletions run all unfinished jobs
+func runAccountDeletions() {
+	// messages are deleted by the sender index
+	if err := indexMessageSenders(); err != nil {
+		logrus.Error("[account-deletion] index messages by sender: ", err)
+		return
+	}
+	err := IterateWithPrefix(fmt.Sprintf(tAccountDeletion, ""), func(key string, value []byte) {
+		d := &AccountDeletion{}
+		if err := json.Unmarshal(value, d); err != nil {
+			logrus.Error(err)
+			return
+		}
+		if d.Done() {
+			return
+		}
+		if err := d.run(); err != nil {
+			logrus.Errorf("[account-deletion] user %s error: %s", d.UserID, err)
+		}
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func keepAccountDeletionLoop() {
+	mutex, err := backend.NewMutex(stateKey("/election/account-deletion"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Info("[account-deletion] act as leader")
+
+	rch := backend.Watch(context.Background(), stateKey(fmt.Sprintf(tAccountDeletion, "")),
+		store.WithPrefix())
+	ticker := time.NewTicker(accountDeletionRetry)
+	defer ticker.Stop()
+
+	runAccountDeletions()
+	for {
+		select {
+		case wresp, ok := <-rch:
+			if !ok {
+				return
+			}
+			for _, ev := range wresp.Events {
+				if ev.IsCreate() {
+					runAccountDeletions()
+					break
+				}
+			}
+		case <-ticker.C:
+			runAccountDeletions()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+)
+
+var tAudit string = "/audit/%s"
+
+type AuditEntry struct {
+	ID         string          `json:"id"`
+	Admin      *ActUser        `json:"admin"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetID"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreateTime time.Time       `json:"createTime"`
+	CreateRev  int64           `json:"createRev"`
+}
+
+type AuditOptions struct {
+	Admin      *ActUser
+	Action     string
+	TargetType string
+	TargetID   string
+	Before     any
+	After      any
+}
+
+// auditOps build the op appending an entry to the admin audit log, so that
+// the entry is committed with the action. entries are never modified or
+// deleted. nil {opts} means the action is not audited
+func auditOps(opts *AuditOptions) ([]store.Op, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	before, err := json.Marshal(opts.Before)
+	if err != nil {
+		return nil, err
+	}
+	after, err := json.Marshal(opts.After)
+	if err != nil {
+		return nil, err
+	}
+	e := &AuditEntry{
+		ID:         base58.Encode(xid.New().Bytes()),
+		Admin:      opts.Admin,
+		Action:     opts.Action,
+		TargetType: opts.TargetType,
+		TargetID:   opts.TargetID,
+		Before:     before,
+		After:      after,
+		CreateTime: time.Now(),
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return []store.Op{store.OpPut(stateKey(fmt.Sprintf(tAudit, e.ID)), string(b))}, nil
+}
+
+// commitAudited commit {ops} with the audit entry, ErrTryAgainLater when
+// any of {cmps} fails
+func commitAudited(audit *AuditOptions, cmps []store.Cmp, ops ...store.Op) error {
+	aOps, err := auditOps(audit)
+	if err != nil {
+		return err
+	}
+	resp, err := backend.Txn(context.Background()).If(cmps...).
+		Then(append(ops, aOps...)...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrTryAgainLater
+	}
+	return nil
+}
+
+func ListAudit(opts *tools.PaginationOptions) (entries []*AuditEntry, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tAudit, "")), opts)
+	for _, kv := range kvs {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(kv.Value, e); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		e.CreateRev = kv.CreateRevision
+		entries = append(entries, e)
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tBlockUser string = "/block/%s/%s"
+	tMuteUser  string = "/mute/%s/%s"
+)
+
+// blockKey the key exists when {uid} blocked {blockedUID}
+func blockKey(uid, blockedUID string) string {
+	return stateKey(fmt.Sprintf(tBlockUser, uid, blockedUID))
+}
+
+// notBlocked txn condition that {uid} not blocked {blockedUID}
+func notBlocked(uid, blockedUID string) store.Cmp {
+	return store.Compare(store.Version(blockKey(uid, blockedUID)), "=", 0)
+}
+
+// blockedOr figure out if a failed txn is caused by a block
+func blockedOr(err error, blocks ...string) error {
+	for _, key := range blocks {
+		resp, e := backend.Get(context.Background(), key, store.WithCountOnly())
+		if e != nil {
+			logrus.Error(e)
+			continue
+		}
+		if resp.Count > 0 {
+			return ErrBlocked
+		}
+	}
+	return err
+}
+
+// mentionable users with {uniqueNames} who didn't block {uid}. users blocking
+// the author are dropped from the mentions instead of failing the status, so
+// the author can't tell who blocked them
+func mentionable(uid string, uniqueNames []string) (users []*User) {
+	for _, at := range tools.Unique(uniqueNames) {
+		if u := UserByUniqueName(at); u != nil && !Blocked(u.ID, uid) {
+			users = append(users, u)
+		}
+	}
+	return
+}
+
+// BlockUser block or unblock user with {uniqueName}. the blocked user can
+// not follow, comment, mention, like or bookmark me anymore, follow
+// relations and follow requests between us are removed
+func BlockUser(user *ActUser, uniqueName string) error {
+	targetUser := UserByUniqueName(uniqueName)
+	if targetUser == nil {
+		return errors.New("not found")
+	}
+	if targetUser.ID == user.ID {
+		return errors.New("can not block yourself")
+	}
+	key := blockKey(user.ID, targetUser.ID)
+	b, err := json.Marshal(targetUser.ToActUser())
+	if err != nil {
+		return err
+	}
+	_, err = backend.Txn(context.Background()).
+		If(store.Compare(store.Version(key), ">", 0)).
+		Then(store.OpDelete(key)).
+		Else(store.OpPut(key, string(b)),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowUser, user.ID, targetUser.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowingUser, targetUser.ID, user.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowUser, targetUser.ID, user.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowingUser, user.ID, targetUser.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequest, user.ID, targetUser.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequested, targetUser.ID, user.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequest, targetUser.ID, user.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequested, user.ID, targetUser.ID)))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	// follow relations may be removed
+	rerankUser(user.ID)
+	rerankUser(targetUser.ID)
+	return nil
+}
+
+// MuteUser mute or unmute user with {uniqueName}. statuses and messages
+// of the muted user are hidden from me
+func MuteUser(user *ActUser, uniqueName string) error {
+	targetUser := UserByUniqueName(uniqueName)
+	if targetUser == nil {
+		return errors.New("not found")
+	}
+	if targetUser.ID == user.ID {
+		return errors.New("can not mute yourself")
+	}
+	key := stateKey(fmt.Sprintf(tMuteUser, user.ID, targetUser.ID))
+	b, err := json.Marshal(targetUser.ToActUser())
+	if err != nil {
+		return err
+	}
+	_, err = backend.Txn(context.Background()).
+		If(store.Compare(store.Version(key), ">", 0)).
+		Then(store.OpDelete(key)).
+		Else(store.OpPut(key, string(b))).
+		Commit()
+	return err
+}
+
+// Blocked determine if {uid} blocked {blockedUID}
+func Blocked(uid, blockedUID string) bool {
+	return countKeys(blockKey(uid, blockedUID)) > 0
+}
+
+// Muted determine if {uid} muted {mutedUID}
+func Muted(uid, mutedUID string) bool {
+	return countKeys(stateKey(fmt.Sprintf(tMuteUser, uid, mutedUID))) > 0
+}
+
+// HiddenUsers users blocked or muted by user, they are hidden from user
+func HiddenUsers(user *ActUser) map[string]bool {
+	hidden := make(map[string]bool)
+	if user == nil {
+		return hidden
+	}
+	for _, t := range []string{tBlockUser, tMuteUser} {
+		prefix := fmt.Sprintf(t, user.ID, "")
+		err := IterateWithPrefix(prefix, func(key string, _ []byte) {
+			hidden[strings.TrimPrefix(key, stateKey(prefix))] = true
+		})
+		if err != nil {
+			logrus.Error("load hidden users error: ", err)
+		}
+	}
+	return hidden
+}
@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func BookmarkStatus(user *ActUser, statusID string) error {
@@ -19,9 +19,9 @@ func BookmarkStatus(user *ActUser, statusID string) error {
 	bookmarkKey := stateKey(fmt.Sprintf("/bookmark/%s/%s", user.ID, statusID))
 	bookmarkStatusKey := stateKey(fmt.Sprintf("/bookmark/status/%s/%s", statusID, user.ID))
 
-	ops := []clientv3.Op{
-		clientv3.OpPut(bookmarkKey, stateKey(fmt.Sprintf("/status/%s", statusID))),
-		clientv3.OpPut(bookmarkStatusKey, string(b)),
+	ops := []store.Op{
+		store.OpPut(bookmarkKey, stateKey(fmt.Sprintf("/status/%s", statusID))),
+		store.OpPut(bookmarkStatusKey, string(b)),
 	}
 	ops = append(ops, newMessageOps(MsgOptions{
 		from:     user,
@@ -31,12 +31,28 @@ func BookmarkStatus(user *ActUser, statusID string) error {
 		message:  s.Overview(),
 	})...)
 
-	_, err := etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.Version(bookmarkKey), ">", 0)).
-		Then(clientv3.OpDelete(bookmarkKey), clientv3.OpDelete(bookmarkStatusKey)).
-		Else(ops...).
+	if Bookmarked(statusID, user.ID) {
+		_, err := backend.Txn(context.Background()).
+			Then(store.OpDelete(bookmarkKey), store.OpDelete(bookmarkStatusKey)).Commit()
+		return err
+	}
+
+	if !s.VisibleTo(user) {
+		return ErrStatusNotFound
+	}
+
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(bookmarkKey), "=", 0),
+			notBlocked(s.User.ID, user.ID)).
+		Then(ops...).
 		Commit()
-	return err
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return blockedOr(ErrTryAgainLater, blockKey(s.User.ID, user.ID))
+	}
+	return nil
 }
 
 func ListBookmarks(user *ActUser, opts *tools.PaginationOptions) ([]*Status, bool) {
@@ -45,7 +61,7 @@ func ListBookmarks(user *ActUser, opts *tools.PaginationOptions) ([]*Status, boo
 
 func Bookmarked(statusID, uid string) bool {
 	bookmarkKey := stateKey(fmt.Sprintf("/bookmark/%s/%s", uid, statusID))
-	resp, err := etcdClient.KV.Get(context.Background(), bookmarkKey, clientv3.WithCountOnly())
+	resp, err := backend.Get(context.Background(), bookmarkKey, store.WithCountOnly())
 	if err != nil {
 		logrus.Error(err)
 		return false
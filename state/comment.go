@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type StatusCommentsOptions struct {
@@ -27,7 +27,7 @@ func commentsCount(statusID string) int64 {
 }
 
 func viewCount(statusID string) int64 {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/views/status/%s", statusID)))
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/views/status/%s", statusID)))
 	if err != nil {
 		logrus.Errorf("status %s view count etcd error: %s", statusID, err)
 		return 0
@@ -40,8 +40,8 @@ func viewCount(statusID string) int64 {
 }
 
 func countKeys(key string) int64 {
-	resp, err := etcdClient.KV.Get(context.Background(), key,
-		clientv3.WithCountOnly(), clientv3.WithPrefix())
+	resp, err := backend.Get(context.Background(), key,
+		store.WithCountOnly(), store.WithPrefix())
 	if err != nil {
 		logrus.Debug(err)
 		return -1
@@ -5,13 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
 var (
@@ -40,6 +40,12 @@ func startKeepConsistency() {
 	go keepStatusViewCountConsistentLoop()
 	go keepSessionConsistentLoop()
 	go keepRecommendedStatusLoop()
+	go rebuildSearchIndex()
+	go rebuildUserIndex()
+	go keepTimelineFanOutLoop()
+	go keepAccountDeletionLoop()
+	go keepPollCloseLoop()
+	go keepScheduledStatusLoop()
 }
 
 func keepStatusUserConsistentLoop() {
@@ -69,7 +75,7 @@ func keepStatusUserConsistentLoop() {
 						logrus.Debug(err)
 						continue
 					}
-					_, err = etcdClient.Put(context.Background(), key, string(b))
+					err = backend.Put(context.Background(), key, string(b))
 					if err != nil {
 						logrus.Error(err)
 					}
@@ -105,50 +111,50 @@ func keepStatusViewCountConsistentLoop() {
 }
 
 func keepSessionConsistentLoop() {
-	rch := etcdClient.Watch(context.Background(), stateKey("/session/"),
-		clientv3.WithPrefix(), clientv3.WithPrevKV())
+	rch := backend.Watch(context.Background(), stateKey("/session/"),
+		store.WithPrefix(), store.WithPrevKV())
 	sm := DefaultSessionManager.(*PersistentSessionManager)
+	prefix := stateKey(fmt.Sprintf(tSession, ""))
 	for wresp := range rch {
 		for _, ev := range wresp.Events {
-			if ev.IsCreate() {
+			keyHash := strings.TrimPrefix(string(ev.Kv.Key), prefix)
+			// raw api key of sessions persisted before hashing, they are migrated
+			if strings.HasPrefix(keyHash, "sk-") {
+				continue
+			}
+			if ev.Type == store.EventTypePut {
 				s := Session{}
 				err := json.Unmarshal(ev.Kv.Value, &s)
 				if err != nil {
-					logrus.Error("[session create] invalid session struct: ", err)
+					logrus.Error("[session put] invalid session struct: ", err)
 					continue
 				}
-				err = sm.MemorySessionManger.Create(&s)
-				if err != nil {
-					logrus.Error("[session create] create error: ", err)
-				}
-				logrus.Debug("[session create] synced session ", s.ApiKey)
+				s.keyHash = keyHash
+				s.lease = ev.Kv.Lease
+				sm.lock.Lock()
+				sm.put(&s)
+				sm.lock.Unlock()
+				logrus.Debug("[session put] synced session ", s.SID)
 			}
 
-			if ev.Type == clientv3.EventTypeDelete {
-				s := Session{}
-				err := json.Unmarshal(ev.PrevKv.Value, &s)
-				if err != nil {
-					logrus.Error("[session delete] invalid session struct: ", err)
-					continue
-				}
-				err = sm.MemorySessionManger.Delete(s.ApiKey)
+			if ev.Type == store.EventTypeDelete {
+				err := sm.MemorySessionManger.delete(keyHash)
 				if err != nil {
 					logrus.Error("[session delete] delete error: ", err)
 				}
-				logrus.Debug("[session delete] removed session ", s.ApiKey)
+				logrus.Debug("[session delete] removed session ", keyHash)
 			}
 		}
 	}
 }
 
 func keepRecommendedStatusLoop() {
-	session, err := concurrency.NewSession(etcdClient)
+	mutex, err := backend.NewMutex(stateKey("/election/recommended"))
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
-	defer session.Close()
-	mutex := concurrency.NewMutex(session, stateKey("/election/recommended"))
+	defer mutex.Close()
 
 	if err := mutex.Lock(context.Background()); err != nil {
 		logrus.Error(err)
@@ -157,7 +163,7 @@ func keepRecommendedStatusLoop() {
 
 	logrus.Info("[recommended-algo] act as leader")
 
-	lastCreateRev, err := etcdClient.KV.Get(context.Background(), lastStatusCreateRev)
+	lastCreateRev, err := backend.Get(context.Background(), lastStatusCreateRev)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -173,12 +179,12 @@ func keepRecommendedStatusLoop() {
 		}
 	}
 
-	opts := []clientv3.OpOption{
-		clientv3.WithLimit(1024),
-		clientv3.WithPrefix(),
-		clientv3.WithMinCreateRev(createRev + 1),
-		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend)}
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey("/status/"), opts...)
+	opts := []store.OpOption{
+		store.WithLimit(1024),
+		store.WithPrefix(),
+		store.WithMinCreateRev(createRev + 1),
+		store.WithSort(store.SortByCreateRevision, store.SortAscend)}
+	resp, err := backend.Get(context.Background(), stateKey("/status/"), opts...)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -203,12 +209,12 @@ func keepRecommendedStatusLoop() {
 		logrus.Infof("[recommended-algo] everything is ok")
 	}
 
-	rch := etcdClient.Watch(context.Background(), stateKey("/status/"),
-		clientv3.WithPrefix(), clientv3.WithPrevKV())
+	rch := backend.Watch(context.Background(), stateKey("/status/"),
+		store.WithPrefix(), store.WithPrevKV())
 	for wresp := range rch {
 		for _, ev := range wresp.Events {
-			if ev.IsCreate() || ev.Type == clientv3.EventTypeDelete {
-				del := ev.Type == clientv3.EventTypeDelete
+			if ev.IsCreate() || ev.Type == store.EventTypeDelete {
+				del := ev.Type == store.EventTypeDelete
 				kv := ev.Kv
 				if del {
 					kv = ev.PrevKv
@@ -240,9 +246,14 @@ func recommend(s *Status, del bool) error {
 		return nil
 	}
 
+	// 非公开状态和转发不推荐
+	if !del && (!s.Listed() || len(s.RepostOf) > 0) {
+		return nil
+	}
+
 	if del {
 		delKey := stateKey(fmt.Sprintf("/recommended/status/%s", s.ID))
-		_, err := etcdClient.KV.Delete(context.Background(), delKey)
+		err := backend.Delete(context.Background(), delKey)
 		if err != nil {
 			logrus.Error(err)
 		}
@@ -251,9 +262,9 @@ func recommend(s *Status, del bool) error {
 
 	statusKey := stateKey(fmt.Sprintf("/status/%s", s.ID))
 	putKey := stateKey(fmt.Sprintf("/recommended/status/%s", s.ID))
-	ops := []clientv3.Op{clientv3.OpPut(putKey, statusKey),
-		clientv3.OpPut(lastStatusCreateRev, fmt.Sprintf("%d", s.CreateRev))}
-	_, err := etcdClient.Txn(context.Background()).
+	ops := []store.Op{store.OpPut(putKey, statusKey),
+		store.OpPut(lastStatusCreateRev, fmt.Sprintf("%d", s.CreateRev))}
+	_, err := backend.Txn(context.Background()).
 		Then(ops...).Commit()
 	return err
 }
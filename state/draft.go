@@ -0,0 +1,293 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tDraft     string = "/draft/%s/%s"
+	tScheduled string = "/scheduled/%s/%s"
+
+	// scheduledInterval due scheduled statuses are published at this interval
+	scheduledInterval time.Duration = 30 * time.Second
+)
+
+// Draft a status saved to post later. it is published by the background
+// worker at PublishTime when set
+type Draft struct {
+	ID          string            `json:"id"`
+	Content     []*StatusFragment `json:"content"`
+	RefStatus   string            `json:"prev,omitempty"`
+	Quote       string            `json:"quote,omitempty"`
+	Visibility  string            `json:"visibility,omitempty"`
+	Labels      []string          `json:"labels,omitempty"`
+	At          []string          `json:"at,omitempty"`
+	PublishTime *time.Time        `json:"publishTime,omitempty"`
+	// Error why the scheduled publish failed, the draft is unscheduled then
+	Error      string    `json:"error,omitempty"`
+	CreateTime time.Time `json:"createTime"`
+	UpdateTime time.Time `json:"updateTime"`
+	CreateRev  int64     `json:"createRev"`
+}
+
+// options status options to publish the draft as {user}
+func (d *Draft) options(user *ActUser) *StatusOptions {
+	return &StatusOptions{
+		Content:     d.Content,
+		RefStatus:   d.RefStatus,
+		User:        user,
+		Labels:      d.Labels,
+		At:          d.At,
+		Visibility:  d.Visibility,
+		QuoteStatus: d.Quote,
+	}
+}
+
+func draftKey(uid, draftID string) string {
+	return stateKey(fmt.Sprintf(tDraft, uid, draftID))
+}
+
+func scheduledKey(uid, draftID string) string {
+	return stateKey(fmt.Sprintf(tScheduled, uid, draftID))
+}
+
+// GetDraft draft {draftID} of {uid}, nil if not found
+func GetDraft(uid, draftID string) *Draft {
+	d, _ := getDraft(uid, draftID)
+	return d
+}
+
+func getDraft(uid, draftID string) (*Draft, int64) {
+	resp, err := backend.Get(context.Background(), draftKey(uid, draftID))
+	if err != nil {
+		logrus.Error(err)
+		return nil, 0
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0
+	}
+	d := &Draft{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, d); err != nil {
+		logrus.Error(err)
+		return nil, 0
+	}
+	d.CreateRev = resp.Kvs[0].CreateRevision
+	return d, resp.Kvs[0].ModRevision
+}
+
+// ListDrafts list drafts and scheduled statuses of {user}
+func ListDrafts(user *ActUser, opts *tools.PaginationOptions) (drafts []*Draft, more bool) {
+	kvs, more := loadByPagination(draftKey(user.ID, ""), opts)
+	for _, kv := range kvs {
+		d := &Draft{}
+		if err := json.Unmarshal(kv.Value, d); err != nil {
+			logrus.Error("ListDrafts unmarshal error: ", err)
+			continue
+		}
+		d.CreateRev = kv.CreateRevision
+		drafts = append(drafts, d)
+	}
+	return
+}
+
+// SaveDraft create a draft when {draftID} is empty, or replace the draft.
+// the draft is scheduled when opts.PublishTime is set
+func SaveDraft(user *ActUser, draftID string, opts *StatusOptions) (*Draft, error) {
+	now := time.Now()
+	d := &Draft{ID: draftID, CreateTime: now}
+	cmps := []store.Cmp{}
+	if len(draftID) == 0 {
+		d.ID = base58.Encode(xid.New().Bytes())
+	} else {
+		old, modRev := getDraft(user.ID, draftID)
+		if old == nil {
+			return nil, ErrDraftNotFound
+		}
+		d.CreateTime = old.CreateTime
+		cmps = append(cmps, store.Compare(store.ModRevision(draftKey(user.ID, draftID)), "=", modRev))
+	}
+	d.Content = opts.Content
+	d.RefStatus = opts.RefStatus
+	d.Quote = opts.QuoteStatus
+	d.Visibility = opts.Visibility
+	d.Labels = tools.Unique(opts.Labels)
+	d.At = tools.Unique(opts.At)
+	d.UpdateTime = now
+	if !opts.PublishTime.IsZero() {
+		d.PublishTime = &opts.PublishTime
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []store.Op{store.OpPut(draftKey(user.ID, d.ID), string(b))}
+	if d.PublishTime != nil {
+		ops = append(ops, store.OpPut(scheduledKey(user.ID, d.ID), d.PublishTime.Format(time.RFC3339)))
+	} else {
+		ops = append(ops, store.OpDelete(scheduledKey(user.ID, d.ID)))
+	}
+	resp, err := backend.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, ErrTryAgainLater
+	}
+	return d, nil
+}
+
+// ScheduleStatus save the status as a draft published at opts.PublishTime
+func ScheduleStatus(opts *StatusOptions) (*Draft, error) {
+	return SaveDraft(opts.User, "", opts)
+}
+
+// DeleteDraft delete the draft, it is unscheduled too
+func DeleteDraft(user *ActUser, draftID string) error {
+	if GetDraft(user.ID, draftID) == nil {
+		return ErrDraftNotFound
+	}
+	_, err := backend.Txn(context.Background()).
+		Then(store.OpDelete(draftKey(user.ID, draftID)),
+			store.OpDelete(scheduledKey(user.ID, draftID))).Commit()
+	return err
+}
+
+// PublishDraft post the draft as a status now, the draft is deleted
+func PublishDraft(user *ActUser, draftID string) (*Status, error) {
+	d, modRev := getDraft(user.ID, draftID)
+	if d == nil {
+		return nil, ErrDraftNotFound
+	}
+	return publishDraft(user, d, modRev)
+}
+
+// publishDraft claim the draft by deleting it at {modRev}, so it is published
+// at most once, then publish it. the draft is restored unscheduled with the
+// error when it fails
+func publishDraft(user *ActUser, d *Draft, modRev int64) (*Status, error) {
+	key := draftKey(user.ID, d.ID)
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(key), "=", modRev)).
+		Then(store.OpDelete(key), store.OpDelete(scheduledKey(user.ID, d.ID))).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		// changed, published or deleted meanwhile
+		return nil, ErrTryAgainLater
+	}
+
+	s, err := func() (*Status, error) {
+		if p := (&Status{Content: d.Content}).Poll(); p != nil && !time.Now().Before(p.CloseTime) {
+			return nil, ErrPollClosed
+		}
+		return NewStatus(d.options(user))
+	}()
+	if err == nil {
+		return s, nil
+	}
+
+	d.PublishTime = nil
+	d.Error = err.Error()
+	b, e := json.Marshal(d)
+	if e != nil {
+		logrus.Errorf("restore draft %s error: %s", d.ID, e)
+		return nil, err
+	}
+	if _, e = backend.Txn(context.Background()).
+		If(store.Compare(store.Version(key), "=", 0)).
+		Then(store.OpPut(key, string(b))).Commit(); e != nil {
+		logrus.Errorf("restore draft %s error: %s", d.ID, e)
+	}
+	return nil, err
+}
+
+// publishScheduled publish due scheduled statuses
+func publishScheduled() {
+	prefix := stateKey(strings.TrimSuffix(tScheduled, "%s/%s"))
+	resp, err := backend.Get(context.Background(), prefix, store.WithPrefix())
+	if err != nil {
+		logrus.Error("[scheduled] ", err)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		publishTime, err := time.Parse(time.RFC3339, string(kv.Value))
+		if err != nil {
+			logrus.Errorf("[scheduled] %s: %s", kv.Key, err)
+			continue
+		}
+		if time.Now().Before(publishTime) {
+			continue
+		}
+		uid, draftID, _ := strings.Cut(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		if err := publishScheduledDraft(uid, draftID, kv); err != nil {
+			logrus.Errorf("[scheduled] publish %s: %s", kv.Key, err)
+		}
+	}
+}
+
+// publishScheduledDraft claim the schedule of the draft by removing it, so a
+// rescheduled draft is not published, then publish the draft
+func publishScheduledDraft(uid, draftID string, scheduledKV *store.KeyValue) error {
+	key := string(scheduledKV.Key)
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(key), "=", scheduledKV.ModRevision)).
+		Then(store.OpDelete(key)).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		// rescheduled or deleted by the user
+		return nil
+	}
+
+	d, modRev := getDraft(uid, draftID)
+	if d == nil {
+		return nil
+	}
+	u := UserByID(uid)
+	if u == nil {
+		return Del(fmt.Sprintf(tDraft, uid, draftID))
+	}
+	s, err := publishDraft(u.ToActUser(), d, modRev)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("[scheduled] draft %s published as status %s", draftID, s.ID)
+	return nil
+}
+
+func keepScheduledStatusLoop() {
+	mutex, err := backend.NewMutex(stateKey("/election/scheduled"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Info("[scheduled] act as leader")
+
+	ticker := time.NewTicker(scheduledInterval)
+	defer ticker.Stop()
+
+	publishScheduled()
+	for range ticker.C {
+		publishScheduled()
+	}
+}
@@ -3,7 +3,35 @@ package state
 import "errors"
 
 var (
-	ErrStatusNotFound       = errors.New("status not found")
-	ErrStatusQuotes   error = errors.New("there are quotes")
-	ErrTryAgainLater  error = errors.New("txn failed. try again later")
+	ErrStatusNotFound          = errors.New("status not found")
+	ErrStatusQuotes      error = errors.New("there are quotes")
+	ErrTryAgainLater     error = errors.New("txn failed. try again later")
+	ErrBlocked           error = errors.New("blocked by the user")
+	ErrReported          error = errors.New("already reported")
+	ErrReportResolved    error = errors.New("report already resolved")
+	ErrBuiltinRole       error = errors.New("built-in role can not be changed")
+	ErrInvalidState      error = errors.New("invalid or expired oauth2 state")
+	ErrIdentityLinked    error = errors.New("identity already linked to another user")
+	ErrIdentityNotLinked error = errors.New("the email belongs to an account, log in and link the identity first")
+	ErrLastIdentity      error = errors.New("the last identity can not be unlinked")
+	ErrWrongPassword     error = errors.New("wrong email or password")
+	ErrWrongOldPassword  error = errors.New("wrong current password")
+	ErrInvalidToken      error = errors.New("invalid or expired token")
+	ErrSignupDisabled    error = errors.New("signup is disabled")
+	ErrTOTPEnabled       error = errors.New("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled   error = errors.New("two-factor authentication not enabled")
+	ErrWrongCode         error = errors.New("wrong verification code")
+	ErrTooManyAttempts   error = errors.New("too many failed attempts, try again later")
+	ErrAccountDeleting   error = errors.New("account deletion in progress")
+	ErrInvalidPassword   error = errors.New("password must be 8 to 72 bytes")
+	ErrPrivateAccount    error = errors.New("private account")
+	ErrNoFollowRequest   error = errors.New("follow request not found")
+	ErrStatusNotListed   error = errors.New("only public statuses can be recommended")
+	ErrNotRepostable     error = errors.New("only public statuses of public accounts can be reposted")
+	ErrNoPoll            error = errors.New("there is no poll")
+	ErrPollClosed        error = errors.New("poll closed")
+	ErrVoted             error = errors.New("already voted")
+	ErrInvalidChoices    error = errors.New("invalid poll choices")
+	ErrPollEdit          error = errors.New("statuses with polls can not be edited")
+	ErrDraftNotFound     error = errors.New("draft not found")
 )
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ExportProfile profile.json of the data export
+type ExportProfile struct {
+	User       *User       `json:"user"`
+	Roles      []string    `json:"roles"`
+	Identities []*Identity `json:"identities"`
+	TOTP       bool        `json:"totp"`
+	ExportTime time.Time   `json:"exportTime"`
+}
+
+// ExportUser write all data of user u into the zip archive, each file is
+// a json document streamed from the state
+func ExportUser(u *User, zw *zip.Writer) error {
+	f, err := zw.Create("profile.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(&ExportProfile{
+		User:       u,
+		Roles:      UserRoles(u.ID),
+		Identities: ListIdentities(u.ID),
+		TOTP:       TOTPEnabled(u.ID),
+		ExportTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	linked := func(_ string, value []byte) any {
+		resp, err := backend.Get(context.Background(), string(value))
+		if err != nil || resp.Count == 0 {
+			return nil
+		}
+		return json.RawMessage(resp.Kvs[0].Value)
+	}
+	raw := func(_ string, value []byte) any { return json.RawMessage(value) }
+	sections := []struct {
+		name   string
+		prefix string
+		item   func(id string, value []byte) any
+	}{
+		{"statuses.json", fmt.Sprintf("/%s/status/", u.ID), linked},
+		{"likes.json", fmt.Sprintf("/like/%s/status/", u.ID), linked},
+		{"bookmarks.json", fmt.Sprintf("/bookmark/%s/", u.ID), linked},
+		{"followers.json", fmt.Sprintf(tFollowUser, u.ID, ""), raw},
+		{"following.json", fmt.Sprintf(tFollowingUser, u.ID, ""), exportID},
+		{"messages.json", fmt.Sprintf("/message/%s/", u.ID), raw},
+		{"blocks.json", fmt.Sprintf(tBlockUser, u.ID, ""), exportID},
+		{"mutes.json", fmt.Sprintf(tMuteUser, u.ID, ""), exportID},
+		{"drafts.json", fmt.Sprintf(tDraft, u.ID, ""), raw},
+	}
+	for _, s := range sections {
+		f, err := zw.Create(s.name)
+		if err != nil {
+			return err
+		}
+		if err := exportPrefix(f, s.prefix, s.item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportID(id string, _ []byte) any {
+	return map[string]string{"id": id}
+}
+
+// exportPrefix write keys with the prefix as a json array, the key suffix
+// and value are converted to an item by {item}, nil items are skipped
+func exportPrefix(w io.Writer, prefix string, item func(id string, value []byte) any) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	var werr error
+	first := true
+	fullPrefix := stateKey(prefix)
+	err := IterateWithPrefix(prefix, func(key string, value []byte) {
+		if werr != nil {
+			return
+		}
+		v := item(strings.TrimPrefix(key, fullPrefix), value)
+		if v == nil {
+			return
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			werr = err
+			return
+		}
+		if !first {
+			b = append([]byte(",\n"), b...)
+		}
+		first = false
+		_, werr = w.Write(b)
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
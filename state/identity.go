@@ -0,0 +1,174 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tIdentity     string = "/identity/%s/%s"
+	tUserIdentity string = "/identities/user/%s/%s"
+)
+
+// Identity an account at an identity provider linked to a user
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	UserID   string `json:"uid"`
+	// Email the email at the provider when last logged in
+	Email      string    `json:"email"`
+	CreateTime time.Time `json:"createTime"`
+	ModRev     int64     `json:"-"`
+}
+
+func (i *Identity) key() string {
+	return stateKey(fmt.Sprintf(tIdentity, i.Provider, i.Subject))
+}
+
+func GetIdentity(provider, subject string) *Identity {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tIdentity, provider, subject)))
+	if err != nil {
+		logrus.Debug(err)
+		return nil
+	}
+	if resp.Count == 0 {
+		return nil
+	}
+	i := &Identity{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, i); err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	i.ModRev = resp.Kvs[0].ModRevision
+	return i
+}
+
+// ListIdentities identities linked to user {uid}
+func ListIdentities(uid string) (identities []*Identity) {
+	resp, err := backend.Get(context.Background(),
+		stateKey(fmt.Sprintf(tUserIdentity, uid, "")), store.WithPrefix())
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		i := &Identity{}
+		if err := json.Unmarshal(kv.Value, i); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		identities = append(identities, i)
+	}
+	return
+}
+
+// LinkIdentity link the provider account to user {uid}. a user links at
+// most one account of each provider
+func LinkIdentity(uid string, i *Identity) error {
+	if old := GetIdentity(i.Provider, i.Subject); old != nil {
+		if old.UserID != uid {
+			return ErrIdentityLinked
+		}
+		return nil
+	}
+	i.UserID = uid
+	i.CreateTime = time.Now()
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	userIdentityKey := stateKey(fmt.Sprintf(tUserIdentity, uid, i.Provider))
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(i.key()), "=", 0),
+			store.Compare(store.Version(userIdentityKey), "=", 0)).
+		Then(store.OpPut(i.key(), string(b)), store.OpPut(userIdentityKey, string(b))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("an identity of %s is already linked", i.Provider)
+	}
+	return nil
+}
+
+// UnlinkIdentity unlink the identity of provider {provider} from user {uid}
+func UnlinkIdentity(uid, provider string) error {
+	identities := ListIdentities(uid)
+	for _, i := range identities {
+		if i.Provider != provider {
+			continue
+		}
+		if len(identities) == 1 {
+			return ErrLastIdentity
+		}
+		_, err := backend.Txn(context.Background()).Then(
+			store.OpDelete(i.key()),
+			store.OpDelete(stateKey(fmt.Sprintf(tUserIdentity, uid, provider)))).Commit()
+		return err
+	}
+	return nil
+}
+
+// legacyUserByEmail the user of email {email} if it was created before
+// identities were linked. users with linked identities are only resolved
+// by them, so an account at another provider can't take over the user
+func legacyUserByEmail(email string) *User {
+	u := UserByEmail(email)
+	if u == nil || len(ListIdentities(u.ID)) > 0 {
+		return nil
+	}
+	return u
+}
+
+// userByIdentity resolve the user logging in by provider subject first,
+// then by email for users created before identities were linked. a new
+// user is created when none matches, ErrIdentityNotLinked when the email
+// belongs to a user that must link the identity from a session instead
+func userByIdentity(i *Identity, opts *UserOptions) (u *User, err error) {
+	if linked := GetIdentity(i.Provider, i.Subject); linked != nil {
+		if u = UserByID(linked.UserID); u != nil {
+			if linked.Email != i.Email {
+				linked.Email = i.Email
+				linked.save()
+			}
+			return
+		}
+		logrus.Warnf("identity %s/%s linked to the missing user %s", i.Provider, i.Subject, linked.UserID)
+	}
+	u = legacyUserByEmail(opts.Email)
+	if u == nil {
+		if UserByEmail(opts.Email) != nil {
+			return nil, ErrIdentityNotLinked
+		}
+		u, err = NewUser(opts)
+		if err != nil {
+			return
+		}
+	}
+	if err = LinkIdentity(u.ID, i); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (i *Identity) save() {
+	b, err := json.Marshal(i)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	_, err = backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(i.key()), "=", i.ModRev)).
+		Then(store.OpPut(i.key(), string(b)),
+			store.OpPut(stateKey(fmt.Sprintf(tUserIdentity, i.UserID, i.Provider)), string(b))).
+		Commit()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
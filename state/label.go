@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type Label struct {
@@ -14,10 +14,10 @@ type Label struct {
 }
 
 func GetLabels(prefix string, size int64) (labels []*Label) {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/label/%s", prefix)),
-		clientv3.WithSort(clientv3.SortByVersion, clientv3.SortDescend),
-		clientv3.WithLimit(size),
-		clientv3.WithPrefix())
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/label/%s", prefix)),
+		store.WithSort(store.SortByVersion, store.SortDescend),
+		store.WithLimit(size),
+		store.WithPrefix())
 	if err != nil {
 		logrus.Debug(err)
 		return
@@ -5,8 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 var statusLikeKey func(statusID, uid string) string = func(statusID, uid string) string {
@@ -19,7 +19,7 @@ var userLikeKey func(statusID, uid string) string = func(statusID, uid string) s
 
 func Liked(statusID, uid string) bool {
 	key := statusLikeKey(statusID, uid)
-	resp, err := etcdClient.KV.Get(context.Background(), key, clientv3.WithCountOnly())
+	resp, err := backend.Get(context.Background(), key, store.WithCountOnly())
 	if err != nil {
 		logrus.Error(err)
 		return false
@@ -43,9 +43,9 @@ func LikeStatus(user *ActUser, statusID string) error {
 	if s == nil {
 		return ErrStatusNotFound
 	}
-	ops := []clientv3.Op{
-		clientv3.OpPut(statusLikeKey, string(b)),
-		clientv3.OpPut(userLikeKey, statueKey),
+	ops := []store.Op{
+		store.OpPut(statusLikeKey, string(b)),
+		store.OpPut(userLikeKey, statueKey),
 	}
 	ops = append(ops, newMessageOps(MsgOptions{
 		from:     user,
@@ -55,10 +55,26 @@ func LikeStatus(user *ActUser, statusID string) error {
 		message:  s.Overview(),
 	})...)
 
-	_, err = etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.Version(statusLikeKey), ">", 0)).
-		Then(clientv3.OpDelete(statusLikeKey), clientv3.OpDelete(userLikeKey)).
-		Else(ops...).
+	if Liked(statusID, user.ID) {
+		_, err = backend.Txn(context.Background()).
+			Then(store.OpDelete(statusLikeKey), store.OpDelete(userLikeKey)).Commit()
+		return err
+	}
+
+	if !s.VisibleTo(user) {
+		return ErrStatusNotFound
+	}
+
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(statusLikeKey), "=", 0),
+			notBlocked(s.User.ID, user.ID)).
+		Then(ops...).
 		Commit()
-	return err
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return blockedOr(ErrTryAgainLater, blockKey(s.User.ID, user.ID))
+	}
+	return nil
 }
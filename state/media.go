@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func SaveMedia(user *ActUser, objectPath string) error {
-	_, err := etcdClient.KV.Put(context.Background(),
+	err := backend.Put(context.Background(),
 		stateKey(fmt.Sprintf("/media/%s%s", user.ID, objectPath)), "")
 	if err != nil {
 		return err
@@ -20,9 +20,9 @@ func SaveMedia(user *ActUser, objectPath string) error {
 
 func TodayMediaCountByUser(user *ActUser) int64 {
 	timePrefix := time.Now().Format("20060102")
-	resp, err := etcdClient.KV.Get(context.Background(),
+	resp, err := backend.Get(context.Background(),
 		stateKey(fmt.Sprintf("/media/%s/%s", user.ID, timePrefix)),
-		clientv3.WithCountOnly(), clientv3.WithPrefix())
+		store.WithCountOnly(), store.WithPrefix())
 	if err != nil {
 		logrus.Error("query media count etcd error: ", err)
 		return 0
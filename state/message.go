@@ -4,21 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 var (
-	MsgTypeLike     string = "like"
-	MsgTypeBookmark string = "bookmark"
-	MsgTypeComment  string = "comment"
-	MsgTypeAt       string = "at"
-	MsgTypeFollow   string = "follow"
+	MsgTypeLike          string = "like"
+	MsgTypeBookmark      string = "bookmark"
+	MsgTypeComment       string = "comment"
+	MsgTypeAt            string = "at"
+	MsgTypeFollow        string = "follow"
+	MsgTypeFollowRequest string = "followRequest"
+	MsgTypeRepost        string = "repost"
+	MsgTypeQuote         string = "quote"
+	MsgTypePollClosed    string = "pollClosed"
+
+	// tMessageFrom index of messages by sender, {to}/{msgID} -> message key.
+	// entries of messages deleted with the recipient are dropped when the
+	// sender is deleted
+	tMessageFrom string = "/message-from/%s/%s"
 )
 
 type Message struct {
@@ -32,20 +42,7 @@ type Message struct {
 }
 
 func ListMessages(user *ActUser, opts *tools.PaginationOptions) (msgs []*Message, more bool) {
-	ops := []clientv3.OpOption{
-		clientv3.WithLimit(opts.Size),
-		clientv3.WithPrefix(),
-	}
-	if opts.Ascend {
-		ops = append(ops, clientv3.WithMinCreateRev(opts.After+1))
-		ops = append(ops, clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
-	} else {
-		if opts.After > 0 {
-			ops = append(ops, clientv3.WithMaxCreateRev(opts.After-1))
-		}
-		ops = append(ops, clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortDescend))
-	}
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/message/%s/", user.ID)), ops...)
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/message/%s/", user.ID)), paginationOptions(opts)...)
 	if err != nil {
 		logrus.Error("ListMessages etcd error: ", err)
 		return
@@ -65,21 +62,24 @@ func ListMessages(user *ActUser, opts *tools.PaginationOptions) (msgs []*Message
 }
 
 func DeleteMessages(user *ActUser, msgs []string) error {
-	ops := []clientv3.Op{}
+	ops := []store.Op{}
 	for _, msgID := range msgs {
 		key := stateKey(fmt.Sprintf("/message/%s/%s", user.ID, msgID))
-		ops = append(ops, clientv3.OpDelete(key))
+		ops = append(ops, store.OpDelete(key))
+		if from := messageSender(key); len(from) > 0 {
+			ops = append(ops, store.OpDelete(messageFromKey(from, user.ID, msgID)))
+		}
 	}
-	_, err := etcdClient.Txn(context.Background()).Then(ops...).Commit()
+	_, err := backend.Txn(context.Background()).Then(ops...).Commit()
 	return err
 }
 
 func ListTipMessages(user *ActUser, size int64) (msgs []string) {
-	ops := []clientv3.OpOption{
-		clientv3.WithLimit(size),
-		clientv3.WithPrefix(),
-		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortDescend)}
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/tips/message/%s/", user.ID)), ops...)
+	ops := []store.OpOption{
+		store.WithLimit(size),
+		store.WithPrefix(),
+		store.WithSort(store.SortByCreateRevision, store.SortDescend)}
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/tips/message/%s/", user.ID)), ops...)
 	if err != nil {
 		logrus.Debug(err)
 		return
@@ -92,12 +92,12 @@ func ListTipMessages(user *ActUser, size int64) (msgs []string) {
 }
 
 func DeleteTipMessages(user *ActUser, msgs []string) error {
-	ops := []clientv3.Op{}
+	ops := []store.Op{}
 	for _, msgID := range msgs {
 		key := stateKey(fmt.Sprintf("/tips/message/%s/%s", user.ID, msgID))
-		ops = append(ops, clientv3.OpDelete(key))
+		ops = append(ops, store.OpDelete(key))
 	}
-	_, err := etcdClient.Txn(context.Background()).Then(ops...).Commit()
+	_, err := backend.Txn(context.Background()).Then(ops...).Commit()
 	return err
 }
 
@@ -109,7 +109,7 @@ type MsgOptions struct {
 	message  string
 }
 
-func newMessageOps(opts MsgOptions) []clientv3.Op {
+func newMessageOps(opts MsgOptions) []store.Op {
 	msg := Message{
 		ID:         base58.Encode(xid.New().Bytes()),
 		From:       opts.from,
@@ -122,8 +122,64 @@ func newMessageOps(opts MsgOptions) []clientv3.Op {
 	msgKey := stateKey(fmt.Sprintf("/message/%s/%s", opts.toUID, msg.ID))
 	msgNewKey := stateKey(fmt.Sprintf("/tips/message/%s/%s", opts.toUID, msg.ID))
 
-	return []clientv3.Op{
-		clientv3.OpPut(msgKey, string(msgB)),
-		clientv3.OpPut(msgNewKey, msgKey),
+	ops := []store.Op{
+		store.OpPut(msgKey, string(msgB)),
+		store.OpPut(msgNewKey, msgKey),
+	}
+	if opts.from != nil && len(opts.from.ID) > 0 {
+		ops = append(ops, store.OpPut(messageFromKey(opts.from.ID, opts.toUID, msg.ID), msgKey))
+	}
+	return ops
+}
+
+func messageFromKey(from, to, msgID string) string {
+	return stateKey(fmt.Sprintf(tMessageFrom, from, to+"/"+msgID))
+}
+
+// messageSender id of the user who sent the message at {key}
+func messageSender(key string) string {
+	resp, err := backend.Get(context.Background(), key)
+	if err != nil || resp.Count == 0 {
+		return ""
 	}
+	msg := &Message{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, msg); err != nil || msg.From == nil {
+		return ""
+	}
+	return msg.From.ID
+}
+
+// indexMessageSenders index messages sent before they were indexed by
+// sender, it scans all messages once
+func indexMessageSenders() error {
+	indexedKey := stateKey("/message-from-indexed")
+	if countKeys(indexedKey) > 0 {
+		return nil
+	}
+	prefix := stateKey("/message/")
+	var ops []store.Op
+	var txnErr error
+	err := IterateWithPrefix("/message/", func(key string, value []byte) {
+		msg := &Message{}
+		if json.Unmarshal(value, msg) != nil || msg.From == nil || len(msg.From.ID) == 0 {
+			return
+		}
+		to, msgID, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		ops = append(ops, store.OpPut(messageFromKey(msg.From.ID, to, msgID), key))
+		if len(ops) >= fanOutBatchSize {
+			if _, err := backend.Txn(context.Background()).Then(ops...).Commit(); err != nil {
+				txnErr = err
+			}
+			ops = ops[:0]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if txnErr != nil {
+		return txnErr
+	}
+	ops = append(ops, store.OpPut(indexedKey, ""))
+	_, err = backend.Txn(context.Background()).Then(ops...).Commit()
+	return err
 }
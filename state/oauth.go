@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tAuthState string = "/oauth-state/%s"
+
+	// authStateTTL time a user has to finish the login at the provider
+	authStateTTL int64 = 600
+)
+
+// AuthState server-side record of an oauth2 login in progress, the id is
+// sent as the oauth2 `state` parameter
+type AuthState struct {
+	ID       string `json:"-"`
+	Provider string `json:"provider"`
+	Jump     string `json:"jump"`
+	// Verifier pkce code verifier
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	// LinkUID the provider account is linked to this user instead of login
+	LinkUID string `json:"linkUID,omitempty"`
+}
+
+// CodeChallenge pkce S256 code challenge of the verifier
+func (s *AuthState) CodeChallenge() string {
+	sum := sha256.Sum256([]byte(s.Verifier))
+	return base64URLEncode(sum[:])
+}
+
+// NewAuthState start an oauth2 login with provider {provider}, or linking
+// the provider account to user {linkUID} when it's not empty
+func NewAuthState(provider, jump, linkUID string) (*AuthState, error) {
+	s := &AuthState{
+		ID:       randomString(32),
+		Provider: provider,
+		Jump:     jump,
+		Verifier: randomString(48),
+		Nonce:    randomString(16),
+		LinkUID:  linkUID,
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := backend.Grant(context.Background(), authStateTTL)
+	if err != nil {
+		return nil, err
+	}
+	err = backend.Put(context.Background(), stateKey(fmt.Sprintf(tAuthState, s.ID)),
+		string(b), store.WithLease(lease))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ConsumeAuthState load and delete the login {id} started with provider
+// {provider}. each state can be consumed only once
+func ConsumeAuthState(provider, id string) (*AuthState, error) {
+	if len(id) == 0 {
+		return nil, ErrInvalidState
+	}
+	kv, err := consumeKey(stateKey(fmt.Sprintf(tAuthState, id)))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, ErrInvalidState
+	}
+	s := &AuthState{}
+	if err := json.Unmarshal(kv.Value, s); err != nil {
+		logrus.Error(err)
+		return nil, ErrInvalidState
+	}
+	if s.Provider != provider {
+		return nil, ErrInvalidState
+	}
+	s.ID = id
+	return s, nil
+}
+
+// consumeKey get and delete the key, nil is returned when the key does not
+// exist or is consumed concurrently
+func consumeKey(key string) (*store.KeyValue, error) {
+	resp, err := backend.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	txn, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+		Then(store.OpDelete(key)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txn.Succeeded {
+		return nil, nil
+	}
+	return resp.Kvs[0], nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base58.Encode(b)
+}
+
+func base64URLEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
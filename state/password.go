@@ -0,0 +1,222 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	tPassword  string = "/password/%s"
+	tAuthToken string = "/auth-token/%s"
+
+	// LocalProvider identity provider of local password and magic link logins
+	LocalProvider string = "local"
+
+	authTokenKindMagic string = "magic"
+	authTokenKindReset string = "reset"
+	// authTokenTTL magic and password reset links are valid for 15 minutes
+	authTokenTTL int64 = 900
+
+	minPasswordLength int = 8
+	// bcrypt ignores bytes after the 72nd
+	maxPasswordLength int = 72
+
+	// dummyPasswordHash compared when the user does not exist, so the
+	// response time does not tell whether an email is registered
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("lln"), bcrypt.DefaultCost)
+)
+
+type authToken struct {
+	Kind   string `json:"kind"`
+	Email  string `json:"email,omitempty"`
+	UserID string `json:"uid,omitempty"`
+}
+
+// localUser the user logging in with email {email} locally
+func localUser(email string) *User {
+	if i := GetIdentity(LocalProvider, strings.ToLower(email)); i != nil {
+		return UserByID(i.UserID)
+	}
+	return legacyUserByEmail(email)
+}
+
+// linkLocalIdentity link the email of user {uid} as its local identity
+// if the user has none, so that the user can log in with the password
+func linkLocalIdentity(uid string) error {
+	u := UserByID(uid)
+	if u == nil || len(u.Email) == 0 {
+		return nil
+	}
+	for _, i := range ListIdentities(uid) {
+		if i.Provider == LocalProvider {
+			return nil
+		}
+	}
+	return LinkIdentity(uid, &Identity{Provider: LocalProvider,
+		Subject: strings.ToLower(u.Email), Email: u.Email})
+}
+
+// SetPassword set the password of user {uid}, the current password
+// {old} is required when one is set
+func SetPassword(uid, old, password string) error {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tPassword, uid)))
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 && bcrypt.CompareHashAndPassword(resp.Kvs[0].Value, []byte(old)) != nil {
+		return ErrWrongOldPassword
+	}
+	return putPassword(uid, password)
+}
+
+func putPassword(uid, password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return ErrInvalidPassword
+	}
+	if err := linkLocalIdentity(uid); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return backend.Put(context.Background(), stateKey(fmt.Sprintf(tPassword, uid)), string(hash))
+}
+
+// PasswordLogin login by email and password
+func PasswordLogin(email, password string, client *SessionClient) (*Session, error) {
+	u := localUser(strings.TrimSpace(email))
+	hash := dummyPasswordHash
+	if u != nil {
+		resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tPassword, u.ID)))
+		if err != nil {
+			return nil, err
+		}
+		if resp.Count > 0 {
+			hash = resp.Kvs[0].Value
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || u == nil {
+		return nil, ErrWrongPassword
+	}
+	return newLoginSession(u, client, false)
+}
+
+// NewMagicLink token of a magic link logging in (or signing up) by email
+// {email}. ErrSignupDisabled when the user does not exist and signup is
+// disabled
+func NewMagicLink(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Address != strings.TrimSpace(email) {
+		return "", fmt.Errorf("invalid email %s", email)
+	}
+	if !config.Conf.Local.Signup && localUser(addr.Address) == nil {
+		return "", ErrSignupDisabled
+	}
+	return newAuthToken(&authToken{Kind: authTokenKindMagic, Email: addr.Address})
+}
+
+// MagicLogin login by the magic link token {token}, the email is verified
+// by the link so the user of the email is logged in or created
+func MagicLogin(token string, client *SessionClient) (*Session, error) {
+	t, err := consumeAuthToken(token, authTokenKindMagic)
+	if err != nil {
+		return nil, err
+	}
+	return CreateSession(
+		&Identity{Provider: LocalProvider, Subject: strings.ToLower(t.Email), Email: t.Email},
+		&UserOptions{Name: t.Email[:strings.Index(t.Email, "@")], Email: t.Email},
+		client)
+}
+
+// NewPasswordReset token of a password reset link of the user with email
+// {email}, nil user is returned when the user does not exist
+func NewPasswordReset(email string) (*User, string, error) {
+	u := localUser(strings.TrimSpace(email))
+	if u == nil {
+		return nil, "", nil
+	}
+	token, err := newAuthToken(&authToken{Kind: authTokenKindReset, UserID: u.ID})
+	return u, token, err
+}
+
+// ResetPassword set the password by the reset link token {token}, all
+// sessions of the user are expired
+func ResetPassword(token, password string) error {
+	t, err := consumeAuthToken(token, authTokenKindReset)
+	if err != nil {
+		return err
+	}
+	if err := putPassword(t.UserID, password); err != nil {
+		return err
+	}
+	return DefaultSessionManager.Expire(t.UserID)
+}
+
+func authTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return stateKey(fmt.Sprintf(tAuthToken, hex.EncodeToString(sum[:])))
+}
+
+// newAuthToken store the token by its hash, so the state does not hold
+// usable links
+func newAuthToken(t *authToken) (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	token := randomString(32)
+	lease, err := backend.Grant(context.Background(), authTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	err = backend.Put(context.Background(), authTokenKey(token), string(b), store.WithLease(lease))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeAuthToken delete the token of kind {kind}, so that a link is used once
+func consumeAuthToken(token, kind string) (*authToken, error) {
+	if len(token) == 0 {
+		return nil, ErrInvalidToken
+	}
+	key := authTokenKey(token)
+	resp, err := backend.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count == 0 {
+		return nil, ErrInvalidToken
+	}
+	t := &authToken{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, t); err != nil {
+		logrus.Error(err)
+		return nil, ErrInvalidToken
+	}
+	// a token of another kind is kept, it's not consumed by the wrong link
+	if t.Kind != kind {
+		return nil, ErrInvalidToken
+	}
+	txn, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+		Then(store.OpDelete(key)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txn.Succeeded {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
@@ -0,0 +1,268 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tVote      string = "/vote/status/%s/%s"
+	tUserVote  string = "/vote/%s/status/%s"
+	tPollClose string = "/poll/close/%s"
+	// tPollClosing the last voter notified of the poll closed
+	tPollClosing string = "/poll/closing/%s"
+
+	// pollCloseInterval closed polls are checked at this interval
+	pollCloseInterval time.Duration = time.Minute
+	// pollCloseBatch voters notified in one txn
+	pollCloseBatch int64 = 32
+)
+
+// Poll the `poll` status fragment. Votes and Voters are tallied when the
+// status is loaded
+type Poll struct {
+	Options   []string  `json:"options"`
+	Multiple  bool      `json:"multiple"`
+	CloseTime time.Time `json:"closeTime"`
+	Votes     []int64   `json:"votes"`
+	Voters    int64     `json:"voters"`
+	Closed    bool      `json:"closed"`
+}
+
+// Vote choices of a voter, indexes of the poll options
+type Vote struct {
+	User    *ActUser `json:"user"`
+	Choices []int    `json:"choices"`
+}
+
+// Poll the poll of the status, nil if there is none
+func (s *Status) Poll() *Poll {
+	for _, c := range s.Content {
+		if c.Type == "poll" && c.Poll != nil {
+			return c.Poll
+		}
+	}
+	return nil
+}
+
+// tallyPoll count votes of the status poll
+func tallyPoll(s *Status) {
+	p := s.Poll()
+	if p == nil {
+		return
+	}
+	p.Votes = make([]int64, len(p.Options))
+	p.Voters = 0
+	p.Closed = !time.Now().Before(p.CloseTime)
+	err := IterateWithPrefix(fmt.Sprintf(tVote, s.ID, ""), func(_ string, value []byte) {
+		v := &Vote{}
+		if err := json.Unmarshal(value, v); err != nil {
+			logrus.Error("tally poll unmarshal error: ", err)
+			return
+		}
+		p.Voters++
+		for _, i := range v.Choices {
+			if i >= 0 && i < len(p.Votes) {
+				p.Votes[i]++
+			}
+		}
+	})
+	if err != nil {
+		logrus.Errorf("tally poll %s error: %s", s.ID, err)
+	}
+}
+
+// PollChoices choices of {uid} in the poll of the status, nil if not voted
+func PollChoices(statusID, uid string) []int {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tVote, statusID, uid)))
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	v := &Vote{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, v); err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	return v.Choices
+}
+
+// VotePoll vote {choices} in the poll of the status, a user votes once
+func VotePoll(user *ActUser, statusID string, choices []int) error {
+	s := GetStatus(statusID)
+	if s == nil || !s.VisibleTo(user) {
+		return ErrStatusNotFound
+	}
+	p := s.Poll()
+	if p == nil {
+		return ErrNoPoll
+	}
+	if p.Closed {
+		return ErrPollClosed
+	}
+	if len(choices) == 0 || (!p.Multiple && len(choices) > 1) {
+		return ErrInvalidChoices
+	}
+	chosen := make(map[int]bool)
+	for _, i := range choices {
+		if i < 0 || i >= len(p.Options) || chosen[i] {
+			return ErrInvalidChoices
+		}
+		chosen[i] = true
+	}
+
+	b, err := json.Marshal(Vote{User: user, Choices: choices})
+	if err != nil {
+		return err
+	}
+	voteKey := stateKey(fmt.Sprintf(tVote, statusID, user.ID))
+	closeKey := stateKey(fmt.Sprintf(tPollClose, statusID))
+	// the close key is removed once voters are notified of the poll closed
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(voteKey), "=", 0),
+			store.Compare(store.Version(closeKey), ">", 0),
+			store.Compare(store.Version(stateKey(fmt.Sprintf("/disabled/user/%s", user.ID))), "=", 0),
+			notBlocked(s.User.ID, user.ID)).
+		Then(store.OpPut(voteKey, string(b)),
+			store.OpPut(stateKey(fmt.Sprintf(tUserVote, user.ID, statusID)),
+				stateKey(fmt.Sprintf("/status/%s", statusID)))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		if countKeys(closeKey) == 0 {
+			return ErrPollClosed
+		}
+		if countKeys(voteKey) > 0 {
+			return ErrVoted
+		}
+		return blockedOr(ErrTryAgainLater, blockKey(s.User.ID, user.ID))
+	}
+	return nil
+}
+
+// closePolls notify voters and the author of polls closed
+func closePolls() {
+	prefix := stateKey(fmt.Sprintf(tPollClose, ""))
+	resp, err := backend.Get(context.Background(), prefix, store.WithPrefix())
+	if err != nil {
+		logrus.Error("[poll] ", err)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		closeTime, err := time.Parse(time.RFC3339, string(kv.Value))
+		if err != nil {
+			logrus.Errorf("[poll] %s: %s", kv.Key, err)
+			continue
+		}
+		if time.Now().Before(closeTime) {
+			continue
+		}
+		if err := closePoll(strings.TrimPrefix(string(kv.Key), prefix), kv); err != nil {
+			logrus.Errorf("[poll] close %s: %s", kv.Key, err)
+		}
+	}
+}
+
+// closePoll notify voters and the author of the poll in batches. the last
+// notified voter is saved with each batch so that a retry resumes after it,
+// the close key is removed with the last batch
+func closePoll(statusID string, closeKV *store.KeyValue) error {
+	s := GetStatus(statusID)
+	if s == nil || s.Poll() == nil {
+		return Del(fmt.Sprintf(tPollClose, statusID))
+	}
+	notify := func(uid string) []store.Op {
+		return newMessageOps(MsgOptions{
+			from:     s.User,
+			toUID:    uid,
+			msgType:  MsgTypePollClosed,
+			targetID: s.ID,
+			message:  s.Overview(),
+		})
+	}
+	closeKey := string(closeKV.Key)
+	closed := store.Compare(store.ModRevision(closeKey), "=", closeKV.ModRevision)
+	progressKey := stateKey(fmt.Sprintf(tPollClosing, statusID))
+	votePrefix := stateKey(fmt.Sprintf(tVote, statusID, ""))
+	// votes are in [votePrefix, votePrefix end)
+	start, end := votePrefix, votePrefix[:len(votePrefix)-1]+"0"
+	progress, err := backend.Get(context.Background(), progressKey)
+	if err != nil {
+		return err
+	}
+	var last string
+	if progress.Count > 0 {
+		last = string(progress.Kvs[0].Value)
+		start = last + "\x00"
+	}
+	var ops []store.Op
+	for {
+		resp, err := backend.Get(context.Background(), start,
+			store.WithRange(end),
+			store.WithKeysOnly(),
+			store.WithLimit(pollCloseBatch),
+			store.WithSort(store.SortByKey, store.SortAscend))
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			if uid := strings.TrimPrefix(key, votePrefix); uid != s.User.ID {
+				ops = append(ops, notify(uid)...)
+			}
+			last = key
+		}
+		start = last + "\x00"
+		if !resp.More {
+			break
+		}
+		ops = append(ops, store.OpPut(progressKey, last))
+		txn, err := backend.Txn(context.Background()).If(closed).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			return ErrTryAgainLater
+		}
+		ops = nil
+	}
+	ops = append(ops, notify(s.User.ID)...)
+	ops = append(ops, store.OpDelete(closeKey), store.OpDelete(progressKey))
+	_, err = backend.Txn(context.Background()).If(closed).Then(ops...).Commit()
+	return err
+}
+
+func keepPollCloseLoop() {
+	mutex, err := backend.NewMutex(stateKey("/election/poll"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Info("[poll] act as leader")
+
+	ticker := time.NewTicker(pollCloseInterval)
+	defer ticker.Stop()
+
+	closePolls()
+	for range ticker.C {
+		closePolls()
+	}
+}
@@ -0,0 +1,174 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+)
+
+var (
+	tPrivateUser     string = "/private/user/%s"
+	tFollowRequest   string = "/follow-request/%s/%s"
+	tFollowRequested string = "/follow-requested/%s/%s"
+)
+
+// Private determine if {uid} is a private account
+func Private(uid string) bool {
+	return countKeys(stateKey(fmt.Sprintf(tPrivateUser, uid))) > 0
+}
+
+// CanView determine if {viewer} can see statuses of {uid}. statuses of a
+// private account are visible to itself and its approved followers only
+func CanView(viewer *ActUser, uid string) bool {
+	if viewer != nil && (viewer.ID == uid || Followed(viewer.ID, uid)) {
+		return true
+	}
+	return !Private(uid)
+}
+
+// InvisibleUsers users hidden from {viewer}: blocked or muted by {viewer},
+// and private authors of {ss} {viewer} can not see
+func InvisibleUsers(viewer *ActUser, ss []*Status) map[string]bool {
+	hidden := HiddenUsers(viewer)
+	checked := make(map[string]bool)
+	for _, s := range ss {
+		if checked[s.User.ID] {
+			continue
+		}
+		checked[s.User.ID] = true
+		if !CanView(viewer, s.User.ID) {
+			hidden[s.User.ID] = true
+		}
+	}
+	return hidden
+}
+
+// FollowRequested determine if {uid} requested to follow {targetUID}
+func FollowRequested(uid, targetUID string) bool {
+	return countKeys(stateKey(fmt.Sprintf(tFollowRequest, targetUID, uid))) > 0
+}
+
+// requestFollow request or cancel the request to follow the private
+// account {targetUser}
+func requestFollow(user *ActUser, targetUser *User) error {
+	requestKey := stateKey(fmt.Sprintf(tFollowRequest, targetUser.ID, user.ID))
+	requestedKey := stateKey(fmt.Sprintf(tFollowRequested, user.ID, targetUser.ID))
+	b, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	if FollowRequested(user.ID, targetUser.ID) {
+		_, err = backend.Txn(context.Background()).
+			Then(store.OpDelete(requestKey), store.OpDelete(requestedKey)).Commit()
+		return err
+	}
+
+	newOps := []store.Op{store.OpPut(requestKey, string(b)), store.OpPut(requestedKey, "")}
+	newOps = append(newOps, newMessageOps(MsgOptions{
+		from:     user,
+		toUID:    targetUser.ID,
+		msgType:  MsgTypeFollowRequest,
+		targetID: targetUser.ID,
+	})...)
+	// the account may be switched to public meanwhile
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(requestKey), "=", 0),
+			store.Compare(store.Version(stateKey(fmt.Sprintf(tPrivateUser, targetUser.ID))), ">", 0),
+			notBlocked(targetUser.ID, user.ID)).
+		Then(newOps...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return blockedOr(ErrTryAgainLater, blockKey(targetUser.ID, user.ID))
+	}
+	return nil
+}
+
+// ListFollowRequests list users requesting to follow {user}
+func ListFollowRequests(user *ActUser, opts *tools.PaginationOptions) (follows []*Follow, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tFollowRequest, user.ID, "")), opts)
+	return followsOf(kvs, stateKey(fmt.Sprintf(tFollowRequest, user.ID, ""))), more
+}
+
+// ApproveFollowRequest approve the follow request from user with {uniqueName}
+func ApproveFollowRequest(user *ActUser, uniqueName string) error {
+	requester := UserByUniqueName(uniqueName)
+	if requester == nil {
+		return errors.New("not found")
+	}
+	return approveFollowRequest(user, requester.ID)
+}
+
+// approveFollowRequests approve all pending follow requests to {user}, when
+// the account is switched to public
+func approveFollowRequests(user *ActUser) error {
+	prefix := stateKey(fmt.Sprintf(tFollowRequest, user.ID, ""))
+	var requesters []string
+	err := IterateWithPrefix(fmt.Sprintf(tFollowRequest, user.ID, ""), func(key string, _ []byte) {
+		requesters = append(requesters, strings.TrimPrefix(key, prefix))
+	})
+	if err != nil {
+		return err
+	}
+	for _, requesterID := range requesters {
+		err := approveFollowRequest(user, requesterID)
+		if errors.Is(err, ErrBlocked) || errors.Is(err, ErrNoFollowRequest) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func approveFollowRequest(user *ActUser, requesterID string) error {
+	requestKey := stateKey(fmt.Sprintf(tFollowRequest, user.ID, requesterID))
+	r, err := backend.Get(context.Background(), requestKey)
+	if err != nil {
+		return err
+	}
+	if len(r.Kvs) == 0 {
+		return ErrNoFollowRequest
+	}
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(requestKey), "=", r.Kvs[0].ModRevision),
+			notBlocked(user.ID, requesterID)).
+		Then(store.OpDelete(requestKey),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequested, requesterID, user.ID))),
+			store.OpPut(stateKey(fmt.Sprintf(tFollowUser, user.ID, requesterID)), string(r.Kvs[0].Value)),
+			store.OpPut(stateKey(fmt.Sprintf(tFollowingUser, requesterID, user.ID)),
+				stateKey(fmt.Sprintf(tUser, user.ID)))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return blockedOr(ErrTryAgainLater, blockKey(user.ID, requesterID))
+	}
+	rerankUser(user.ID)
+	return nil
+}
+
+// RejectFollowRequest reject the follow request from user with {uniqueName}
+func RejectFollowRequest(user *ActUser, uniqueName string) error {
+	requester := UserByUniqueName(uniqueName)
+	if requester == nil {
+		return errors.New("not found")
+	}
+	if !FollowRequested(requester.ID, user.ID) {
+		return ErrNoFollowRequest
+	}
+	_, err := backend.Txn(context.Background()).
+		Then(store.OpDelete(stateKey(fmt.Sprintf(tFollowRequest, user.ID, requester.ID))),
+			store.OpDelete(stateKey(fmt.Sprintf(tFollowRequested, requester.ID, user.ID)))).
+		Commit()
+	return err
+}
@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type CommentsRecommandMeta struct {
@@ -21,7 +21,7 @@ type CommentsRecommandMeta struct {
 
 func NewCommentsRecommandMeta(statusID string) (meta *CommentsRecommandMeta, err error) {
 	recommandKey := stateKey(fmt.Sprintf("/meta/comments/recommended/%s", statusID))
-	resp, err := etcdClient.KV.Get(context.Background(), recommandKey)
+	resp, err := backend.Get(context.Background(), recommandKey)
 	if err != nil {
 		return
 	}
@@ -90,16 +90,16 @@ func (m *CommentsRecommandMeta) RunRecommand(statusCreateRev int64) error {
 
 	b, _ := json.Marshal(m)
 
-	cmps := []clientv3.Cmp{}
+	cmps := []store.Cmp{}
 
 	if m.modRev > 0 {
-		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(m.recommandKey), "=", m.modRev))
+		cmps = append(cmps, store.Compare(store.ModRevision(m.recommandKey), "=", m.modRev))
 	}
 
-	resp, err := etcdClient.Txn(context.Background()).
+	resp, err := backend.Txn(context.Background()).
 		If(cmps...).
-		Then(clientv3.OpPut(m.recommandKey, string(b)),
-			clientv3.OpPut(lastStatusCreateRev, fmt.Sprintf("%d", statusCreateRev))).Commit()
+		Then(store.OpPut(m.recommandKey, string(b)),
+			store.OpPut(lastStatusCreateRev, fmt.Sprintf("%d", statusCreateRev))).Commit()
 	if err != nil {
 		return nil
 	}
@@ -130,9 +130,9 @@ func LikesMap(minCreateRev, maxCreateRev int64) map[string]int64 {
 }
 
 func listStatusByCreateRev(minCreateRev, maxCreateRev int64) []string {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey("/recommended/status/"),
-		clientv3.WithKeysOnly(), clientv3.WithPrefix(),
-		clientv3.WithMinCreateRev(minCreateRev), clientv3.WithMaxCreateRev(maxCreateRev))
+	resp, err := backend.Get(context.Background(), stateKey("/recommended/status/"),
+		store.WithKeysOnly(), store.WithPrefix(),
+		store.WithMinCreateRev(minCreateRev), store.WithMaxCreateRev(maxCreateRev))
 	if err != nil {
 		return nil
 	}
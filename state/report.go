@@ -0,0 +1,259 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tReport      string = "/report/%s"
+	tReportQueue string = "/report-queue/%s/%s"
+	tReported    string = "/reported/%s/%s"
+
+	ReportTargetStatus string = "status"
+	ReportTargetUser   string = "user"
+
+	ReportStateOpen     string = "open"
+	ReportStateClaimed  string = "claimed"
+	ReportStateResolved string = "resolved"
+
+	ReportActionNone         string = "none"
+	ReportActionDeleteStatus string = "deleteStatus"
+	ReportActionDisableUser  string = "disableUser"
+	ReportActionNotRecommend string = "notRecommendStatus"
+
+	ReportCategories []string = []string{"spam", "abuse", "harassment", "illegal", "other"}
+)
+
+type ReportOptions struct {
+	Reporter   *ActUser
+	TargetType string
+	TargetID   string
+	Category   string
+	Reason     string
+}
+
+type Report struct {
+	ID          string    `json:"id"`
+	Reporter    *ActUser  `json:"reporter"`
+	TargetType  string    `json:"targetType"`
+	TargetID    string    `json:"targetID"`
+	Category    string    `json:"category"`
+	Reason      string    `json:"reason"`
+	State       string    `json:"state"`
+	Assignee    *ActUser  `json:"assignee,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	CreateTime  time.Time `json:"createTime"`
+	ResolveTime time.Time `json:"resolveTime,omitempty"`
+	CreateRev   int64     `json:"createRev"`
+	modRev      int64
+}
+
+// NewReport report a status or user. a reporter can report a target once
+// until the report is resolved
+func NewReport(opts *ReportOptions) (*Report, error) {
+	if !slices.Contains(ReportCategories, opts.Category) {
+		return nil, fmt.Errorf("invalid category %s", opts.Category)
+	}
+	switch opts.TargetType {
+	case ReportTargetStatus:
+		if GetStatus(opts.TargetID) == nil {
+			return nil, ErrStatusNotFound
+		}
+	case ReportTargetUser:
+		if UserByID(opts.TargetID) == nil {
+			return nil, errors.New("user not found")
+		}
+	default:
+		return nil, fmt.Errorf("invalid target type %s", opts.TargetType)
+	}
+
+	r := &Report{
+		ID:         base58.Encode(xid.New().Bytes()),
+		Reporter:   opts.Reporter,
+		TargetType: opts.TargetType,
+		TargetID:   opts.TargetID,
+		Category:   opts.Category,
+		Reason:     opts.Reason,
+		State:      ReportStateOpen,
+		CreateTime: time.Now(),
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	reportKey := stateKey(fmt.Sprintf(tReport, r.ID))
+	reportedKey := stateKey(fmt.Sprintf(tReported, r.TargetID, r.Reporter.ID))
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(reportedKey), "=", 0)).
+		Then(store.OpPut(reportKey, string(b)),
+			store.OpPut(stateKey(fmt.Sprintf(tReportQueue, ReportStateOpen, r.ID)), reportKey),
+			store.OpPut(reportedKey, reportKey)).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, ErrReported
+	}
+	return r, nil
+}
+
+func GetReport(reportID string) *Report {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tReport, reportID)))
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	if resp.Count == 0 {
+		return nil
+	}
+	r := &Report{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, r); err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	r.CreateRev = resp.Kvs[0].CreateRevision
+	r.modRev = resp.Kvs[0].ModRevision
+	return r
+}
+
+// ListReports reports in queue {state}, ordered by the time they entered the queue
+func ListReports(state string, opts *tools.PaginationOptions) (reports []*Report, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tReportQueue, state, "")), opts)
+	for _, kv := range kvs {
+		resp, err := backend.Get(context.Background(), string(kv.Value))
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if resp.Count == 0 {
+			logrus.Errorf("not found %s -> %s ", string(kv.Key), string(kv.Value))
+			continue
+		}
+		r := &Report{}
+		if err := json.Unmarshal(resp.Kvs[0].Value, r); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		// cursor of the queue
+		r.CreateRev = kv.CreateRevision
+		reports = append(reports, r)
+	}
+	return
+}
+
+// save put the report and move it from queue {from} to the queue of its
+// current state along with {ops} and the audit entry, fails if the report was changed
+// concurrently or any of {cmps} fails
+func (r *Report) save(from string, audit *AuditOptions, cmps []store.Cmp, ops ...store.Op) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	aOps, err := auditOps(audit)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, aOps...)
+	reportKey := stateKey(fmt.Sprintf(tReport, r.ID))
+	ops = append(ops, store.OpPut(reportKey, string(b)))
+	if from != r.State {
+		ops = append(ops,
+			store.OpDelete(stateKey(fmt.Sprintf(tReportQueue, from, r.ID))),
+			store.OpPut(stateKey(fmt.Sprintf(tReportQueue, r.State, r.ID)), reportKey))
+	}
+	resp, err := backend.Txn(context.Background()).
+		If(append(cmps, store.Compare(store.ModRevision(reportKey), "=", r.modRev))...).
+		Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrTryAgainLater
+	}
+	return nil
+}
+
+// Claim assign the report to admin, so that others know it's being handled
+func (r *Report) Claim(admin *ActUser, audit *AuditOptions) error {
+	if r.State == ReportStateResolved {
+		return ErrReportResolved
+	}
+	if r.Assignee != nil && r.Assignee.ID != admin.ID {
+		return fmt.Errorf("claimed by %s", r.Assignee.UniqueName)
+	}
+	from := r.State
+	r.State = ReportStateClaimed
+	r.Assignee = admin
+	return r.save(from, audit, nil)
+}
+
+// Resolve close the report by taking {action} on the target, the action
+// is committed in the same txn as the report so that it's taken once
+func (r *Report) Resolve(admin *ActUser, action, note string, audit *AuditOptions) error {
+	if r.State == ReportStateResolved {
+		return ErrReportResolved
+	}
+	if r.Assignee != nil && r.Assignee.ID != admin.ID {
+		return fmt.Errorf("claimed by %s", r.Assignee.UniqueName)
+	}
+
+	var cmps []store.Cmp
+	var ops []store.Op
+	switch action {
+	case ReportActionNone:
+	case ReportActionDeleteStatus, ReportActionNotRecommend:
+		if r.TargetType != ReportTargetStatus {
+			return fmt.Errorf("action %s is not applicable to %s", action, r.TargetType)
+		}
+		s := GetStatus(r.TargetID)
+		if s == nil {
+			break
+		}
+		if action == ReportActionNotRecommend {
+			ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf("/recommended/status/%s", s.ID))))
+			break
+		}
+		var err error
+		cmps, ops, err = removeStatusOps(s)
+		if err != nil {
+			return err
+		}
+	case ReportActionDisableUser:
+		uid := r.TargetID
+		if r.TargetType == ReportTargetStatus {
+			s := GetStatus(r.TargetID)
+			if s == nil {
+				return ErrStatusNotFound
+			}
+			uid = s.User.ID
+		}
+		if UserByID(uid) == nil {
+			return errors.New("user not found")
+		}
+		ops = append(ops, store.OpPut(stateKey(fmt.Sprintf("/disabled/user/%s", uid)), ""))
+	default:
+		return fmt.Errorf("invalid action %s", action)
+	}
+
+	from := r.State
+	r.State = ReportStateResolved
+	r.Assignee = admin
+	r.Action = action
+	r.Note = note
+	r.ResolveTime = time.Now()
+	ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tReported, r.TargetID, r.Reporter.ID))))
+	return r.save(from, audit, cmps, ops...)
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rs/xid"
+)
+
+var (
+	// tStatusRepost the key exists when {uid} reposted {statusID}, the value is the repost id
+	tStatusRepost string = "/repost/status/%s/%s"
+	// tStatusQuote the key exists when {quoteID} quoted {statusID}
+	tStatusQuote string = "/quote/status/%s/%s"
+)
+
+// Reposted determine if {uid} reposted the status
+func Reposted(statusID, uid string) bool {
+	return countKeys(stateKey(fmt.Sprintf(tStatusRepost, statusID, uid))) > 0
+}
+
+func repostCount(statusID string) int64 {
+	return countKeys(stateKey(fmt.Sprintf(tStatusRepost, statusID, "")))
+}
+
+func quoteCount(statusID string) int64 {
+	return countKeys(stateKey(fmt.Sprintf(tStatusQuote, statusID, "")))
+}
+
+// Repostable determine if the status can be reposted, only public and
+// unlisted statuses of public accounts can be
+func (s *Status) Repostable() bool {
+	return len(s.RepostOf) == 0 &&
+		(s.Listed() || s.Visibility == VisibilityUnlisted) && !Private(s.User.ID)
+}
+
+// RepostStatus repost or undo the repost of {statusID}. a repost is a
+// status without content, so it is listed in the statuses of {user} and
+// fanned out to timelines of the followers
+func RepostStatus(user *ActUser, statusID string) error {
+	s := GetStatus(statusID)
+	if s != nil && len(s.RepostOf) > 0 {
+		r := s
+		if s = GetStatus(r.RepostOf); s == nil && r.User.ID == user.ID {
+			// undo the repost of a deleted status
+			return r.Delete(user.ID)
+		}
+	}
+	if s == nil {
+		return ErrStatusNotFound
+	}
+
+	repostKey := stateKey(fmt.Sprintf(tStatusRepost, s.ID, user.ID))
+	resp, err := backend.Get(context.Background(), repostKey)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) > 0 {
+		if r := GetStatus(string(resp.Kvs[0].Value)); r != nil {
+			return r.Delete(user.ID)
+		}
+		return backend.Delete(context.Background(), repostKey)
+	}
+
+	if !s.VisibleTo(user) {
+		return ErrStatusNotFound
+	}
+	if !s.Repostable() {
+		return ErrNotRepostable
+	}
+
+	r := &Status{
+		ID:         base58.Encode(xid.New().Bytes()),
+		RepostOf:   s.ID,
+		User:       user,
+		CreateTime: time.Now(),
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	statusKey := stateKey(fmt.Sprintf("/status/%s", r.ID))
+	ops := []store.Op{
+		store.OpPut(statusKey, string(b)),
+		store.OpPut(stateKey(fmt.Sprintf("/%s/status/%s", user.ID, r.ID)), statusKey),
+		store.OpPut(stateKey(fmt.Sprintf("/probe/status/%s", r.ID)), r.ID),
+		store.OpPut(repostKey, r.ID),
+	}
+	ops = append(ops, newMessageOps(MsgOptions{
+		from:     user,
+		toUID:    s.User.ID,
+		msgType:  MsgTypeRepost,
+		targetID: s.ID,
+		message:  s.Overview(),
+	})...)
+
+	probeKey := stateKey(fmt.Sprintf("/probe/status/%s", s.ID))
+	txnResp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(probeKey), "!=", 0),
+			store.Compare(store.Version(repostKey), "=", 0),
+			store.Compare(store.Version(stateKey(fmt.Sprintf("/disabled/user/%s", user.ID))), "=", 0),
+			notBlocked(s.User.ID, user.ID)).
+		Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		if countKeys(probeKey) == 0 {
+			return ErrStatusNotFound
+		}
+		return blockedOr(ErrTryAgainLater, blockKey(s.User.ID, user.ID))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+)
+
+var tStatusRevision string = "/revision/status/%s/%s"
+
+// Revision an earlier version of a status. CreateTime is when the version
+// was posted, CreateRev is the cursor for pagination
+type Revision struct {
+	Content    []*StatusFragment `json:"content"`
+	CreateTime time.Time         `json:"createTime"`
+	CreateRev  int64             `json:"createRev"`
+}
+
+// Edit replace content of the status with {opts}, the current version is
+// kept in the revision history. labels and mentions are derived again,
+// users mentioned for the first time are notified
+func (s *Status) Edit(opts *StatusOptions) error {
+	if s.User.ID != opts.User.ID || len(s.RepostOf) > 0 {
+		return ErrStatusNotFound
+	}
+	if s.Poll() != nil || (&Status{Content: opts.Content}).Poll() != nil {
+		return ErrPollEdit
+	}
+	statusKey := stateKey(fmt.Sprintf("/status/%s", s.ID))
+	resp, err := backend.Get(context.Background(), statusKey)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ErrStatusNotFound
+	}
+	cur := &Status{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, cur); err != nil {
+		return err
+	}
+	if cur.Removed {
+		return ErrStatusNotFound
+	}
+
+	revision := Revision{Content: cur.Content, CreateTime: cur.CreateTime}
+	if cur.EditTime != nil {
+		revision.CreateTime = *cur.EditTime
+	}
+	rb, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	cur.Content = opts.Content
+	cur.Labels = tools.Unique(opts.Labels)
+	cur.EditTime = &now
+	revisionKey := stateKey(fmt.Sprintf(tStatusRevision, s.ID, base58.Encode(xid.New().Bytes())))
+	// users blocking the author meanwhile are dropped from the mentions
+	users := mentionable(s.User.ID, opts.At)
+	for {
+		cur.Mentions = nil
+		var mentioned []*User
+		for _, u := range users {
+			cur.Mentions = append(cur.Mentions, u.ID)
+			if !slices.Contains(s.Mentions, u.ID) {
+				mentioned = append(mentioned, u)
+			}
+		}
+		b, err := json.Marshal(cur)
+		if err != nil {
+			return err
+		}
+
+		ops := []store.Op{
+			store.OpPut(statusKey, string(b)),
+			store.OpPut(revisionKey, string(rb)),
+		}
+		cmps := []store.Cmp{
+			store.Compare(store.ModRevision(statusKey), "=", resp.Kvs[0].ModRevision),
+			store.Compare(store.Version(stateKey(fmt.Sprintf("/disabled/user/%s", s.User.ID))), "=", 0),
+		}
+		for _, u := range users {
+			cmps = append(cmps, notBlocked(u.ID, s.User.ID))
+		}
+		for _, u := range mentioned {
+			ops = append(ops, newMessageOps(MsgOptions{
+				from:     opts.User,
+				toUID:    u.ID,
+				msgType:  MsgTypeAt,
+				targetID: s.ID,
+				message:  cur.Overview(),
+			})...)
+		}
+
+		for _, l := range s.Labels {
+			if !slices.Contains(cur.Labels, l) {
+				ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf("/labels/%s/status/%s", l, s.ID))))
+			}
+		}
+		if cur.Listed() {
+			for _, l := range cur.Labels {
+				ops = append(ops, store.OpPut(stateKey(fmt.Sprintf("/labels/%s/status/%s", l, s.ID)), statusKey))
+				ops = append(ops, store.OpPut(stateKey(fmt.Sprintf("/label/%s", l)), l))
+			}
+			cur.CreateRev = s.CreateRev
+			ops = append(ops, reindexStatusOps(cur)...)
+		}
+
+		txnResp, err := backend.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			break
+		}
+		n := len(users)
+		users = slices.DeleteFunc(users, func(u *User) bool { return Blocked(u.ID, s.User.ID) })
+		if len(users) == n {
+			return ErrTryAgainLater
+		}
+	}
+	s.Content = cur.Content
+	s.Labels = cur.Labels
+	s.Mentions = cur.Mentions
+	s.EditTime = cur.EditTime
+	return nil
+}
+
+// ListRevisions list earlier versions of the status, the latest first
+func (s *Status) ListRevisions(opts *tools.PaginationOptions) (revisions []*Revision, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tStatusRevision, s.ID, "")), opts)
+	for _, kv := range kvs {
+		r := &Revision{}
+		if err := json.Unmarshal(kv.Value, r); err != nil {
+			logrus.Error("ListRevisions unmarshal error: ", err)
+			continue
+		}
+		r.CreateRev = kv.CreateRevision
+		revisions = append(revisions, r)
+	}
+	return
+}
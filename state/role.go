@@ -0,0 +1,179 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tRole      string = "/role/%s"
+	tUserRoles string = "/roles/user/%s"
+
+	PermVerifyUser      string = "user:verify"
+	PermDisableUser     string = "user:disable"
+	PermManageSettings  string = "settings:write"
+	PermRecommendStatus string = "status:recommend"
+	PermDeleteStatus    string = "status:delete"
+	PermModerateReport  string = "report:moderate"
+	PermReadAudit       string = "audit:read"
+	PermManageRoles     string = "role:manage"
+
+	Permissions []string = []string{PermVerifyUser, PermDisableUser, PermManageSettings,
+		PermRecommendStatus, PermDeleteStatus, PermModerateReport, PermReadAudit, PermManageRoles}
+
+	// RoleAdmin the built-in role with all permissions, users in
+	// `config.Conf.Admins` have this role as well
+	RoleAdmin string = "admin"
+
+	defaultRoles []*Role = []*Role{
+		{Name: RoleAdmin, Permissions: Permissions},
+		{Name: "moderator", Permissions: []string{PermDeleteStatus, PermRecommendStatus,
+			PermDisableUser, PermModerateReport}},
+		{Name: "verifier", Permissions: []string{PermVerifyUser}},
+	}
+)
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// initRoles put default roles into state if absent
+func initRoles() {
+	for _, role := range defaultRoles {
+		key := stateKey(fmt.Sprintf(tRole, role.Name))
+		b, _ := json.Marshal(role)
+		_, err := backend.Txn(context.Background()).
+			If(store.Compare(store.Version(key), "=", 0)).
+			Then(store.OpPut(key, string(b))).Commit()
+		if err != nil {
+			logrus.Errorf("init role %s error: %s", role.Name, err)
+		}
+	}
+}
+
+func GetRole(name string) *Role {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tRole, name)))
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	if resp.Count == 0 {
+		return nil
+	}
+	role := &Role{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, role); err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	return role
+}
+
+func ListRoles() (roles []*Role) {
+	err := IterateWithPrefix(fmt.Sprintf(tRole, ""), func(_ string, value []byte) {
+		role := &Role{}
+		if err := json.Unmarshal(value, role); err != nil {
+			logrus.Error(err)
+			return
+		}
+		roles = append(roles, role)
+	})
+	if err != nil {
+		logrus.Error("list roles error: ", err)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return
+}
+
+// PutRole create or replace a role. the admin role is built-in and can not be changed
+func PutRole(role *Role, audit *AuditOptions) error {
+	if role.Name == RoleAdmin {
+		return ErrBuiltinRole
+	}
+	if !UniqueNameRegex.MatchString(role.Name) {
+		return fmt.Errorf("invalid role name %s", role.Name)
+	}
+	for _, p := range role.Permissions {
+		if !slices.Contains(Permissions, p) {
+			return fmt.Errorf("invalid permission %s", p)
+		}
+	}
+	role.Permissions = tools.Unique(role.Permissions)
+	b, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	return commitAudited(audit, nil, store.OpPut(stateKey(fmt.Sprintf(tRole, role.Name)), string(b)))
+}
+
+// DeleteRole delete a role, users lose its permissions immediately
+func DeleteRole(name string, audit *AuditOptions) error {
+	if name == RoleAdmin {
+		return ErrBuiltinRole
+	}
+	return commitAudited(audit, nil, store.OpDelete(stateKey(fmt.Sprintf(tRole, name))))
+}
+
+// UserRoles roles granted to user {uid}
+func UserRoles(uid string) (roles []string) {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tUserRoles, uid)))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if resp.Count > 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, &roles); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if slices.Contains(config.Conf.Admins, uid) && !slices.Contains(roles, RoleAdmin) {
+		roles = append(roles, RoleAdmin)
+	}
+	return
+}
+
+// SetUserRoles replace roles of user {uid}
+func SetUserRoles(uid string, roles []string, audit *AuditOptions) error {
+	roles = tools.Unique(roles)
+	for _, name := range roles {
+		if GetRole(name) == nil {
+			return fmt.Errorf("role %s not found", name)
+		}
+	}
+	key := stateKey(fmt.Sprintf(tUserRoles, uid))
+	if len(roles) == 0 {
+		return commitAudited(audit, nil, store.OpDelete(key))
+	}
+	b, err := json.Marshal(roles)
+	if err != nil {
+		return err
+	}
+	return commitAudited(audit, nil, store.OpPut(key, string(b)))
+}
+
+// HasRole determine if user {uid} has role {name}
+func HasRole(uid, name string) bool {
+	return slices.Contains(UserRoles(uid), name)
+}
+
+// HasPermission determine if any role of user {uid} grants permission {perm}
+func HasPermission(uid, perm string) bool {
+	for _, name := range UserRoles(uid) {
+		if name == RoleAdmin {
+			return true
+		}
+		role := GetRole(name)
+		if role != nil && slices.Contains(role.Permissions, perm) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,416 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tIndexTerm   string = "/index/term/%s/%s"
+	tIndexStatus string = "/index/status/%s"
+	tIndexRev    string = "/index/rev"
+	queryRegex          = regexp.MustCompile(`"([^"]+)"|(\S+)`)
+	// a term having more postings than this times the postings of the
+	// rarest term is looked up per candidate status instead of loaded
+	lookupRatio int64 = 8
+)
+
+// posting term occurrence in a status
+type posting struct {
+	statusID  string
+	CreateRev int64 `json:"rev,omitempty"`
+	Positions []int `json:"pos"`
+}
+
+// indexStatusOps build ops to put status content into the inverted index.
+// postings of a new status share its create revision because they are put
+// in the same txn, otherwise the create revision is recorded in the posting
+func indexStatusOps(s *Status) []store.Op {
+	positions := make(map[string][]int)
+	offset := 0
+	for _, c := range s.Content {
+		if c.Type != "text" {
+			continue
+		}
+		tokens := tokenize(c.Value, true)
+		for _, t := range tokens {
+			positions[t.term] = append(positions[t.term], t.pos+offset)
+		}
+		if len(tokens) > 0 {
+			// paragraphs are not adjacent for phrase queries
+			offset += tokens[len(tokens)-1].pos + 2
+		}
+	}
+	if len(positions) == 0 {
+		return nil
+	}
+	var ops []store.Op
+	var terms []string
+	for term, pos := range positions {
+		b, _ := json.Marshal(posting{CreateRev: s.CreateRev, Positions: pos})
+		ops = append(ops, store.OpPut(stateKey(fmt.Sprintf(tIndexTerm, term, s.ID)), string(b)))
+		terms = append(terms, term)
+	}
+	b, _ := json.Marshal(terms)
+	ops = append(ops, store.OpPut(stateKey(fmt.Sprintf(tIndexStatus, s.ID)), string(b)))
+	return ops
+}
+
+// indexedTerms terms of the status in the inverted index
+func indexedTerms(statusID string) (terms []string, err error) {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tIndexStatus, statusID)))
+	if err != nil || resp.Count == 0 {
+		return
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &terms)
+	return
+}
+
+// unindexStatusOps build ops to remove status from the inverted index
+func unindexStatusOps(statusID string) []store.Op {
+	terms, err := indexedTerms(statusID)
+	if err != nil {
+		logrus.Error("unindex status error: ", err)
+		return nil
+	}
+	if terms == nil {
+		return nil
+	}
+	ops := []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tIndexStatus, statusID)))}
+	for _, term := range terms {
+		ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tIndexTerm, term, statusID))))
+	}
+	return ops
+}
+
+// reindexStatusOps build ops to replace the status content in the inverted
+// index, a key is not both put and deleted in a txn
+func reindexStatusOps(s *Status) []store.Op {
+	ops := indexStatusOps(s)
+	if len(ops) == 0 {
+		return unindexStatusOps(s.ID)
+	}
+	terms, err := indexedTerms(s.ID)
+	if err != nil {
+		logrus.Error("reindex status error: ", err)
+		return ops
+	}
+	put := make(map[string]bool)
+	for _, op := range ops {
+		put[op.Key()] = true
+	}
+	for _, term := range terms {
+		key := stateKey(fmt.Sprintf(tIndexTerm, term, s.ID))
+		if !put[key] {
+			ops = append(ops, store.OpDelete(key))
+		}
+	}
+	return ops
+}
+
+func postingCount(term string) int64 {
+	return countKeys(stateKey(fmt.Sprintf(tIndexTerm, term, "")))
+}
+
+func unmarshalPosting(kv *store.KeyValue) *posting {
+	p := &posting{}
+	if err := json.Unmarshal(kv.Value, p); err != nil {
+		logrus.Debug(err)
+		return nil
+	}
+	if p.CreateRev == 0 {
+		p.CreateRev = kv.CreateRevision
+	}
+	s := strings.Split(string(kv.Key), "/")
+	p.statusID = s[len(s)-1]
+	return p
+}
+
+// loadPostings load all postings of the term
+func loadPostings(term string) (postings map[string]*posting, err error) {
+	postings = make(map[string]*posting)
+	var lastCreateRev int64
+	for {
+		resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tIndexTerm, term, "")),
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(lastCreateRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			lastCreateRev = kv.CreateRevision
+			if p := unmarshalPosting(kv); p != nil {
+				postings[p.statusID] = p
+			}
+		}
+		if !resp.More {
+			return postings, nil
+		}
+	}
+}
+
+// lookupPostings load postings of the term in the candidate statuses only
+func lookupPostings(term string, candidates map[string]*posting) (postings map[string]*posting, err error) {
+	postings = make(map[string]*posting)
+	for statusID := range candidates {
+		resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tIndexTerm, term, statusID)))
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		if p := unmarshalPosting(resp.Kvs[0]); p != nil {
+			postings[p.statusID] = p
+		}
+	}
+	return
+}
+
+// parseQuery split query to clauses, a clause is a quoted phrase or a word,
+// its terms must appear adjacent in status
+func parseQuery(query string) (clauses [][]token) {
+	for _, m := range queryRegex.FindAllStringSubmatch(query, -1) {
+		text := m[1]
+		if len(text) == 0 {
+			text = m[2]
+		}
+		tokens := tokenize(text, false)
+		if len(tokens) > 0 {
+			clauses = append(clauses, tokens)
+		}
+	}
+	return
+}
+
+func matchClause(clause []token, postings map[string]map[string]*posting, statusID string) bool {
+	first := postings[clause[0].term][statusID]
+	for _, start := range first.Positions {
+		matched := true
+		for _, t := range clause[1:] {
+			p := postings[t.term][statusID]
+			want := start + t.pos - clause[0].pos
+			found := false
+			for _, pos := range p.Positions {
+				if pos == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ListStatusByKeyword full-text search status visible to {viewer}. results are
+// ranked by tf-idf, the least relevant first when `opts.Ascend`. `opts.After`
+// is the offset of the page, the number of results returned by previous pages
+func ListStatusByKeyword(viewer *ActUser, value string, opts *tools.PaginationOptions) (ss []*Status, more bool) {
+	if opts == nil {
+		opts = &tools.PaginationOptions{Size: 20}
+	}
+	clauses := parseQuery(value)
+	if len(clauses) == 0 {
+		return
+	}
+
+	// the number of statuses containing each term, the idf of the term
+	counts := make(map[string]int64)
+	var rarestTerm string
+	for _, clause := range clauses {
+		for _, t := range clause {
+			if _, ok := counts[t.term]; ok {
+				continue
+			}
+			counts[t.term] = postingCount(t.term)
+			if counts[t.term] == 0 {
+				return
+			}
+			if len(rarestTerm) == 0 || counts[t.term] < counts[rarestTerm] {
+				rarestTerm = t.term
+			}
+		}
+	}
+
+	// intersect from the rarest term, postings of common terms are looked
+	// up in the statuses containing the rarest term only
+	rarest, err := loadPostings(rarestTerm)
+	if err != nil {
+		logrus.Errorf("search %s load postings error: %s", value, err)
+		return
+	}
+	postings := map[string]map[string]*posting{rarestTerm: rarest}
+	for term, count := range counts {
+		if term == rarestTerm {
+			continue
+		}
+		var p map[string]*posting
+		if count > lookupRatio*int64(len(rarest)) {
+			p, err = lookupPostings(term, rarest)
+		} else {
+			p, err = loadPostings(term)
+		}
+		if err != nil {
+			logrus.Errorf("search %s load postings error: %s", value, err)
+			return
+		}
+		postings[term] = p
+	}
+
+	total := float64(countKeys(stateKey(fmt.Sprintf(tIndexStatus, ""))))
+	type hit struct {
+		statusID  string
+		createRev int64
+		score     float64
+	}
+	var hits []*hit
+	for statusID, p := range rarest {
+		matched := true
+		for _, tp := range postings {
+			if _, ok := tp[statusID]; !ok {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, clause := range clauses {
+			if !matchClause(clause, postings, statusID) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		h := &hit{statusID: statusID, createRev: p.CreateRev}
+		for term, tp := range postings {
+			idf := math.Log(1 + total/float64(counts[term]))
+			h.score += math.Sqrt(float64(len(tp[statusID].Positions))) * idf
+		}
+		hits = append(hits, h)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].createRev > hits[j].createRev
+	})
+	if opts.Ascend {
+		tools.Reverse(hits)
+	}
+
+	// the offset counts visible results, so it matches what the viewer got
+	hidden := HiddenUsers(viewer)
+	var skipped int64
+	for _, h := range hits {
+		s := GetStatus(h.statusID)
+		if s == nil || hidden[s.User.ID] || !s.VisibleTo(viewer) {
+			continue
+		}
+		if skipped < opts.After {
+			skipped++
+			continue
+		}
+		if int64(len(ss)) >= opts.Size {
+			more = true
+			break
+		}
+		ss = append(ss, s)
+	}
+	return
+}
+
+// rebuildSearchIndex index status created before search was available
+func rebuildSearchIndex() {
+	mutex, err := backend.NewMutex(stateKey("/election/index"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Unlock(context.Background())
+
+	// statuses created after the high-water revision are scanned only,
+	// newer statuses are indexed when they are created
+	indexed := 0
+	var lastCreateRev int64
+	revKey := stateKey(tIndexRev)
+	if resp, err := backend.Get(context.Background(), revKey); err == nil && len(resp.Kvs) > 0 {
+		lastCreateRev, _ = strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	}
+	for {
+		resp, err := backend.Get(context.Background(), stateKey("/status/"),
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(lastCreateRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
+		if err != nil {
+			logrus.Error("[search-index] ", err)
+			return
+		}
+		for _, kv := range resp.Kvs {
+			lastCreateRev = kv.CreateRevision
+			s := &Status{}
+			if err := json.Unmarshal(kv.Value, s); err != nil {
+				logrus.Debug(err)
+				continue
+			}
+			if !s.Listed() {
+				continue
+			}
+			s.CreateRev = kv.CreateRevision
+			ops := indexStatusOps(s)
+			if len(ops) == 0 {
+				continue
+			}
+			indexKey := stateKey(fmt.Sprintf(tIndexStatus, s.ID))
+			r, err := backend.Txn(context.Background()).
+				If(store.Compare(store.Version(indexKey), "=", 0),
+					store.Compare(store.Version(string(kv.Key)), ">", 0)).
+				Then(ops...).Commit()
+			if err != nil {
+				logrus.Error("[search-index] ", err)
+				continue
+			}
+			if r.Succeeded {
+				indexed++
+			}
+		}
+		if len(resp.Kvs) > 0 {
+			if err := backend.Put(context.Background(), revKey, strconv.FormatInt(lastCreateRev, 10)); err != nil {
+				logrus.Error("[search-index] ", err)
+			}
+		}
+		if !resp.More {
+			break
+		}
+	}
+	logrus.Infof("[search-index] %d status indexed", indexed)
+}
@@ -1,29 +1,107 @@
 package state
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/decred/base58"
 	"github.com/rkonfj/lln/config"
-	"github.com/rkonfj/lln/tools"
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	tSession string = "/session/%s"
+	// last seen time is updated at most once per interval
+	sessionTouchInterval time.Duration = time.Minute
+	// leases are renewed when less than 1/sessionRenewFraction of the ttl
+	// is left, so an active session is written about twice per ttl
+	sessionRenewFraction time.Duration = 2
+	// sessions without a renewable lease persist the last seen time hourly
+	sessionPersistInterval time.Duration = time.Hour
+	// freshSessionAge sensitive actions require a session logged in within the age
+	freshSessionAge time.Duration = 10 * time.Minute
+	// key of api key hash, from config or generated once and kept in state
+	sessionHashKey []byte
+)
+
+// Session api keys are not persisted, sessions are stored and looked up
+// by the keyed hash of the api key
 type Session struct {
-	ApiKey       string `json:"apiKey"`
-	ID           string `json:"id"`
-	Name         string `json:"name"`
-	UniqueName   string `json:"uniqueName"`
-	Picture      string `json:"picture"`
-	Locale       string `json:"locale"`
-	Bio          string `json:"bio"`
-	VerifiedCode int64  `json:"verifiedCode"`
-	Admin        bool   `json:"admin"`
-	Bg           string `json:"bg"`
+	ApiKey       string    `json:"apiKey,omitempty"`
+	SID          string    `json:"sid"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	UniqueName   string    `json:"uniqueName"`
+	Picture      string    `json:"picture"`
+	Locale       string    `json:"locale"`
+	Bio          string    `json:"bio"`
+	VerifiedCode int64     `json:"verifiedCode"`
+	Admin        bool      `json:"admin"`
+	Roles        []string  `json:"roles"`
+	Bg           string    `json:"bg"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"userAgent"`
+	CreateTime   time.Time `json:"createTime"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Kind         string    `json:"kind,omitempty"`
+	TokenName    string    `json:"tokenName,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"`
+	ExpireTime   time.Time `json:"expireTime,omitempty"`
+	// MFAPending pre-session waiting for the second factor, see VerifyLogin
+	MFAPending bool `json:"mfaPending,omitempty"`
+	// MFA the session is verified with a second factor
+	MFA     bool `json:"mfa,omitempty"`
+	keyHash string
+	lease   store.LeaseID
+	// renewTime when the lease was renewed and last seen time persisted
+	renewTime time.Time
+}
+
+// initSessionHashKey load the key used to hash api keys
+func initSessionHashKey() error {
+	if len(config.Conf.Session.HashKey) > 0 {
+		sessionHashKey = []byte(config.Conf.Session.HashKey)
+		return nil
+	}
+	logrus.Warn("session.hashKey is not configured, using the key generated in state")
+	key := stateKey("/meta/session-hash-key")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	_, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(key), "=", 0)).
+		Then(store.OpPut(key, base58.Encode(b))).Commit()
+	if err != nil {
+		return err
+	}
+	resp, err := backend.Get(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if resp.Count == 0 {
+		return ErrTryAgainLater
+	}
+	sessionHashKey = resp.Kvs[0].Value
+	return nil
+}
+
+// hashApiKey keyed hash of api key
+func hashApiKey(apiKey string) string {
+	mac := hmac.New(sha256.New, sessionHashKey)
+	mac.Write([]byte(apiKey))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (s *Session) ToUser() *ActUser {
@@ -36,11 +114,51 @@ func (s *Session) ToUser() *ActUser {
 	}
 }
 
+// IsToken determine if the session is a personal access token
+func (s *Session) IsToken() bool {
+	return s.Kind == SessionKindToken
+}
+
+// HasScope determine if the session is allowed to access {scope}. login
+// sessions have all scopes, tokens have the scopes they were created with
+func (s *Session) HasScope(scope string) bool {
+	if !s.IsToken() {
+		return true
+	}
+	return len(scope) > 0 && slices.Contains(s.Scopes, scope)
+}
+
+// Expired determine if the session passed its expire time, absolute ttl or
+// idle timeout. tokens and pre-sessions expire at their expire time only
+func (s *Session) Expired(now time.Time) bool {
+	if s.IsToken() || s.MFAPending {
+		return !s.ExpireTime.IsZero() && now.After(s.ExpireTime)
+	}
+	ttl, idle := config.Conf.Session.TTL, config.Conf.Session.IdleTimeout
+	if ttl > 0 && now.Sub(s.CreateTime) > ttl {
+		return true
+	}
+	return idle > 0 && now.Sub(s.LastSeen) > idle
+}
+
+// Fresh determine if the session logged in recently, verified with the second
+// factor when the user has two-factor authentication enabled
+func (s *Session) Fresh(now time.Time) bool {
+	if s.IsToken() || s.MFAPending || now.Sub(s.CreateTime) > freshSessionAge {
+		return false
+	}
+	return s.MFA || !TOTPEnabled(s.ID)
+}
+
 type SessionManager interface {
 	Create(*Session) error
 	Load(string) *Session
 	Delete(string) error
 	Expire(string) error
+	// List sessions of user
+	List(string) []*Session
+	// Revoke session by session id
+	Revoke(string) error
 }
 
 type MemorySessionManger struct {
@@ -52,48 +170,97 @@ type MemorySessionManger struct {
 func (sm *MemorySessionManger) Create(s *Session) error {
 	b := make([]byte, 16)
 	rand.Reader.Read(b)
-	s.ApiKey = fmt.Sprintf("sk-%s", base58.Encode(append(b, xid.New().Bytes()...)))
+	prefix := "sk"
+	if s.IsToken() {
+		prefix = "pat"
+	}
+	s.ApiKey = fmt.Sprintf("%s-%s", prefix, base58.Encode(append(b, xid.New().Bytes()...)))
+	s.SID = base58.Encode(xid.New().Bytes())
+	s.CreateTime = time.Now()
+	s.LastSeen = s.CreateTime
+	s.renewTime = s.CreateTime
+	s.keyHash = hashApiKey(s.ApiKey)
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
-	if _, ok := sm.session[s.ApiKey]; ok {
-		logrus.Debug("session key already exists: ", s.ApiKey)
+	if _, ok := sm.session[s.keyHash]; ok {
+		logrus.Debug("session key already exists: ", s.SID)
 		return nil
 	}
-	sm.session[s.ApiKey] = s
-	sm.revSession[s.ID] = append(sm.revSession[s.ID], s.ApiKey)
+	sm.put(s)
 	return nil
 }
 
+// put add or replace the session, lock must be held
+func (sm *MemorySessionManger) put(s *Session) {
+	if _, ok := sm.session[s.keyHash]; !ok {
+		sm.revSession[s.ID] = append(sm.revSession[s.ID], s.keyHash)
+	}
+	sm.session[s.keyHash] = s
+}
+
 func (sm *MemorySessionManger) Delete(apiKey string) error {
+	return sm.delete(hashApiKey(apiKey))
+}
+
+// delete session by api key hash
+func (sm *MemorySessionManger) delete(keyHash string) error {
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
-	s := sm.session[apiKey]
+	s := sm.session[keyHash]
 	if s == nil {
 		return nil
 	}
-	delete(sm.session, apiKey)
+	delete(sm.session, keyHash)
 
-	apiKeys := []string{}
+	keyHashes := []string{}
 
 	for _, key := range sm.revSession[s.ID] {
-		if key != apiKey {
-			apiKeys = append(apiKeys, key)
+		if key != keyHash {
+			keyHashes = append(keyHashes, key)
 		}
 	}
 
-	sm.revSession[s.ID] = apiKeys
+	sm.revSession[s.ID] = keyHashes
+	return nil
+}
+
+// get session by api key hash
+func (sm *MemorySessionManger) get(keyHash string) *Session {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	return sm.session[keyHash]
+}
+
+// bySID find session by session id
+func (sm *MemorySessionManger) bySID(sid string) *Session {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	for _, s := range sm.session {
+		if s.SID == sid {
+			return s
+		}
+	}
 	return nil
 }
 
 func (sm *MemorySessionManger) Load(key string) *Session {
-	return sm.session[key]
+	keyHash := hashApiKey(key)
+	s := sm.get(keyHash)
+	if s == nil {
+		return nil
+	}
+	if s.Expired(time.Now()) {
+		sm.delete(keyHash)
+		return nil
+	}
+	return s
 }
 
 func (sm *MemorySessionManger) Expire(userID string) error {
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
-	if apiKeys, ok := sm.revSession[userID]; ok {
-		for _, key := range apiKeys {
+	if keyHashes, ok := sm.revSession[userID]; ok {
+		for _, key := range keyHashes {
 			delete(sm.session, key)
 		}
 		delete(sm.revSession, userID)
@@ -101,6 +268,28 @@ func (sm *MemorySessionManger) Expire(userID string) error {
 	return nil
 }
 
+func (sm *MemorySessionManger) Revoke(sid string) error {
+	s := sm.bySID(sid)
+	if s == nil {
+		return nil
+	}
+	return sm.delete(s.keyHash)
+}
+
+func (sm *MemorySessionManger) List(userID string) (sessions []*Session) {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	for _, key := range sm.revSession[userID] {
+		if s, ok := sm.session[key]; ok {
+			sessions = append(sessions, s)
+		}
+	}
+	return
+}
+
+// PersistentSessionManager sessions are persisted with a lease of the idle
+// timeout, the lease is renewed when the session is used, so that idle
+// sessions disappear from all instances
 type PersistentSessionManager struct {
 	MemorySessionManger
 }
@@ -112,23 +301,152 @@ func NewSessionManager() *PersistentSessionManager {
 			revSession: make(map[string][]string),
 		},
 	}
+	if err := initSessionHashKey(); err != nil {
+		logrus.Fatal("init session hash key error: ", err)
+	}
+	prefix := stateKey(fmt.Sprintf(tSession, ""))
 	sessionCount := 0
-	err := IterateWithPrefix("/session", func(_ string, value []byte) {
-		ssion := Session{}
-		err := json.Unmarshal(value, &ssion)
+	var lastCreateRev int64
+	for {
+		resp, err := backend.Get(context.Background(), prefix,
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(lastCreateRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
 		if err != nil {
-			logrus.Error(err)
-			return
+			logrus.Error("restore session error: ", err)
+			break
+		}
+		for _, kv := range resp.Kvs {
+			lastCreateRev = kv.CreateRevision
+			ssion := &Session{}
+			if err := json.Unmarshal(kv.Value, ssion); err != nil {
+				logrus.Error(err)
+				continue
+			}
+			ssion.keyHash = strings.TrimPrefix(string(kv.Key), prefix)
+			ssion.lease = kv.Lease
+			if sm.restore(string(kv.Key), ssion) {
+				sessionCount++
+			}
+		}
+		if !resp.More {
+			break
 		}
-		sm.MemorySessionManger.session[ssion.ApiKey] = &ssion
-		sm.MemorySessionManger.revSession[ssion.ID] = append(sm.MemorySessionManger.revSession[ssion.ID], ssion.ApiKey)
-		sessionCount++
-	})
+	}
 	logrus.Infof("%d sessions restored", sessionCount)
+	return sm
+}
+
+// restore put persisted session into memory. expired sessions are deleted,
+// sessions persisted with raw api key or without lease are migrated
+func (sm *PersistentSessionManager) restore(key string, s *Session) bool {
+	now := time.Now()
+	if s.CreateTime.IsZero() {
+		s.CreateTime = now
+		s.LastSeen = now
+	}
+	if len(s.SID) == 0 {
+		s.SID = base58.Encode(xid.New().Bytes())
+	}
+	s.renewTime = s.LastSeen
+	if s.Expired(now) {
+		if err := backend.Delete(context.Background(), key); err != nil {
+			logrus.Error("delete expired session error: ", err)
+		}
+		return false
+	}
+	legacy := len(s.ApiKey) > 0
+	if legacy {
+		s.keyHash = hashApiKey(s.ApiKey)
+		s.ApiKey = ""
+	}
+	if legacy || (s.lease == 0 && s.leaseTTL() > 0) {
+		if err := sm.migrate(key, s); err != nil {
+			logrus.Error("migrate session error: ", err)
+		}
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.put(s)
+	return true
+}
+
+// migrate move session persisted at key to its hashed key with a lease
+func (sm *PersistentSessionManager) migrate(key string, s *Session) error {
+	if s.lease == 0 {
+		if err := grantSessionLease(s); err != nil {
+			return err
+		}
+	}
+	op, err := sessionPutOp(s)
 	if err != nil {
-		logrus.Error("restore session error: ", err)
+		return err
 	}
-	return sm
+	ops := []store.Op{op}
+	if key != op.Key() {
+		ops = append(ops, store.OpDelete(key))
+	}
+	// other instances may be migrating the same session
+	_, err = backend.Txn(context.Background()).
+		If(store.Compare(store.Version(key), ">", 0)).
+		Then(ops...).Commit()
+	return err
+}
+
+// leaseTTL seconds a session lives without being used, a token or
+// pre-session lives until its expire time
+func (s *Session) leaseTTL() int64 {
+	if s.IsToken() || s.MFAPending {
+		if s.ExpireTime.IsZero() {
+			return 0
+		}
+		return max(int64(time.Until(s.ExpireTime).Seconds()), 1)
+	}
+	ttl := config.Conf.Session.IdleTimeout
+	if ttl == 0 {
+		ttl = config.Conf.Session.TTL
+	}
+	return int64(ttl.Seconds())
+}
+
+func grantSessionLease(s *Session) error {
+	s.lease = 0
+	if ttl := s.leaseTTL(); ttl > 0 {
+		lease, err := backend.Grant(context.Background(), ttl)
+		if err != nil {
+			return err
+		}
+		s.lease = lease
+	}
+	return nil
+}
+
+// sessionPutOp op to persist the session without its api key
+func sessionPutOp(s *Session) (store.Op, error) {
+	c := *s
+	c.ApiKey = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.OpPut(stateKey(fmt.Sprintf(tSession, s.keyHash)), string(b),
+		store.WithLease(s.lease)), nil
+}
+
+// persist put the session into state, a new lease is granted when {grant}
+func (sm *PersistentSessionManager) persist(s *Session, grant bool) error {
+	if grant {
+		if err := grantSessionLease(s); err != nil {
+			return err
+		}
+	}
+	op, err := sessionPutOp(s)
+	if err != nil {
+		return err
+	}
+	_, err = backend.Txn(context.Background()).Then(op).Commit()
+	return err
 }
 
 func (sm *PersistentSessionManager) Create(s *Session) error {
@@ -136,56 +454,178 @@ func (sm *PersistentSessionManager) Create(s *Session) error {
 	if err != nil {
 		return err
 	}
-	b, err := json.Marshal(s)
-	if err != nil {
+	if err := sm.persist(s, true); err != nil {
 		logrus.Warn(err)
-		return nil
 	}
-	Put(fmt.Sprintf("/session/%s", s.ApiKey), b)
 	return nil
 }
 
+func (sm *PersistentSessionManager) Load(key string) *Session {
+	keyHash := hashApiKey(key)
+	s := sm.get(keyHash)
+	if s == nil {
+		return nil
+	}
+	now := time.Now()
+	if s.Expired(now) {
+		if err := sm.remove(keyHash); err != nil {
+			logrus.Error("delete expired session error: ", err)
+		}
+		return nil
+	}
+	if now.Sub(s.LastSeen) > sessionTouchInterval {
+		sm.touch(s, now)
+	}
+	return s
+}
+
+// renewDue determine if the lease of the session should be renewed, the
+// last seen time is persisted along with it
+func (s *Session) renewDue(now time.Time) bool {
+	interval := sessionPersistInterval
+	if s.lease != 0 && !s.IsToken() && !s.MFAPending {
+		ttl := time.Duration(s.leaseTTL()) * time.Second
+		interval = ttl - ttl/sessionRenewFraction
+	}
+	return now.Sub(s.renewTime) > interval
+}
+
+// touch record last seen time of the session, it's persisted and the lease
+// is renewed only when the renewal is due
+func (sm *PersistentSessionManager) touch(s *Session, now time.Time) {
+	c := *s
+	c.LastSeen = now
+	renew := s.renewDue(now)
+	if renew {
+		c.renewTime = now
+	}
+	sm.lock.Lock()
+	if sm.session[s.keyHash] != s {
+		// changed concurrently
+		sm.lock.Unlock()
+		return
+	}
+	sm.put(&c)
+	sm.lock.Unlock()
+	if !renew {
+		return
+	}
+
+	go func() {
+		// lease of token or pre-session is not renewed, it expires at the expire time
+		if c.lease != 0 && !c.IsToken() && !c.MFAPending {
+			err := backend.KeepAliveOnce(context.Background(), c.lease)
+			if err == store.ErrLeaseNotFound {
+				sm.MemorySessionManger.delete(c.keyHash)
+				return
+			}
+			if err != nil {
+				logrus.Error("renew session lease error: ", err)
+			}
+		}
+		if err := sm.persist(&c, false); err != nil {
+			logrus.Error("touch session error: ", err)
+		}
+	}()
+}
+
+// Expire log out user {userID} so that changes of the user take effect,
+// tokens are kept and refreshed instead
 func (sm *PersistentSessionManager) Expire(userID string) error {
-	apiKeys := sm.MemorySessionManger.revSession[userID]
-	logrus.Debug("expire api keys: ", apiKeys)
-	for _, key := range apiKeys {
-		err := Del(fmt.Sprintf("/session/%s", key))
-		if err != nil {
+	sessions := sm.List(userID)
+	logrus.Debugf("expire %d sessions of user %s", len(sessions), userID)
+	u := UserByID(userID)
+	for _, s := range sessions {
+		if s.IsToken() && u != nil {
+			c := *s
+			c.fillUser(u)
+			if err := sm.persist(&c, false); err != nil {
+				return err
+			}
+			sm.lock.Lock()
+			sm.put(&c)
+			sm.lock.Unlock()
+			continue
+		}
+		if err := sm.remove(s.keyHash); err != nil {
 			return err
 		}
 	}
-	return sm.MemorySessionManger.Expire(userID)
+	return nil
 }
 
 func (sm *PersistentSessionManager) Delete(apiKey string) error {
-	err := Del(fmt.Sprintf("/session/%s", apiKey))
+	return sm.remove(hashApiKey(apiKey))
+}
+
+func (sm *PersistentSessionManager) Revoke(sid string) error {
+	s := sm.bySID(sid)
+	if s == nil {
+		return nil
+	}
+	return sm.remove(s.keyHash)
+}
+
+// remove session by api key hash
+func (sm *PersistentSessionManager) remove(keyHash string) error {
+	err := Del(fmt.Sprintf(tSession, keyHash))
 	if err != nil {
 		return err
 	}
-	return sm.MemorySessionManger.Delete(apiKey)
+	return sm.MemorySessionManger.delete(keyHash)
 }
 
 var DefaultSessionManager SessionManager
 
-func CreateSession(opts *UserOptions) (s *Session, err error) {
-	u := UserByEmail(opts.Email)
-	if u == nil {
-		u, err = NewUser(opts)
-		if err != nil {
-			return
-		}
+// SessionClient the client a session is created for
+type SessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+// CreateSession login the user of the identity, see userByIdentity
+func CreateSession(identity *Identity, opts *UserOptions, client *SessionClient) (s *Session, err error) {
+	u, err := userByIdentity(identity, opts)
+	if err != nil {
+		return
+	}
+	return newLoginSession(u, client, false)
+}
+
+// newLoginSession login user u. a pre-session is created when the user has
+// two-factor authentication enabled and the login is not verified by {mfa}.
+// users whose account is being deleted can't login
+func newLoginSession(u *User, client *SessionClient, mfa bool) (*Session, error) {
+	if accountDeleting(u.ID) {
+		return nil, ErrAccountDeleting
 	}
-	s = &Session{
-		ID:           u.ID,
-		Name:         u.Name,
-		UniqueName:   u.UniqueName,
-		Picture:      u.Picture,
-		Bg:           u.Bg,
-		Locale:       u.Locale,
-		Bio:          u.Bio,
-		VerifiedCode: u.VerifiedCode,
-		Admin:        tools.Contains(config.Conf.Admins, u.ID),
+	s := &Session{
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		MFA:       mfa,
+	}
+	s.fillUser(u)
+	if !mfa && TOTPEnabled(u.ID) {
+		s.MFAPending = true
+		s.ExpireTime = time.Now().Add(preSessionTTL)
+	}
+	if err := DefaultSessionManager.Create(s); err != nil {
+		return nil, err
 	}
-	DefaultSessionManager.Create(s)
 	return s, nil
 }
+
+// fillUser copy user u into the session
+func (s *Session) fillUser(u *User) {
+	roles := UserRoles(u.ID)
+	s.ID = u.ID
+	s.Name = u.Name
+	s.UniqueName = u.UniqueName
+	s.Picture = u.Picture
+	s.Bg = u.Bg
+	s.Locale = u.Locale
+	s.Bio = u.Bio
+	s.VerifiedCode = u.VerifiedCode
+	s.Admin = slices.Contains(roles, RoleAdmin)
+	s.Roles = roles
+}
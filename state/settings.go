@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"github.com/rkonfj/lln/state/store"
 )
 
 type Settings struct {
@@ -24,7 +24,7 @@ type Friend struct {
 
 func GetSettings() (s *Settings, err error) {
 	key := stateKey("/settings")
-	resp, err := etcdClient.KV.Get(context.Background(), key)
+	resp, err := backend.Get(context.Background(), key)
 	if err != nil {
 		return
 	}
@@ -35,9 +35,9 @@ func GetSettings() (s *Settings, err error) {
 			Friends:        []Friend{},
 		}
 		b, _ := json.Marshal(s)
-		r, er := etcdClient.Txn(context.Background()).
-			If(clientv3.Compare(clientv3.Version(key), "=", 0)).
-			Then(clientv3.OpPut(key, string(b))).Commit()
+		r, er := backend.Txn(context.Background()).
+			If(store.Compare(store.Version(key), "=", 0)).
+			Then(store.OpPut(key, string(b))).Commit()
 		if er != nil {
 			err = er
 			return
@@ -53,9 +53,9 @@ func GetSettings() (s *Settings, err error) {
 	return
 }
 
-func UpdateSettings(s *Settings) error {
+func UpdateSettings(s *Settings, audit *AuditOptions) error {
 	key := stateKey("/settings")
-	resp, err := etcdClient.KV.Get(context.Background(), key)
+	resp, err := backend.Get(context.Background(), key)
 	if err != nil {
 		return err
 	}
@@ -66,14 +66,7 @@ func UpdateSettings(s *Settings) error {
 
 	b, _ := json.Marshal(s)
 
-	r, err := etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
-		Then(clientv3.OpPut(key, string(b))).Commit()
-	if err != nil {
-		return err
-	}
-	if !r.Succeeded {
-		return ErrTryAgainLater
-	}
-	return nil
+	return commitAudited(audit,
+		[]store.Cmp{store.Compare(store.ModRevision(key), "=", resp.Kvs[0].ModRevision)},
+		store.OpPut(key, string(b)))
 }
@@ -6,45 +6,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.etcd.io/etcd/pkg/transport"
 )
 
 var (
-	etcdClient *clientv3.Client
+	backend store.Backend
 )
 
-type EtcdOptions struct {
-	Endpoints     []string
-	CertFile      string
-	KeyFile       string
-	TrustedCAFile string
-}
-
-func InitState(opts EtcdOptions) (err error) {
+// InitState init state component with the storage backend
+func InitState(b store.Backend) error {
 	logrus.Info("initializing state component")
-	cfg := clientv3.Config{
-		Endpoints:   opts.Endpoints,
-		DialTimeout: 5 * time.Second,
-	}
-
-	tlsInfo := transport.TLSInfo{
-		CertFile:      opts.CertFile,
-		KeyFile:       opts.KeyFile,
-		TrustedCAFile: opts.TrustedCAFile,
-	}
-	tlsConfig, err := tlsInfo.ClientConfig()
-	if err != nil {
-		logrus.Debug(err)
-	} else {
-		cfg.TLS = tlsConfig
-	}
-
-	etcdClient, err = clientv3.New(cfg)
+	backend = b
 	DefaultSessionManager = NewSessionManager()
+	initRoles()
 	startKeepConsistency()
-	return
+	return nil
 }
 
 func stateKey(key string) string {
@@ -54,25 +31,23 @@ func stateKey(key string) string {
 	return fmt.Sprintf("/lln/%s", key)
 }
 
-func getPointerValue(key string) (*clientv3.GetResponse, error) {
-	resp, err := etcdClient.KV.Get(context.Background(), key)
+func getPointerValue(key string) (*store.GetResponse, error) {
+	resp, err := backend.Get(context.Background(), key)
 	if err != nil {
 		return nil, err
 	}
 	if len(resp.Kvs) != 1 {
 		return nil, fmt.Errorf("pointer %s not found", key)
 	}
-	return etcdClient.KV.Get(context.Background(), string(resp.Kvs[0].Value))
+	return backend.Get(context.Background(), string(resp.Kvs[0].Value))
 }
 
 func Put(key string, value []byte) error {
-	_, err := etcdClient.KV.Put(context.Background(), stateKey(key), string(value))
-	return err
+	return backend.Put(context.Background(), stateKey(key), string(value))
 }
 
 func Del(key string) error {
-	_, err := etcdClient.KV.Delete(context.Background(), stateKey(key))
-	return err
+	return backend.Delete(context.Background(), stateKey(key))
 }
 
 func IterateWithPrefix(prefix string, handle func(key string, value []byte)) error {
@@ -80,10 +55,11 @@ func IterateWithPrefix(prefix string, handle func(key string, value []byte)) err
 	for {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		resp, err := etcdClient.KV.Get(ctx, stateKey(prefix),
-			clientv3.WithPrefix(),
-			clientv3.WithLimit(1024),
-			clientv3.WithMinCreateRev(lastCreateRev+1))
+		resp, err := backend.Get(ctx, stateKey(prefix),
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(lastCreateRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,871 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.WarnLevel)
+	config.Conf = &config.Config{Session: config.SessionConfig{TTL: time.Hour, IdleTimeout: time.Hour}}
+	config.Conf.Model.Timeline.FanOutFollowersLimit = 100
+	if err := InitState(store.NewMemoryBackend()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+var userSeq atomic.Int64
+
+// newTestUser create a user with a unique name derived from name
+func newTestUser(t *testing.T, name string) *ActUser {
+	t.Helper()
+	name = fmt.Sprintf("%s_%d", name, userSeq.Add(1))
+	u, err := NewUser(&UserOptions{Name: name, Email: name + "@lln.test", Picture: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.ToActUser()
+}
+
+func newTestStatus(t *testing.T, opts *StatusOptions) *Status {
+	t.Helper()
+	s, err := NewStatus(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func text(v string) []*StatusFragment {
+	return []*StatusFragment{{Type: "text", Value: v}}
+}
+
+// messageTypes types of messages sent to user, the latest first
+func messageTypes(user *ActUser) (types []string) {
+	msgs, _ := ListMessages(user, &tools.PaginationOptions{})
+	for _, m := range msgs {
+		types = append(types, m.Type)
+	}
+	return
+}
+
+func TestStatusComments(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: text("hello")})
+	if got := GetStatus(s.ID); got == nil || got.Overview() != "hello" || got.User.ID != alice.ID {
+		t.Fatalf("unexpected status %+v", got)
+	}
+
+	c := newTestStatus(t, &StatusOptions{User: bob, Content: text("hi"), RefStatus: s.ID})
+	if ss, _ := StatusComments(s.ID, &tools.PaginationOptions{Size: 10}); len(ss) != 1 || ss[0].ID != c.ID {
+		t.Fatalf("unexpected comments %v", ss)
+	}
+	if types := messageTypes(alice); len(types) != 1 || types[0] != MsgTypeComment {
+		t.Fatalf("unexpected messages of alice %v", types)
+	}
+
+	if _, err := NewStatus(&StatusOptions{User: bob, Content: text("x"), RefStatus: "missing"}); err == nil {
+		t.Fatal("comment on a missing status succeeded")
+	}
+
+	if err := s.Delete(bob.ID); !errors.Is(err, ErrStatusNotFound) {
+		t.Fatalf("deleted by other user: %v", err)
+	}
+	if err := s.Delete(alice.ID); !errors.Is(err, ErrStatusQuotes) {
+		t.Fatalf("deleted with comments: %v", err)
+	}
+	if err := c.Delete(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if GetStatus(c.ID) != nil {
+		t.Fatal("deleted comment still exists")
+	}
+}
+
+func TestLikeBookmarkToggle(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: text("like me")})
+
+	cases := []struct {
+		toggle func(*ActUser, string) error
+		state  func(statusID, uid string) bool
+		count  func(statusID string) int64
+		msg    string
+	}{
+		{LikeStatus, Liked, likeCount, MsgTypeLike},
+		{BookmarkStatus, Bookmarked, bookmarkCount, MsgTypeBookmark},
+	}
+	for _, c := range cases {
+		if err := c.toggle(bob, s.ID); err != nil {
+			t.Fatal(err)
+		}
+		if !c.state(s.ID, bob.ID) || c.count(s.ID) != 1 {
+			t.Fatalf("%s: not toggled on", c.msg)
+		}
+		if err := c.toggle(bob, s.ID); err != nil {
+			t.Fatal(err)
+		}
+		if c.state(s.ID, bob.ID) || c.count(s.ID) != 0 {
+			t.Fatalf("%s: not toggled off", c.msg)
+		}
+		if err := c.toggle(bob, "missing"); !errors.Is(err, ErrStatusNotFound) {
+			t.Fatalf("%s: missing status: %v", c.msg, err)
+		}
+	}
+	if types := messageTypes(alice); len(types) != 2 {
+		t.Fatalf("unexpected messages of alice %v", types)
+	}
+}
+
+func TestFollowUser(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	a := UserByID(alice.ID)
+	if !Followed(bob.ID, alice.ID) || a.Followers() != 1 || UserByID(bob.ID).Followings() != 1 {
+		t.Fatal("follow not recorded")
+	}
+	if follows, _ := a.ListFollowers(&tools.PaginationOptions{Size: 10}); len(follows) != 1 || follows[0].User.ID != bob.ID {
+		t.Fatalf("unexpected followers %v", follows)
+	}
+	if types := messageTypes(alice); len(types) != 1 || types[0] != MsgTypeFollow {
+		t.Fatalf("unexpected messages of alice %v", types)
+	}
+
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if Followed(bob.ID, alice.ID) || a.Followers() != 0 {
+		t.Fatal("unfollow not recorded")
+	}
+	if err := FollowUser(bob, "missing"); err == nil {
+		t.Fatal("followed a missing user")
+	}
+}
+
+func TestBlockUser(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: text("no bob")})
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := BlockUser(alice, bob.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if !Blocked(alice.ID, bob.ID) || Followed(bob.ID, alice.ID) {
+		t.Fatal("block must remove the follow")
+	}
+
+	blocked := []struct {
+		name string
+		err  error
+	}{
+		{"follow", FollowUser(bob, alice.UniqueName)},
+		{"like", LikeStatus(bob, s.ID)},
+		{"comment", func() error {
+			_, err := NewStatus(&StatusOptions{User: bob, Content: text("x"), RefStatus: s.ID})
+			return err
+		}()},
+	}
+	for _, c := range blocked {
+		if !errors.Is(c.err, ErrBlocked) {
+			t.Errorf("%s: %v, want ErrBlocked", c.name, c.err)
+		}
+	}
+
+	if err := BlockUser(alice, bob.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if Blocked(alice.ID, bob.ID) {
+		t.Fatal("not unblocked")
+	}
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrivateAccount(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	u := UserByID(alice.ID)
+	private := true
+	if err := u.Modify(ModifiableUser{Private: &private}); err != nil {
+		t.Fatal(err)
+	}
+	if CanView(bob, alice.ID) || !CanView(alice, alice.ID) {
+		t.Fatal("private statuses visible to non-followers")
+	}
+
+	for _, f := range []*ActUser{bob, carol} {
+		if err := FollowUser(f, alice.UniqueName); err != nil {
+			t.Fatal(err)
+		}
+		if Followed(f.ID, alice.ID) || !FollowRequested(f.ID, alice.ID) {
+			t.Fatal("follow of a private account must be a request")
+		}
+	}
+	if requests, _ := ListFollowRequests(alice, &tools.PaginationOptions{Size: 10}); len(requests) != 2 {
+		t.Fatalf("unexpected follow requests %v", requests)
+	}
+
+	if err := ApproveFollowRequest(alice, bob.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := RejectFollowRequest(alice, carol.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if !Followed(bob.ID, alice.ID) || !CanView(bob, alice.ID) || FollowRequested(bob.ID, alice.ID) {
+		t.Fatal("approved follower can't view")
+	}
+	if Followed(carol.ID, alice.ID) || CanView(carol, alice.ID) || FollowRequested(carol.ID, alice.ID) {
+		t.Fatal("rejected follower can view")
+	}
+	if err := ApproveFollowRequest(alice, carol.UniqueName); !errors.Is(err, ErrNoFollowRequest) {
+		t.Fatalf("approve without request: %v", err)
+	}
+}
+
+func TestStatusVisibility(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		visibility string
+		listed     bool
+		visible    map[*ActUser]bool
+	}{
+		{VisibilityPublic, true, map[*ActUser]bool{nil: true, bob: true, carol: true}},
+		{VisibilityUnlisted, false, map[*ActUser]bool{nil: true, bob: true, carol: true}},
+		{VisibilityFollowers, false, map[*ActUser]bool{nil: false, bob: true, carol: false}},
+		{VisibilityMentioned, false, map[*ActUser]bool{nil: false, bob: false, carol: true}},
+	}
+	for _, c := range cases {
+		s := newTestStatus(t, &StatusOptions{User: alice, Content: text("@" + carol.UniqueName),
+			At: []string{carol.UniqueName}, Visibility: c.visibility})
+		if s.Listed() != c.listed {
+			t.Errorf("%s: listed %v", c.visibility, s.Listed())
+		}
+		if !s.VisibleTo(alice) {
+			t.Errorf("%s: invisible to the author", c.visibility)
+		}
+		for viewer, visible := range c.visible {
+			if s.VisibleTo(viewer) != visible {
+				t.Errorf("%s: visible to %v: %v", c.visibility, viewer, !visible)
+			}
+		}
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	var ids []string
+	for i := 0; i < 12; i++ {
+		content := "quokkacommon"
+		if i%4 == 0 {
+			content = "quokkacommon quokkarare"
+		}
+		ids = append(ids, newTestStatus(t, &StatusOptions{User: alice, Content: text(content)}).ID)
+	}
+
+	var got []string
+	opts := &tools.PaginationOptions{Size: 5}
+	for {
+		ss, more := ListStatusByKeyword(nil, "quokkacommon", opts)
+		for _, s := range ss {
+			got = append(got, s.ID)
+		}
+		opts.After += int64(len(ss))
+		if !more {
+			break
+		}
+	}
+	if len(got) != len(ids) || len(tools.Unique(got)) != len(ids) {
+		t.Fatalf("paged %d distinct of %d results, want %d", len(tools.Unique(got)), len(got), len(ids))
+	}
+
+	// the common term is looked up in statuses with the rare term
+	ss, _ := ListStatusByKeyword(nil, "quokkacommon quokkarare", &tools.PaginationOptions{Size: 10})
+	if len(ss) != 3 {
+		t.Fatalf("got %d results, want 3", len(ss))
+	}
+
+	// deleting a returned result doesn't restart the next page
+	first, _ := ListStatusByKeyword(nil, "quokkacommon", &tools.PaginationOptions{Size: 2})
+	if err := first[0].Delete(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := ListStatusByKeyword(nil, "quokkacommon", &tools.PaginationOptions{Size: 2, After: 1})
+	if next[0].ID == first[0].ID || next[0].ID == first[1].ID {
+		t.Fatal("next page repeats the previous page")
+	}
+
+	asc, _ := ListStatusByKeyword(nil, "quokkacommon", &tools.PaginationOptions{Size: 20, Ascend: true})
+	desc, _ := ListStatusByKeyword(nil, "quokkacommon", &tools.PaginationOptions{Size: 20})
+	if len(asc) != len(desc) || asc[0].ID != desc[len(desc)-1].ID {
+		t.Fatal("ascending order is not the reverse ranking")
+	}
+}
+
+func TestTimelinePagination(t *testing.T) {
+	reader, fanOut, fanIn := newTestUser(t, "reader"), newTestUser(t, "fanout"), newTestUser(t, "fanin")
+	for _, u := range []*ActUser{fanOut, fanIn} {
+		if err := FollowUser(reader, u.UniqueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Put(fmt.Sprintf(tTimelineFanIn, fanIn.ID), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		for _, u := range []*ActUser{fanOut, fanIn, reader} {
+			want = append(want, newTestStatus(t, &StatusOptions{User: u, Content: text("tl")}).ID)
+		}
+	}
+	// fan out after all statuses are created, so the inbox is written
+	// later than the statuses of the fan-in source
+	for _, id := range want {
+		if err := fanOutStatus(GetStatus(id), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ascend := range []bool{false, true} {
+		var got []*Status
+		opts := &tools.PaginationOptions{Size: 4, Ascend: ascend}
+		for {
+			ss, more := Timeline(reader, opts)
+			got = append(got, ss...)
+			if !more {
+				break
+			}
+			opts.After = ss[len(ss)-1].CreateRev
+		}
+		if len(got) != len(want) {
+			t.Fatalf("ascend %v: got %d statuses, want %d", ascend, len(got), len(want))
+		}
+		for i, s := range got {
+			w := want[len(want)-1-i]
+			if ascend {
+				w = want[i]
+			}
+			if s.ID != w {
+				t.Fatalf("ascend %v: status %d is %s, want %s", ascend, i, s.ID, w)
+			}
+		}
+	}
+}
+
+func TestFollowsResolveUsers(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	b := UserByID(bob.ID)
+	if err := b.Modify(ModifiableUser{UniqueName: b.UniqueName, Name: "Bob Renamed", Picture: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	followers, _ := UserByID(alice.ID).ListFollowers(&tools.PaginationOptions{Size: 10})
+	followings, _ := UserByID(bob.ID).ListFollowings(&tools.PaginationOptions{Size: 10})
+	if len(followers) != 1 || followers[0].User.Name != "Bob Renamed" || followers[0].User.Picture != "new" {
+		t.Fatalf("stale follower %+v", followers[0].User)
+	}
+	if len(followings) != 1 || followings[0].User.ID != alice.ID {
+		t.Fatalf("unexpected followings %v", followings)
+	}
+}
+
+func TestMentionBlocker(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	if err := BlockUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStatus(&StatusOptions{User: alice, Content: text("hi"),
+		At: []string{bob.UniqueName, carol.UniqueName}})
+	if err != nil {
+		t.Fatalf("mentioning a blocker must not fail the status: %v", err)
+	}
+	if len(s.Mentions) != 1 || s.Mentions[0] != carol.ID {
+		t.Fatalf("unexpected mentions %v", s.Mentions)
+	}
+	if types := messageTypes(bob); len(types) != 0 {
+		t.Fatalf("blocker notified %v", types)
+	}
+	if types := messageTypes(carol); len(types) != 1 || types[0] != MsgTypeAt {
+		t.Fatalf("unexpected messages of carol %v", types)
+	}
+}
+
+// racingBackend runs {race} once before the next txn is committed
+type racingBackend struct {
+	store.Backend
+	race func()
+}
+
+func (b *racingBackend) Txn(ctx context.Context) store.Txn {
+	if race := b.race; race != nil {
+		b.race = nil
+		race()
+	}
+	return b.Backend.Txn(ctx)
+}
+
+func TestMentionBlockerRace(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	dave := newTestUser(t, "dave")
+	orig := backend
+	defer func() { backend = orig }()
+
+	// bob blocks alice after the mentions are read
+	backend = &racingBackend{Backend: orig, race: func() {
+		if err := BlockUser(bob, alice.UniqueName); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	s, err := NewStatus(&StatusOptions{User: alice, Content: text("hi"),
+		At: []string{bob.UniqueName, carol.UniqueName}})
+	if err != nil {
+		t.Fatalf("mentioning a blocker must not fail the status: %v", err)
+	}
+	if len(s.Mentions) != 1 || s.Mentions[0] != carol.ID {
+		t.Fatalf("unexpected mentions %v", s.Mentions)
+	}
+	if types := messageTypes(bob); len(types) != 0 {
+		t.Fatalf("blocker notified %v", types)
+	}
+
+	// dave blocks alice while she is editing
+	backend = &racingBackend{Backend: orig, race: func() {
+		if err := BlockUser(dave, alice.UniqueName); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if err := s.Edit(&StatusOptions{User: alice, Content: text("hi again"),
+		At: []string{carol.UniqueName, dave.UniqueName}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Mentions) != 1 || s.Mentions[0] != carol.ID {
+		t.Fatalf("unexpected mentions %v", s.Mentions)
+	}
+	if types := messageTypes(dave); len(types) != 0 {
+		t.Fatalf("blocker notified %v", types)
+	}
+}
+
+func TestResolveReportDeleteStatus(t *testing.T) {
+	alice, bob, admin := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "admin")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: text("spam")})
+	newTestStatus(t, &StatusOptions{User: bob, Content: text("reply"), RefStatus: s.ID})
+
+	r, err := NewReport(&ReportOptions{Reporter: bob, TargetType: ReportTargetStatus,
+		TargetID: s.ID, Category: "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GetReport(r.ID).Resolve(admin, ReportActionDeleteStatus, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	got := GetStatus(s.ID)
+	if got == nil || !got.Removed || len(got.Content) != 0 || got.User.ID != alice.ID {
+		t.Fatalf("status should be tombstoned, got %+v", got)
+	}
+	if err := got.Edit(&StatusOptions{User: alice, Content: text("back")}); err != ErrStatusNotFound {
+		t.Fatalf("editing a removed status should fail, got %v", err)
+	}
+	if err := GetReport(r.ID).Resolve(admin, ReportActionDeleteStatus, "", nil); err != ErrReportResolved {
+		t.Fatalf("resolving twice should fail, got %v", err)
+	}
+	// a stale report can't take the action again
+	if err := r.Resolve(admin, ReportActionNone, "", nil); err != ErrTryAgainLater {
+		t.Fatalf("resolving a stale report should fail, got %v", err)
+	}
+}
+
+func TestAuditCommittedWithAction(t *testing.T) {
+	admin, bob := newTestUser(t, "admin"), newTestUser(t, "bob")
+	u := UserByID(bob.ID)
+	audited := func() int {
+		entries, _ := ListAudit(&tools.PaginationOptions{Size: 1000})
+		n := 0
+		for _, e := range entries {
+			if e.TargetID == bob.ID {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := u.SetVerified(1, &AuditOptions{Admin: admin, Action: "userVerified",
+		TargetType: "user", TargetID: bob.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if n := audited(); n != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", n)
+	}
+	// u is stale now, neither the action nor the entry is committed
+	if err := u.SetVerified(2, &AuditOptions{Admin: admin, Action: "userVerified",
+		TargetType: "user", TargetID: bob.ID}); err != ErrTryAgainLater {
+		t.Fatalf("stale action should fail, got %v", err)
+	}
+	if n := audited(); n != 1 {
+		t.Fatalf("failed action should not be audited, got %d entries", n)
+	}
+}
+
+func TestSessionRenewDue(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		s       *Session
+		elapsed time.Duration
+		due     bool
+	}{
+		{"fresh session", &Session{lease: 1}, 10 * time.Minute, false},
+		{"half of the idle lease left", &Session{lease: 1}, 31 * time.Minute, true},
+		{"token", &Session{lease: 1, Kind: SessionKindToken, ExpireTime: now.Add(24 * time.Hour)}, 31 * time.Minute, false},
+		{"token persisted hourly", &Session{Kind: SessionKindToken}, 61 * time.Minute, true},
+	}
+	for _, c := range cases {
+		c.s.renewTime = now.Add(-c.elapsed)
+		if due := c.s.renewDue(now); due != c.due {
+			t.Errorf("%s: expected renew due %t, got %t", c.name, c.due, due)
+		}
+	}
+}
+
+func TestUserByIdentityEmailFallback(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	email := UserByID(alice.ID).Email
+	opts := &UserOptions{Name: "alice", Email: email}
+
+	// a legacy user without identities is matched by email and linked
+	u, err := userByIdentity(&Identity{Provider: "github", Subject: "1", Email: email}, opts)
+	if err != nil || u.ID != alice.ID {
+		t.Fatalf("legacy user should be matched by email, got %v %v", u, err)
+	}
+	// once linked, other providers can't take over the user by email
+	if _, err := userByIdentity(&Identity{Provider: "google", Subject: "2", Email: email}, opts); err != ErrIdentityNotLinked {
+		t.Fatalf("expected ErrIdentityNotLinked, got %v", err)
+	}
+	if localUser(email) != nil {
+		t.Fatal("local login should not fall back to email of a linked user")
+	}
+
+	// linked explicitly from a session
+	if err := LinkIdentity(alice.ID, &Identity{Provider: "google", Subject: "2", Email: email}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := userByIdentity(&Identity{Provider: "google", Subject: "2", Email: email}, opts); err != nil || u.ID != alice.ID {
+		t.Fatalf("linked identity should resolve the user, got %v %v", u, err)
+	}
+	// setting a password links the local identity
+	if err := SetPassword(alice.ID, "", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if u := localUser(email); u == nil || u.ID != alice.ID {
+		t.Fatalf("local identity should resolve the user, got %v", u)
+	}
+}
+
+func TestAuthTokenKind(t *testing.T) {
+	token, err := newAuthToken(&authToken{Kind: authTokenKindMagic, Email: "alice@lln.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeAuthToken(token, authTokenKindReset); err != ErrInvalidToken {
+		t.Fatalf("token of another kind should be rejected, got %v", err)
+	}
+	// the rejected link did not consume the token
+	if tk, err := consumeAuthToken(token, authTokenKindMagic); err != nil || tk.Email != "alice@lln.test" {
+		t.Fatalf("expected the magic token, got %v %v", tk, err)
+	}
+	if _, err := consumeAuthToken(token, authTokenKindMagic); err != ErrInvalidToken {
+		t.Fatalf("token should be used once, got %v", err)
+	}
+}
+
+func TestDeleteMessagesFrom(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	s := newTestStatus(t, &StatusOptions{User: bob, Content: text("hello")})
+	if err := LikeStatus(alice, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := LikeStatus(carol, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if types := messageTypes(bob); len(types) != 2 {
+		t.Fatalf("expected 2 messages of bob, got %v", types)
+	}
+
+	if err := deleteMessagesFrom(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := ListMessages(bob, &tools.PaginationOptions{Size: 10})
+	if len(msgs) != 1 || msgs[0].From.ID != carol.ID {
+		t.Fatalf("only the message from carol should be left, got %v", msgs)
+	}
+	if n := countKeys(stateKey(fmt.Sprintf(tMessageFrom, alice.ID, ""))); n != 0 {
+		t.Fatalf("sender index of alice should be deleted, %d left", n)
+	}
+
+	// deleted by the recipient, the sender index goes with the message
+	if err := DeleteMessages(bob, []string{msgs[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(stateKey(fmt.Sprintf(tMessageFrom, carol.ID, ""))); n != 0 {
+		t.Fatalf("sender index of carol should be deleted, %d left", n)
+	}
+}
+
+func TestSessionFresh(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	now := time.Now()
+	cases := []struct {
+		name  string
+		s     *Session
+		fresh bool
+	}{
+		{"just logged in", &Session{ID: alice.ID, CreateTime: now}, true},
+		{"logged in long ago", &Session{ID: alice.ID, CreateTime: now.Add(-time.Hour)}, false},
+		{"token", &Session{ID: alice.ID, CreateTime: now, Kind: SessionKindToken}, false},
+		{"pre-session", &Session{ID: alice.ID, CreateTime: now, MFAPending: true}, false},
+	}
+	for _, c := range cases {
+		if fresh := c.s.Fresh(now); fresh != c.fresh {
+			t.Errorf("%s: expected fresh %t, got %t", c.name, c.fresh, fresh)
+		}
+	}
+}
+
+func TestPrivateAccountSwitch(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	private, public := true, false
+	if err := UserByID(alice.ID).Modify(ModifiableUser{Private: &private}); err != nil {
+		t.Fatal(err)
+	}
+	// private is unchanged when it's not set
+	if err := UserByID(alice.ID).Modify(ModifiableUser{Bio: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if !Private(alice.ID) || !UserByID(alice.ID).Private {
+		t.Fatal("account should stay private")
+	}
+
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if !FollowRequested(bob.ID, alice.ID) {
+		t.Fatal("follow of a private account must be a request")
+	}
+	if err := UserByID(alice.ID).Modify(ModifiableUser{Private: &public}); err != nil {
+		t.Fatal(err)
+	}
+	if Private(alice.ID) || FollowRequested(bob.ID, alice.ID) || !Followed(bob.ID, alice.ID) {
+		t.Fatal("pending requests should be approved when the account is public")
+	}
+}
+
+func TestClosePollResume(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: []*StatusFragment{{Type: "poll",
+		Poll: &Poll{Options: []string{"a", "b"}, CloseTime: time.Now().Add(time.Hour)}}}})
+	for _, u := range []*ActUser{bob, carol} {
+		if err := VotePoll(u, s.ID, []int{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VotePoll(bob, s.ID, []int{1}); err != ErrVoted {
+		t.Fatalf("expected ErrVoted, got %v", err)
+	}
+
+	// an earlier run notified the first voter and failed
+	first, second := bob, carol
+	if carol.ID < bob.ID {
+		first, second = carol, bob
+	}
+	closeKey := stateKey(fmt.Sprintf(tPollClose, s.ID))
+	if err := backend.Put(context.Background(), stateKey(fmt.Sprintf(tPollClosing, s.ID)),
+		stateKey(fmt.Sprintf(tVote, s.ID, first.ID))); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := backend.Get(context.Background(), closeKey)
+	if err != nil || resp.Count != 1 {
+		t.Fatalf("poll close key not found: %v", err)
+	}
+	if err := closePoll(s.ID, resp.Kvs[0]); err != nil {
+		t.Fatal(err)
+	}
+	closed := func(u *ActUser) (n int) {
+		for _, typ := range messageTypes(u) {
+			if typ == MsgTypePollClosed {
+				n++
+			}
+		}
+		return
+	}
+	if closed(first) != 0 || closed(second) != 1 || closed(alice) != 1 {
+		t.Fatalf("unexpected notifications %d %d %d", closed(first), closed(second), closed(alice))
+	}
+	if countKeys(closeKey) != 0 || countKeys(stateKey(fmt.Sprintf(tPollClosing, s.ID))) != 0 {
+		t.Fatal("close keys should be removed")
+	}
+	// voters are notified, no more votes
+	if err := VotePoll(newTestUser(t, "dave"), s.ID, []int{1}); err != ErrPollClosed {
+		t.Fatalf("expected ErrPollClosed, got %v", err)
+	}
+}
+
+func TestPublishDraftClaim(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	d, err := SaveDraft(alice, "", &StatusOptions{User: alice, Content: text("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, modRev := getDraft(alice.ID, d.ID)
+	if _, err := SaveDraft(alice, d.ID, &StatusOptions{User: alice, Content: text("hello again")}); err != nil {
+		t.Fatal(err)
+	}
+	// claimed by someone else at the stale revision
+	if _, err := publishDraft(alice, d, modRev); err != ErrTryAgainLater {
+		t.Fatalf("expected ErrTryAgainLater, got %v", err)
+	}
+	if GetDraft(alice.ID, d.ID) == nil {
+		t.Fatal("draft should be kept")
+	}
+
+	closed, err := SaveDraft(alice, "", &StatusOptions{User: alice, Content: []*StatusFragment{{Type: "poll",
+		Poll: &Poll{Options: []string{"a", "b"}, CloseTime: time.Now().Add(-time.Minute)}}},
+		PublishTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublishDraft(alice, closed.ID); err != ErrPollClosed {
+		t.Fatalf("expected ErrPollClosed, got %v", err)
+	}
+	restored := GetDraft(alice.ID, closed.ID)
+	if restored == nil || restored.Error != ErrPollClosed.Error() || restored.PublishTime != nil {
+		t.Fatalf("draft should be restored unscheduled with the error: %+v", restored)
+	}
+	if countKeys(scheduledKey(alice.ID, closed.ID)) != 0 {
+		t.Fatal("draft should be unscheduled")
+	}
+}
+
+func TestDeleteRepostedStatus(t *testing.T) {
+	alice, bob, carol := newTestUser(t, "alice"), newTestUser(t, "bob"), newTestUser(t, "carol")
+	s := newTestStatus(t, &StatusOptions{User: alice, Content: text("hello")})
+	if err := RepostStatus(bob, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tStatusRepost, s.ID, bob.ID)))
+	if err != nil || resp.Count != 1 {
+		t.Fatalf("repost not found: %v", err)
+	}
+	repostID := string(resp.Kvs[0].Value)
+	if err := s.Delete(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if GetStatus(repostID) != nil || countKeys(stateKey(fmt.Sprintf("/%s/status/%s", bob.ID, repostID))) != 0 {
+		t.Fatal("repost should be deleted with the original")
+	}
+
+	// the original is deleted right before the repost is committed
+	s = newTestStatus(t, &StatusOptions{User: alice, Content: text("hello again")})
+	orig := backend
+	defer func() { backend = orig }()
+	backend = &racingBackend{Backend: orig, race: func() {
+		if err := s.Delete(alice.ID); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if err := RepostStatus(carol, s.ID); err != ErrStatusNotFound {
+		t.Fatalf("expected ErrStatusNotFound, got %v", err)
+	}
+	if Reposted(s.ID, carol.ID) || countKeys(stateKey(fmt.Sprintf("/%s/status/", carol.ID))) != 0 {
+		t.Fatal("repost of a deleted status should not be committed")
+	}
+}
+
+func TestDeleteAccountDisablesUser(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	u := UserByID(alice.ID)
+	if _, err := DeleteAccount(u); err != nil {
+		t.Fatal(err)
+	}
+	// the worker may be running, the user is refused in any phase
+	if _, err := newLoginSession(u, &SessionClient{}, false); err != ErrAccountDeleting {
+		t.Fatalf("expected ErrAccountDeleting, got %v", err)
+	}
+	if _, err := NewStatus(&StatusOptions{User: alice, Content: text("still here")}); err == nil {
+		t.Fatal("user being deleted must not post")
+	}
+	if err := u.Enable(nil); err != ErrAccountDeleting {
+		t.Fatalf("expected ErrAccountDeleting, got %v", err)
+	}
+}
+
+func TestSearchUsersRank(t *testing.T) {
+	alpha, beta, gamma := newTestUser(t, "zedalpha"), newTestUser(t, "zedbeta"), newTestUser(t, "zedgamma")
+	for _, f := range []*ActUser{alpha, gamma} {
+		if err := FollowUser(f, beta.UniqueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	limit := maxUserCandidates
+	defer func() { maxUserCandidates = limit }()
+	// the most followed is found though it's not the first in key order
+	maxUserCandidates = 1
+	if users := SearchUsers("zed", 1); len(users) != 1 || users[0].ID != beta.ID {
+		t.Fatalf("unexpected users %v", users)
+	}
+	if err := UserByID(gamma.ID).SetVerified(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if users := SearchUsers("zed", 1); len(users) != 1 || users[0].ID != gamma.ID {
+		t.Fatalf("verified user should rank first: %v", users)
+	}
+
+	maxUserCandidates = limit
+	if err := UserByID(beta.ID).Disable(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range SearchUsers("zed", 10) {
+		if u.ID == beta.ID {
+			t.Fatal("disabled user found")
+		}
+	}
+}
+
+func TestFollowSwitchedPrivate(t *testing.T) {
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	orig := backend
+	defer func() { backend = orig }()
+	// alice goes private after bob read her profile
+	backend = &racingBackend{Backend: orig, race: func() {
+		private := true
+		if err := UserByID(alice.ID).Modify(ModifiableUser{Private: &private}); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if err := FollowUser(bob, alice.UniqueName); err != nil {
+		t.Fatal(err)
+	}
+	if Followed(bob.ID, alice.ID) || !FollowRequested(bob.ID, alice.ID) {
+		t.Fatal("follow of an account switched to private must be a request")
+	}
+}
@@ -5,22 +5,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type StatusOptions struct {
-	Content   []*StatusFragment
-	RefStatus string
-	User      *ActUser
-	Labels    []string
-	At        []string
+	Content    []*StatusFragment
+	RefStatus  string
+	User       *ActUser
+	Labels     []string
+	At         []string
+	Visibility string
+	// QuoteStatus the status embedded in the new status
+	QuoteStatus string
+	// PublishTime the status is scheduled to publish at, see ScheduleStatus
+	PublishTime time.Time
 }
 
 type Status struct {
@@ -35,11 +41,21 @@ type Status struct {
 	Views      int64             `json:"views"`
 	Bookmarks  int64             `json:"bookmarks"`
 	Disabled   bool              `json:"disabled"`
+	Visibility string            `json:"visibility,omitempty"`
+	Mentions   []string          `json:"mentions,omitempty"`
+	Labels     []string          `json:"labels,omitempty"`
+	EditTime   *time.Time        `json:"editTime,omitempty"`
+	RepostOf   string            `json:"repostOf,omitempty"`
+	Quote      string            `json:"quote,omitempty"`
+	Reposts    int64             `json:"reposts"`
+	Quotes     int64             `json:"quotes"`
+	Removed    bool              `json:"removed,omitempty"`
 }
 
 type StatusFragment struct {
 	Value string `json:"value"`
 	Type  string `json:"type"`
+	Poll  *Poll  `json:"poll,omitempty"`
 }
 
 func (s *Status) Overview() string {
@@ -64,26 +80,47 @@ func (s *Status) Delete(uid string) error {
 	if s.User.ID != uid {
 		return ErrStatusNotFound
 	}
-	statusProbeKey := stateKey(fmt.Sprintf("/probe/status/%s", s.ID))
-	resp, err := etcdClient.KV.Get(context.Background(), statusProbeKey)
+	cmps, ops, err := deleteStatusOps(s)
+	if err != nil {
+		return err
+	}
+	txnResp, err := backend.Txn(context.Background()).If(cmps...).
+		Then(ops...).Commit()
 	if err != nil {
 		return err
 	}
-	cmps := []clientv3.Cmp{}
+
+	if !txnResp.Succeeded {
+		// disable delete when comments count greater than 0
+		return ErrStatusQuotes
+	}
+	return nil
+}
+
+// deleteStatusOps build the txn deleting the status, ErrStatusQuotes when
+// the status has comments
+func deleteStatusOps(s *Status) ([]store.Cmp, []store.Op, error) {
+	uid := s.User.ID
+	statusProbeKey := stateKey(fmt.Sprintf("/probe/status/%s", s.ID))
+	resp, err := backend.Get(context.Background(), statusProbeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmps := []store.Cmp{}
 	if resp.Count > 0 {
 		// disable delete when comments count greater than 0
 		if string(resp.Kvs[0].Value) != s.ID {
 			statusCommentsKey := stateKey(fmt.Sprintf("/comments/status/%s", s.ID))
-			r, err := etcdClient.Get(context.Background(), statusCommentsKey,
-				clientv3.WithCountOnly(), clientv3.WithPrefix())
+			r, err := backend.Get(context.Background(), statusCommentsKey,
+				store.WithCountOnly(), store.WithPrefix())
 			if err != nil || r.Count != 0 {
 				logrus.Error("", err)
-				return errors.New("there are quotes")
+				return nil, nil, ErrStatusQuotes
 			}
 		}
 		// there are no new comments when executing txn
-		cmps = append(cmps, clientv3.Compare(
-			clientv3.ModRevision(statusProbeKey), "=", resp.Kvs[0].ModRevision))
+		cmps = append(cmps, store.Compare(
+			store.ModRevision(statusProbeKey), "=", resp.Kvs[0].ModRevision))
 	}
 
 	statusCommentsKey := stateKey(fmt.Sprintf("/comments/status/%s/%s", s.RefStatus, s.ID))
@@ -94,22 +131,101 @@ func (s *Status) Delete(uid string) error {
 
 	b, _ := json.Marshal(s)
 
-	txnResp, err := etcdClient.Txn(context.Background()).If(cmps...).
-		Then(clientv3.OpDelete(statusKey),
-			clientv3.OpDelete(userStatusKey),
-			clientv3.OpDelete(statusProbeKey),
-			clientv3.OpDelete(statusCommentsKey),
-			clientv3.OpDelete(statusViewsKey),
-			clientv3.OpPut(statusRecycleKey, string(b))).Commit()
+	ops := []store.Op{store.OpDelete(statusKey),
+		store.OpDelete(userStatusKey),
+		store.OpDelete(statusProbeKey),
+		store.OpDelete(statusCommentsKey),
+		store.OpDelete(statusViewsKey),
+		store.OpDelete(stateKey(fmt.Sprintf(tStatusRevision, s.ID, "")), store.WithPrefix()),
+		store.OpDelete(stateKey(fmt.Sprintf(tStatusRepost, s.ID, "")), store.WithPrefix()),
+		store.OpDelete(stateKey(fmt.Sprintf(tStatusQuote, s.ID, "")), store.WithPrefix()),
+		store.OpDelete(stateKey(fmt.Sprintf(tVote, s.ID, "")), store.WithPrefix()),
+		store.OpDelete(stateKey(fmt.Sprintf(tPollClose, s.ID))),
+		store.OpDelete(stateKey(fmt.Sprintf(tPollClosing, s.ID))),
+		store.OpPut(statusRecycleKey, string(b))}
+	ops = append(ops, unindexStatusOps(s.ID)...)
+	// reposts are statuses without content, they go with the original
+	reposts, err := backend.Get(context.Background(),
+		stateKey(fmt.Sprintf(tStatusRepost, s.ID, "")), store.WithPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, kv := range reposts.Kvs {
+		r := GetStatus(string(kv.Value))
+		if r == nil {
+			continue
+		}
+		repostCmps, repostOps, err := deleteStatusOps(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmps = append(cmps, repostCmps...)
+		ops = append(ops, repostOps...)
+	}
+	if len(s.RepostOf) > 0 {
+		ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tStatusRepost, s.RepostOf, uid))))
+	}
+	if len(s.Quote) > 0 {
+		ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tStatusQuote, s.Quote, s.ID))))
+	}
+	return cmps, ops, nil
+}
+
+// RemoveStatus delete the status on behalf of moderators, it's stripped
+// instead if it has comments
+func RemoveStatus(s *Status, audit *AuditOptions) error {
+	cmps, ops, err := removeStatusOps(s)
 	if err != nil {
 		return err
 	}
+	return commitAudited(audit, cmps, ops...)
+}
 
-	if !txnResp.Succeeded {
-		// disable delete when comments count greater than 0
-		return ErrStatusQuotes
+// removeStatusOps build the txn removing the status on behalf of moderators,
+// statuses with comments are tombstoned instead of deleted
+func removeStatusOps(s *Status) ([]store.Cmp, []store.Op, error) {
+	cmps, ops, err := deleteStatusOps(s)
+	if errors.Is(err, ErrStatusQuotes) {
+		return tombstoneStatusOps(s.ID, nil)
 	}
-	return nil
+	return cmps, ops, err
+}
+
+// tombstoneStatusOps build the txn stripping a status that can't be deleted
+// because it has comments, the status is kept so that the thread stays intact.
+// the author is replaced by {user} unless it's nil
+func tombstoneStatusOps(statusID string, user *ActUser) ([]store.Cmp, []store.Op, error) {
+	statusKey := stateKey(fmt.Sprintf("/status/%s", statusID))
+	resp, err := backend.Get(context.Background(), statusKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil, ErrStatusNotFound
+	}
+	s := &Status{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, s); err != nil {
+		return nil, nil, err
+	}
+	s.Content = nil
+	s.Mentions = nil
+	s.Labels = nil
+	s.Removed = true
+	if user != nil {
+		s.User = user
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmps := []store.Cmp{store.Compare(store.ModRevision(statusKey), "=", resp.Kvs[0].ModRevision)}
+	ops := append(unindexStatusOps(statusID),
+		store.OpPut(statusKey, string(b)),
+		store.OpDelete(stateKey(fmt.Sprintf("/recommended/status/%s", statusID))),
+		store.OpDelete(stateKey(fmt.Sprintf(tStatusRevision, statusID, "")), store.WithPrefix()),
+		store.OpDelete(stateKey(fmt.Sprintf(tPollClose, statusID))),
+		store.OpDelete(stateKey(fmt.Sprintf(tPollClosing, statusID))))
+	return cmps, ops, nil
 }
 
 func NewStatus(opts *StatusOptions) (*Status, error) {
@@ -119,10 +235,57 @@ func NewStatus(opts *StatusOptions) (*Status, error) {
 		RefStatus:  opts.RefStatus,
 		User:       opts.User,
 		CreateTime: time.Now(),
+		Visibility: opts.Visibility,
+		Labels:     tools.Unique(opts.Labels),
 	}
+	if s.Visibility == VisibilityPublic {
+		s.Visibility = ""
+	}
+	var quoted *Status
+	if len(opts.QuoteStatus) > 0 {
+		quoted = GetStatus(opts.QuoteStatus)
+		if quoted != nil && len(quoted.RepostOf) > 0 {
+			quoted = GetStatus(quoted.RepostOf)
+		}
+		if quoted == nil || !quoted.VisibleTo(opts.User) {
+			return nil, ErrStatusNotFound
+		}
+		s.Quote = quoted.ID
+	}
+	// users blocking the author meanwhile are dropped from the mentions
+	mentioned := mentionable(opts.User.ID, opts.At)
+	for {
+		s.Mentions = nil
+		for _, u := range mentioned {
+			s.Mentions = append(s.Mentions, u.ID)
+		}
+		cmps, ops, blocks, err := newStatusOps(s, opts, quoted, mentioned)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := backend.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return s, nil
+		}
+		n := len(mentioned)
+		mentioned = slices.DeleteFunc(mentioned, func(u *User) bool { return Blocked(u.ID, opts.User.ID) })
+		if len(mentioned) == n {
+			return nil, blockedOr(ErrTryAgainLater, blocks...)
+		}
+	}
+}
+
+// newStatusOps build the txn posting the status, the txn fails if any of
+// {mentioned} blocked the author. blocks are the block keys of other users
+// that fail the txn
+func newStatusOps(s *Status, opts *StatusOptions, quoted *Status, mentioned []*User) (
+	cmps []store.Cmp, ops []store.Op, blocks []string, err error) {
 	b, err := json.Marshal(s)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	statusKey := stateKey(fmt.Sprintf("/status/%s", s.ID))
@@ -130,23 +293,28 @@ func NewStatus(opts *StatusOptions) (*Status, error) {
 	statusCommentsKey := stateKey(fmt.Sprintf("/comments/status/%s/%s", s.RefStatus, s.ID))
 	statusProbeKey := stateKey(fmt.Sprintf("/probe/status/%s", s.ID))
 	userDisabledKey := stateKey(fmt.Sprintf("/disabled/user/%s", opts.User.ID))
-	ops := []clientv3.Op{
-		clientv3.OpPut(statusKey, string(b)),
-		clientv3.OpPut(userStatusKey, statusKey),
-		clientv3.OpPut(statusProbeKey, s.ID),
+	ops = []store.Op{
+		store.OpPut(statusKey, string(b)),
+		store.OpPut(userStatusKey, statusKey),
+		store.OpPut(statusProbeKey, s.ID),
 	}
 
-	cmps := []clientv3.Cmp{
-		clientv3.Compare(clientv3.Version(userDisabledKey), "=", 0),
+	cmps = []store.Cmp{
+		store.Compare(store.Version(userDisabledKey), "=", 0),
 	}
 
 	if len(s.RefStatus) > 0 {
 		refProbeKey := stateKey(fmt.Sprintf("/probe/status/%s", s.RefStatus))
-		cmps = append(cmps, clientv3.Compare(clientv3.Version(refProbeKey), "!=", 0))
-		ops = append(ops, clientv3.OpPut(statusCommentsKey, statusKey))
-		ops = append(ops, clientv3.OpPut(refProbeKey, s.ID))
+		cmps = append(cmps, store.Compare(store.Version(refProbeKey), "!=", 0))
+		ops = append(ops, store.OpPut(statusCommentsKey, statusKey))
+		ops = append(ops, store.OpPut(refProbeKey, s.ID))
 		s := GetStatus(s.RefStatus)
 		if s != nil {
+			if len(s.RepostOf) > 0 || !s.VisibleTo(opts.User) {
+				return nil, nil, nil, ErrStatusNotFound
+			}
+			cmps = append(cmps, notBlocked(s.User.ID, opts.User.ID))
+			blocks = append(blocks, blockKey(s.User.ID, opts.User.ID))
 			ops = append(ops, newMessageOps(MsgOptions{
 				from:     opts.User,
 				toUID:    s.User.ID,
@@ -157,56 +325,79 @@ func NewStatus(opts *StatusOptions) (*Status, error) {
 		}
 	}
 
-	if len(opts.At) > 0 {
-		for _, at := range tools.Unique(opts.At) {
-			u := UserByUniqueName(at)
-			if u != nil {
-				ops = append(ops, newMessageOps(MsgOptions{
-					from:     opts.User,
-					toUID:    u.ID,
-					msgType:  MsgTypeAt,
-					targetID: s.ID,
-					message:  s.Overview(),
-				})...)
-			}
-		}
+	if quoted != nil {
+		quotedProbeKey := stateKey(fmt.Sprintf("/probe/status/%s", quoted.ID))
+		cmps = append(cmps, store.Compare(store.Version(quotedProbeKey), "!=", 0),
+			notBlocked(quoted.User.ID, opts.User.ID))
+		blocks = append(blocks, blockKey(quoted.User.ID, opts.User.ID))
+		ops = append(ops, store.OpPut(stateKey(fmt.Sprintf(tStatusQuote, quoted.ID, s.ID)), statusKey))
+		ops = append(ops, newMessageOps(MsgOptions{
+			from:     opts.User,
+			toUID:    quoted.User.ID,
+			msgType:  MsgTypeQuote,
+			targetID: s.ID,
+			message:  s.Overview(),
+		})...)
 	}
 
-	if len(opts.Labels) > 0 {
+	for _, u := range mentioned {
+		cmps = append(cmps, notBlocked(u.ID, opts.User.ID))
+		ops = append(ops, newMessageOps(MsgOptions{
+			from:     opts.User,
+			toUID:    u.ID,
+			msgType:  MsgTypeAt,
+			targetID: s.ID,
+			message:  s.Overview(),
+		})...)
+	}
+
+	// unlisted statuses are not put into labels and the search index
+	if s.Listed() && len(opts.Labels) > 0 {
 		for _, l := range tools.Unique(opts.Labels) {
 			key := stateKey(fmt.Sprintf("/labels/%s/status/%s", l, s.ID))
-			ops = append(ops, clientv3.OpPut(key, statusKey))
+			ops = append(ops, store.OpPut(key, statusKey))
 			key = stateKey(fmt.Sprintf("/label/%s", l))
-			ops = append(ops, clientv3.OpPut(key, l))
+			ops = append(ops, store.OpPut(key, l))
 		}
 	}
 
-	resp, err := etcdClient.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
-	if err != nil {
-		return nil, err
+	if s.Listed() {
+		ops = append(ops, indexStatusOps(s)...)
 	}
-	if !resp.Succeeded {
-		return nil, ErrTryAgainLater
+
+	if p := s.Poll(); p != nil {
+		ops = append(ops, store.OpPut(stateKey(fmt.Sprintf(tPollClose, s.ID)),
+			p.CloseTime.Format(time.RFC3339)))
 	}
-	return s, nil
+
+	return
 }
 
-func RecommendStatus(statusID string) error {
+func RecommendStatus(statusID string, audit *AuditOptions) error {
+	s := GetStatus(statusID)
+	if s == nil {
+		return ErrStatusNotFound
+	}
+	if !s.Listed() {
+		return ErrStatusNotListed
+	}
 	key := stateKey(fmt.Sprintf("/recommended/status/%s", statusID))
 	statusKey := stateKey(fmt.Sprintf("/status/%s", statusID))
-	_, err := etcdClient.KV.Put(context.Background(), key, statusKey)
-	return err
+	return commitAudited(audit, nil, store.OpPut(key, statusKey))
 }
 
-func NotRecommendStatus(statusID string) error {
+func NotRecommendStatus(statusID string, audit *AuditOptions) error {
 	key := stateKey(fmt.Sprintf("/recommended/status/%s", statusID))
-	_, err := etcdClient.KV.Delete(context.Background(), key)
-	return err
+	return commitAudited(audit, nil, store.OpDelete(key))
+}
+
+func Recommended(statusID string) bool {
+	return countKeys(stateKey(fmt.Sprintf("/recommended/status/%s", statusID))) > 0
 }
 
 func getStatusBin(statusID string) (s []byte, createRev int64) {
 	statusKey := stateKey(fmt.Sprintf("/status/%s", statusID))
-	resp, err := etcdClient.KV.Get(context.Background(), statusKey)
+	resp, err := backend.Get(context.Background(), statusKey)
 	if err != nil {
 		logrus.Debug(err)
 		return
@@ -230,30 +421,40 @@ func GetStatus(statusID string) *Status {
 	return s
 }
 
-func loadStatusByLinkerPagination(prefixKey string, options *tools.PaginationOptions) (ss []*Status, more bool) {
-	if options == nil {
-		options = &tools.PaginationOptions{}
-	}
-	opts := []clientv3.OpOption{
-		clientv3.WithPrefix(),
-		clientv3.WithLimit(options.Size),
+// paginationOptions translate pagination to create revision range options
+func paginationOptions(options *tools.PaginationOptions) []store.OpOption {
+	opts := []store.OpOption{
+		store.WithPrefix(),
+		store.WithLimit(options.Size),
 	}
 	if options.Ascend {
-		opts = append(opts, clientv3.WithMinCreateRev(options.After+1))
-		opts = append(opts, clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+		opts = append(opts, store.WithMinCreateRev(options.After+1))
+		opts = append(opts, store.WithSort(store.SortByCreateRevision, store.SortAscend))
 	} else {
 		if options.After > 0 {
-			opts = append(opts, clientv3.WithMaxCreateRev(options.After-1))
+			opts = append(opts, store.WithMaxCreateRev(options.After-1))
 		}
-		opts = append(opts, clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortDescend))
+		opts = append(opts, store.WithSort(store.SortByCreateRevision, store.SortDescend))
 	}
-	resp, err := etcdClient.KV.Get(context.Background(), prefixKey, opts...)
+	return opts
+}
+
+func loadByPagination(prefixKey string, options *tools.PaginationOptions) (kvs []*store.KeyValue, more bool) {
+	if options == nil {
+		options = &tools.PaginationOptions{}
+	}
+	resp, err := backend.Get(context.Background(), prefixKey, paginationOptions(options)...)
 	if err != nil {
-		logrus.Errorf("prefix %s pagination etcd error: %s", prefixKey, err)
+		logrus.Errorf("prefix %s pagination error: %s", prefixKey, err)
 		return
 	}
-	for _, kv := range resp.Kvs {
-		r, err := etcdClient.Get(context.Background(), string(kv.Value))
+	return resp.Kvs, resp.More
+}
+
+func loadStatusByLinkerPagination(prefixKey string, options *tools.PaginationOptions) (ss []*Status, more bool) {
+	kvs, more := loadByPagination(prefixKey, options)
+	for _, kv := range kvs {
+		r, err := backend.Get(context.Background(), string(kv.Value))
 		if err != nil {
 			logrus.Error(err)
 			continue
@@ -269,7 +470,7 @@ func loadStatusByLinkerPagination(prefixKey string, options *tools.PaginationOpt
 		}
 		ss = append(ss, s)
 	}
-	return ss, resp.More
+	return ss, more
 }
 
 func Recommendations(user *ActUser, opts *tools.PaginationOptions) (ss []*Status, more bool) {
@@ -277,8 +478,8 @@ func Recommendations(user *ActUser, opts *tools.PaginationOptions) (ss []*Status
 }
 
 func RecommendCount(user *ActUser, createRev int64) int {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey("/recommended/status/"),
-		clientv3.WithPrefix(), clientv3.WithLimit(128), clientv3.WithMinCreateRev(createRev+1))
+	resp, err := backend.Get(context.Background(), stateKey("/recommended/status/"),
+		store.WithPrefix(), store.WithLimit(128), store.WithMinCreateRev(createRev+1))
 	if err != nil {
 		logrus.Error("RecommendCount etcd error: ", err)
 		return 0
@@ -290,10 +491,6 @@ func ListStatusByLabel(value string, opts *tools.PaginationOptions) ([]*Status,
 	return loadStatusByLinkerPagination(stateKey(fmt.Sprintf("/labels/%s/status/", value)), opts)
 }
 
-func ListStatusByKeyword(value string, opts *tools.PaginationOptions) []*Status {
-	return nil
-}
-
 func unmarshalStatus(b []byte, cRev int64) (s *Status, err error) {
 	s = &Status{}
 	err = json.Unmarshal(b, s)
@@ -305,12 +502,15 @@ func unmarshalStatus(b []byte, cRev int64) (s *Status, err error) {
 	s.LikeCount = likeCount(s.ID)
 	s.Views = viewCount(s.ID)
 	s.Bookmarks = bookmarkCount(s.ID)
+	s.Reposts = repostCount(s.ID)
+	s.Quotes = quoteCount(s.ID)
+	tallyPoll(s)
 	s.Disabled = statusDisabled(s.ID)
 	return s, nil
 }
 
 func statusDisabled(statusID string) bool {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/probe/status/%s", statusID)))
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/probe/status/%s", statusID)))
 	if err != nil {
 		logrus.Error("statusDisabled etcd error:", err.Error())
 		return false
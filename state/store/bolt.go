@@ -0,0 +1,312 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketKV       = []byte("kv")
+	bucketMeta     = []byte("meta")
+	bucketLease    = []byte("lease")
+	bucketLeaseKey = []byte("leasekey")
+	keyRev         = []byte("rev")
+)
+
+// BoltBackend stores state in a single bbolt data file, it's suitable for
+// small deployments running a single lln instance
+type BoltBackend struct {
+	db     *bolt.DB
+	hub    *watchHub
+	locker *localLocker
+	lessor *localLessor
+	done   chan struct{}
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	lessor := newLocalLessor()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketKV, bucketMeta, bucketLease, bucketLeaseKey} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// restore leases, expired ones are revoked by the lease loop
+		err := tx.Bucket(bucketLease).ForEach(func(k, v []byte) error {
+			lessor.grant(LeaseID(binary.BigEndian.Uint64(k)), int64(binary.BigEndian.Uint64(v[0:])),
+				time.Unix(0, int64(binary.BigEndian.Uint64(v[8:]))))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketLeaseKey).ForEach(func(k, v []byte) error {
+			lessor.attach(string(k), LeaseID(binary.BigEndian.Uint64(v)))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	b := &BoltBackend{db: db, hub: newWatchHub(), locker: newLocalLocker(),
+		lessor: lessor, done: make(chan struct{})}
+	go revokeLoop(b.lessor, b.Revoke, b.done)
+	return b, nil
+}
+
+func (b *BoltBackend) Get(ctx context.Context, key string, opts ...OpOption) (resp *GetResponse, err error) {
+	op := OpGet(key, opts...)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		resp = evalRange(op, boltRange(tx.Bucket(bucketKV), op))
+		return nil
+	})
+	if err == nil {
+		for _, kv := range resp.Kvs {
+			kv.Lease = b.lessor.leaseOf(string(kv.Key))
+		}
+	}
+	return
+}
+
+func (b *BoltBackend) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := b.Txn(ctx).Then(OpPut(key, value, opts...)).Commit()
+	return err
+}
+
+func (b *BoltBackend) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := b.Txn(ctx).Then(OpDelete(key, opts...)).Commit()
+	return err
+}
+
+func (b *BoltBackend) Txn(ctx context.Context) Txn {
+	return &localTxn{commit: b.commit}
+}
+
+func (b *BoltBackend) Watch(ctx context.Context, key string, opts ...OpOption) WatchChan {
+	return b.hub.watch(ctx, OpGet(key, opts...))
+}
+
+func (b *BoltBackend) NewMutex(key string) (Mutex, error) {
+	return b.locker.newMutex(key), nil
+}
+
+func (b *BoltBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	expiry := time.Now().Add(time.Duration(ttl) * time.Second)
+	id := b.lessor.grant(0, ttl, expiry)
+	if err := b.putLease(id, ttl, expiry); err != nil {
+		b.lessor.remove(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+func (b *BoltBackend) KeepAliveOnce(ctx context.Context, id LeaseID) error {
+	expiry, err := b.lessor.renew(id)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketLease).Get(leaseIDBytes(id))
+		if v == nil {
+			return ErrLeaseNotFound
+		}
+		return b.putLeaseTx(tx, id, int64(binary.BigEndian.Uint64(v[0:])), expiry)
+	})
+}
+
+func (b *BoltBackend) Revoke(ctx context.Context, id LeaseID) error {
+	keys, err := b.lessor.keysOf(id)
+	if err != nil {
+		return err
+	}
+	var ops []Op
+	for _, key := range keys {
+		ops = append(ops, OpDelete(key))
+	}
+	if _, err := b.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLease).Delete(leaseIDBytes(id))
+	})
+	if err != nil {
+		return err
+	}
+	b.lessor.remove(id)
+	return nil
+}
+
+func (b *BoltBackend) Close() error {
+	close(b.done)
+	return b.db.Close()
+}
+
+func (b *BoltBackend) putLease(id LeaseID, ttl int64, expiry time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.putLeaseTx(tx, id, ttl, expiry)
+	})
+}
+
+// putLeaseTx stores lease as `ttl|expiry`
+func (b *BoltBackend) putLeaseTx(tx *bolt.Tx, id LeaseID, ttl int64, expiry time.Time) error {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[0:], uint64(ttl))
+	binary.BigEndian.PutUint64(v[8:], uint64(expiry.UnixNano()))
+	return tx.Bucket(bucketLease).Put(leaseIDBytes(id), v)
+}
+
+func leaseIDBytes(id LeaseID) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+func (b *BoltBackend) commit(t *localTxn) (resp *TxnResponse, err error) {
+	var events []*Event
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		kvs := tx.Bucket(bucketKV)
+		meta := tx.Bucket(bucketMeta)
+		resp = &TxnResponse{Succeeded: true}
+		for _, cmp := range t.cmps {
+			if !evalCmp(cmp, boltGet(kvs, cmp.key)) {
+				resp.Succeeded = false
+				break
+			}
+		}
+		ops := t.then
+		if !resp.Succeeded {
+			ops = t.els
+		}
+		if err := b.lessor.checkLeases(ops); err != nil {
+			return err
+		}
+
+		var rev int64
+		if v := meta.Get(keyRev); v != nil {
+			rev = int64(binary.BigEndian.Uint64(v))
+		}
+		for _, op := range ops {
+			evs, err := boltApply(kvs, tx.Bucket(bucketLeaseKey), op, rev+1)
+			if err != nil {
+				return err
+			}
+			events = append(events, evs...)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(rev+1))
+		return meta.Put(keyRev, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.lessor.apply(events)
+	b.hub.notify(events)
+	return
+}
+
+// boltApply applies a write op at revision rev
+func boltApply(bucket, leaseKeys *bolt.Bucket, op Op, rev int64) (events []*Event, err error) {
+	switch op.t {
+	case tPut:
+		prev := boltGet(bucket, op.key)
+		kv := &KeyValue{
+			Key:            []byte(op.key),
+			Value:          []byte(op.value),
+			CreateRevision: rev,
+			ModRevision:    rev,
+			Version:        1,
+			Lease:          op.lease,
+		}
+		if prev != nil {
+			kv.CreateRevision = prev.CreateRevision
+			kv.Version = prev.Version + 1
+		}
+		if err = bucket.Put(kv.Key, encodeKv(kv)); err != nil {
+			return
+		}
+		if op.lease != 0 {
+			err = leaseKeys.Put(kv.Key, leaseIDBytes(op.lease))
+		} else {
+			err = leaseKeys.Delete(kv.Key)
+		}
+		if err != nil {
+			return
+		}
+		events = append(events, &Event{Type: EventTypePut, Kv: kv, PrevKv: prev})
+	case tDeleteRange:
+		for _, prev := range boltRange(bucket, op) {
+			if err = bucket.Delete(prev.Key); err != nil {
+				return
+			}
+			if err = leaseKeys.Delete(prev.Key); err != nil {
+				return
+			}
+			events = append(events, &Event{
+				Type:   EventTypeDelete,
+				Kv:     &KeyValue{Key: prev.Key, ModRevision: rev},
+				PrevKv: prev,
+			})
+		}
+	default:
+		err = errors.New("read operations are not supported in txn")
+	}
+	return
+}
+
+// boltRange returns all keys in the range of op ordered by key
+func boltRange(bucket *bolt.Bucket, op Op) (kvs []*KeyValue) {
+	if !op.prefix && len(op.end) == 0 {
+		if kv := boltGet(bucket, op.key); kv != nil {
+			kvs = append(kvs, kv)
+		}
+		return
+	}
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(op.key)); k != nil && op.match(string(k)); k, v = c.Next() {
+		kvs = append(kvs, decodeKv(k, v))
+	}
+	return
+}
+
+func boltGet(bucket *bolt.Bucket, key string) *KeyValue {
+	v := bucket.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	return decodeKv([]byte(key), v)
+}
+
+// encodeKv encodes revisions and value as `createRev|modRev|version|value`
+func encodeKv(kv *KeyValue) []byte {
+	b := make([]byte, 24+len(kv.Value))
+	binary.BigEndian.PutUint64(b[0:], uint64(kv.CreateRevision))
+	binary.BigEndian.PutUint64(b[8:], uint64(kv.ModRevision))
+	binary.BigEndian.PutUint64(b[16:], uint64(kv.Version))
+	copy(b[24:], kv.Value)
+	return b
+}
+
+func decodeKv(k, v []byte) *KeyValue {
+	// bolt owned memory is only valid within the transaction
+	value := make([]byte, len(v)-24)
+	copy(value, v[24:])
+	return &KeyValue{
+		Key:            append([]byte{}, k...),
+		Value:          value,
+		CreateRevision: int64(binary.BigEndian.Uint64(v[0:])),
+		ModRevision:    int64(binary.BigEndian.Uint64(v[8:])),
+		Version:        int64(binary.BigEndian.Uint64(v[16:])),
+	}
+}
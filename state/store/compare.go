@@ -0,0 +1,36 @@
+package store
+
+type CompareTarget int
+
+const (
+	CompareVersion CompareTarget = iota
+	CompareCreateRevision
+	CompareModRevision
+)
+
+// Cmp is a condition of a transaction
+type Cmp struct {
+	key    string
+	target CompareTarget
+	result string
+	value  int64
+}
+
+func Version(key string) Cmp {
+	return Cmp{key: key, target: CompareVersion}
+}
+
+func CreateRevision(key string) Cmp {
+	return Cmp{key: key, target: CompareCreateRevision}
+}
+
+func ModRevision(key string) Cmp {
+	return Cmp{key: key, target: CompareModRevision}
+}
+
+// Compare completes cmp with the result operator (=, !=, > or <) and the value to compare
+func Compare(cmp Cmp, result string, v int64) Cmp {
+	cmp.result = result
+	cmp.value = v
+	return cmp
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.etcd.io/etcd/pkg/transport"
+)
+
+type EtcdOptions struct {
+	Endpoints     []string
+	CertFile      string
+	KeyFile       string
+	TrustedCAFile string
+}
+
+// EtcdBackend stores state in an etcd cluster
+type EtcdBackend struct {
+	client *clientv3.Client
+}
+
+func NewEtcdBackend(opts EtcdOptions) (*EtcdBackend, error) {
+	cfg := clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		DialTimeout: 5 * time.Second,
+	}
+
+	tlsInfo := transport.TLSInfo{
+		CertFile:      opts.CertFile,
+		KeyFile:       opts.KeyFile,
+		TrustedCAFile: opts.TrustedCAFile,
+	}
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		logrus.Debug(err)
+	} else {
+		cfg.TLS = tlsConfig
+	}
+
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdBackend{client: client}, nil
+}
+
+func (b *EtcdBackend) Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error) {
+	op := OpGet(key, opts...)
+	resp, err := b.client.KV.Get(ctx, key, op.etcdOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	ret := &GetResponse{Count: resp.Count, More: resp.More}
+	for _, kv := range resp.Kvs {
+		ret.Kvs = append(ret.Kvs, fromEtcdKv(kv))
+	}
+	return ret, nil
+}
+
+func (b *EtcdBackend) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	op := OpPut(key, value, opts...)
+	_, err := b.client.KV.Put(ctx, key, value, op.etcdOptions()...)
+	return err
+}
+
+func (b *EtcdBackend) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	op := OpDelete(key, opts...)
+	_, err := b.client.KV.Delete(ctx, key, op.etcdOptions()...)
+	return err
+}
+
+func (b *EtcdBackend) Txn(ctx context.Context) Txn {
+	return &etcdTxn{txn: b.client.Txn(ctx)}
+}
+
+func (b *EtcdBackend) Watch(ctx context.Context, key string, opts ...OpOption) WatchChan {
+	op := OpGet(key, opts...)
+	ch := make(chan WatchResponse)
+	go func() {
+		defer close(ch)
+		for wresp := range b.client.Watch(ctx, key, op.etcdOptions()...) {
+			resp := WatchResponse{}
+			for _, ev := range wresp.Events {
+				e := &Event{Type: EventTypePut, Kv: fromEtcdKv(ev.Kv)}
+				if ev.Type == clientv3.EventTypeDelete {
+					e.Type = EventTypeDelete
+				}
+				if ev.PrevKv != nil {
+					e.PrevKv = fromEtcdKv(ev.PrevKv)
+				}
+				resp.Events = append(resp.Events, e)
+			}
+			ch <- resp
+		}
+	}()
+	return ch
+}
+
+func (b *EtcdBackend) NewMutex(key string) (Mutex, error) {
+	session, err := concurrency.NewSession(b.client)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdMutex{session: session, mutex: concurrency.NewMutex(session, key)}, nil
+}
+
+func (b *EtcdBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	resp, err := b.client.Lease.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return LeaseID(resp.ID), nil
+}
+
+func (b *EtcdBackend) KeepAliveOnce(ctx context.Context, id LeaseID) error {
+	_, err := b.client.Lease.KeepAliveOnce(ctx, clientv3.LeaseID(id))
+	return fromEtcdError(err)
+}
+
+func (b *EtcdBackend) Revoke(ctx context.Context, id LeaseID) error {
+	_, err := b.client.Lease.Revoke(ctx, clientv3.LeaseID(id))
+	return fromEtcdError(err)
+}
+
+func (b *EtcdBackend) Close() error {
+	return b.client.Close()
+}
+
+type etcdTxn struct {
+	txn clientv3.Txn
+}
+
+func (t *etcdTxn) If(cmps ...Cmp) Txn {
+	var etcdCmps []clientv3.Cmp
+	for _, cmp := range cmps {
+		etcdCmps = append(etcdCmps, cmp.etcdCmp())
+	}
+	t.txn = t.txn.If(etcdCmps...)
+	return t
+}
+
+func (t *etcdTxn) Then(ops ...Op) Txn {
+	t.txn = t.txn.Then(toEtcdOps(ops)...)
+	return t
+}
+
+func (t *etcdTxn) Else(ops ...Op) Txn {
+	t.txn = t.txn.Else(toEtcdOps(ops)...)
+	return t
+}
+
+func (t *etcdTxn) Commit() (*TxnResponse, error) {
+	resp, err := t.txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &TxnResponse{Succeeded: resp.Succeeded}, nil
+}
+
+type etcdMutex struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+func (m *etcdMutex) Lock(ctx context.Context) error {
+	return m.mutex.Lock(ctx)
+}
+
+func (m *etcdMutex) Unlock(ctx context.Context) error {
+	return m.mutex.Unlock(ctx)
+}
+
+func (m *etcdMutex) Close() error {
+	return m.session.Close()
+}
+
+func (op Op) etcdOptions() (opts []clientv3.OpOption) {
+	if op.prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if len(op.end) > 0 {
+		opts = append(opts, clientv3.WithRange(op.end))
+	}
+	if op.limit > 0 {
+		opts = append(opts, clientv3.WithLimit(op.limit))
+	}
+	if op.countOnly {
+		opts = append(opts, clientv3.WithCountOnly())
+	}
+	if op.keysOnly {
+		opts = append(opts, clientv3.WithKeysOnly())
+	}
+	if op.prevKV {
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	if op.minCreateRev > 0 {
+		opts = append(opts, clientv3.WithMinCreateRev(op.minCreateRev))
+	}
+	if op.maxCreateRev > 0 {
+		opts = append(opts, clientv3.WithMaxCreateRev(op.maxCreateRev))
+	}
+	if op.sortOrder != SortNone {
+		opts = append(opts, clientv3.WithSort(
+			clientv3.SortTarget(op.sortTarget), clientv3.SortOrder(op.sortOrder)))
+	}
+	if op.lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(op.lease)))
+	}
+	return
+}
+
+func toEtcdOps(ops []Op) (etcdOps []clientv3.Op) {
+	for _, op := range ops {
+		switch op.t {
+		case tPut:
+			etcdOps = append(etcdOps, clientv3.OpPut(op.key, op.value, op.etcdOptions()...))
+		case tDeleteRange:
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.key, op.etcdOptions()...))
+		default:
+			etcdOps = append(etcdOps, clientv3.OpGet(op.key, op.etcdOptions()...))
+		}
+	}
+	return
+}
+
+func (cmp Cmp) etcdCmp() clientv3.Cmp {
+	switch cmp.target {
+	case CompareCreateRevision:
+		return clientv3.Compare(clientv3.CreateRevision(cmp.key), cmp.result, cmp.value)
+	case CompareModRevision:
+		return clientv3.Compare(clientv3.ModRevision(cmp.key), cmp.result, cmp.value)
+	default:
+		return clientv3.Compare(clientv3.Version(cmp.key), cmp.result, cmp.value)
+	}
+}
+
+func fromEtcdKv(kv *mvccpb.KeyValue) *KeyValue {
+	return &KeyValue{
+		Key:            kv.Key,
+		Value:          kv.Value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Lease:          LeaseID(kv.Lease),
+	}
+}
+
+func fromEtcdError(err error) error {
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return ErrLeaseNotFound
+	}
+	return err
+}
@@ -0,0 +1,425 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// helpers shared by the backends that keep data in this process.
+// they reproduce the etcd revision model: every write transaction bumps a
+// global revision, keys remember the revision they were created and last
+// modified at, and the version counts modifications since creation.
+
+// match reports whether key falls in the range of op
+func (op Op) match(key string) bool {
+	if len(op.end) > 0 {
+		return key >= op.key && key < op.end
+	}
+	if op.prefix {
+		return strings.HasPrefix(key, op.key)
+	}
+	return key == op.key
+}
+
+// evalRange applies filters, sorting and limit of op to kvs which must be
+// all keys in the range of op ordered by key
+func evalRange(op Op, kvs []*KeyValue) *GetResponse {
+	resp := &GetResponse{Count: int64(len(kvs))}
+	if op.countOnly {
+		return resp
+	}
+
+	var filtered []*KeyValue
+	for _, kv := range kvs {
+		if op.minCreateRev > 0 && kv.CreateRevision < op.minCreateRev {
+			continue
+		}
+		if op.maxCreateRev > 0 && kv.CreateRevision > op.maxCreateRev {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+
+	if op.sortOrder != SortNone {
+		less := func(i, j int) bool {
+			a, b := filtered[i], filtered[j]
+			switch op.sortTarget {
+			case SortByVersion:
+				return a.Version < b.Version
+			case SortByCreateRevision:
+				return a.CreateRevision < b.CreateRevision
+			case SortByModRevision:
+				return a.ModRevision < b.ModRevision
+			case SortByValue:
+				return bytes.Compare(a.Value, b.Value) < 0
+			default:
+				return bytes.Compare(a.Key, b.Key) < 0
+			}
+		}
+		if op.sortOrder == SortDescend {
+			sort.SliceStable(filtered, func(i, j int) bool { return less(j, i) })
+		} else {
+			sort.SliceStable(filtered, less)
+		}
+	}
+
+	if op.limit > 0 && int64(len(filtered)) > op.limit {
+		filtered = filtered[:op.limit]
+		resp.More = true
+	}
+
+	for _, kv := range filtered {
+		c := *kv
+		if op.keysOnly {
+			c.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &c)
+	}
+	return resp
+}
+
+// evalCmp evaluates cmp against kv, kv is nil when the key does not exist
+func evalCmp(cmp Cmp, kv *KeyValue) bool {
+	var v int64
+	if kv != nil {
+		switch cmp.target {
+		case CompareCreateRevision:
+			v = kv.CreateRevision
+		case CompareModRevision:
+			v = kv.ModRevision
+		default:
+			v = kv.Version
+		}
+	}
+	switch cmp.result {
+	case "=":
+		return v == cmp.value
+	case "!=":
+		return v != cmp.value
+	case ">":
+		return v > cmp.value
+	case "<":
+		return v < cmp.value
+	}
+	return false
+}
+
+// localTxn collects the txn and hands it to the backend on commit
+type localTxn struct {
+	cmps   []Cmp
+	then   []Op
+	els    []Op
+	commit func(t *localTxn) (*TxnResponse, error)
+}
+
+func (t *localTxn) If(cmps ...Cmp) Txn {
+	t.cmps = append(t.cmps, cmps...)
+	return t
+}
+
+func (t *localTxn) Then(ops ...Op) Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *localTxn) Else(ops ...Op) Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+func (t *localTxn) Commit() (*TxnResponse, error) {
+	return t.commit(t)
+}
+
+// watchHub delivers events of committed transactions to watchers
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+type watcher struct {
+	op     Op
+	lock   sync.Mutex
+	queue  []WatchResponse
+	signal chan struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+func (h *watchHub) watch(ctx context.Context, op Op) WatchChan {
+	w := &watcher{op: op, signal: make(chan struct{}, 1)}
+	h.lock.Lock()
+	h.watchers[w] = struct{}{}
+	h.lock.Unlock()
+
+	ch := make(chan WatchResponse)
+	go func() {
+		defer close(ch)
+		defer func() {
+			h.lock.Lock()
+			delete(h.watchers, w)
+			h.lock.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.signal:
+			}
+			w.lock.Lock()
+			queue := w.queue
+			w.queue = nil
+			w.lock.Unlock()
+			for _, resp := range queue {
+				select {
+				case ch <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (h *watchHub) notify(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for w := range h.watchers {
+		resp := WatchResponse{}
+		for _, ev := range events {
+			if !w.op.match(string(ev.Kv.Key)) {
+				continue
+			}
+			e := &Event{Type: ev.Type, Kv: ev.Kv}
+			if w.op.prevKV {
+				e.PrevKv = ev.PrevKv
+			}
+			resp.Events = append(resp.Events, e)
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
+		w.lock.Lock()
+		w.queue = append(w.queue, resp)
+		w.lock.Unlock()
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// localLocker hands out mutexes which are exclusive within the process
+type localLocker struct {
+	lock  sync.Mutex
+	locks map[string]chan struct{}
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{locks: make(map[string]chan struct{})}
+}
+
+func (l *localLocker) newMutex(key string) Mutex {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ch, ok := l.locks[key]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.locks[key] = ch
+	}
+	return &localMutex{ch: ch}
+}
+
+type localMutex struct {
+	ch     chan struct{}
+	lock   sync.Mutex
+	locked bool
+}
+
+func (m *localMutex) Lock(ctx context.Context) error {
+	select {
+	case m.ch <- struct{}{}:
+		m.lock.Lock()
+		m.locked = true
+		m.lock.Unlock()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *localMutex) Unlock(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.locked {
+		<-m.ch
+		m.locked = false
+	}
+	return nil
+}
+
+func (m *localMutex) Close() error {
+	return m.Unlock(context.Background())
+}
+
+// localLessor keeps leases of the backends in this process. expired leases
+// are revoked by the backend's lease loop
+type localLessor struct {
+	lock   sync.Mutex
+	nextID LeaseID
+	leases map[LeaseID]*localLease
+	keys   map[string]LeaseID
+}
+
+type localLease struct {
+	ttl    int64
+	expiry time.Time
+	keys   map[string]struct{}
+}
+
+func newLocalLessor() *localLessor {
+	return &localLessor{leases: make(map[LeaseID]*localLease), keys: make(map[string]LeaseID)}
+}
+
+// grant adds lease id, a zero id is allocated
+func (l *localLessor) grant(id LeaseID, ttl int64, expiry time.Time) LeaseID {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if id == 0 {
+		l.nextID++
+		id = l.nextID
+	} else if id > l.nextID {
+		l.nextID = id
+	}
+	l.leases[id] = &localLease{ttl: ttl, expiry: expiry, keys: make(map[string]struct{})}
+	return id
+}
+
+// renew returns the new expiry of lease id
+func (l *localLessor) renew(id LeaseID) (time.Time, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, ok := l.leases[id]
+	if !ok {
+		return time.Time{}, ErrLeaseNotFound
+	}
+	lease.expiry = time.Now().Add(time.Duration(lease.ttl) * time.Second)
+	return lease.expiry, nil
+}
+
+func (l *localLessor) exists(id LeaseID) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, ok := l.leases[id]
+	return ok
+}
+
+func (l *localLessor) leaseOf(key string) LeaseID {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.keys[key]
+}
+
+// attach moves key to lease id, a zero id detaches the key
+func (l *localLessor) attach(key string, id LeaseID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if prev, ok := l.keys[key]; ok {
+		if lease, ok := l.leases[prev]; ok {
+			delete(lease.keys, key)
+		}
+		delete(l.keys, key)
+	}
+	if lease, ok := l.leases[id]; ok {
+		lease.keys[key] = struct{}{}
+		l.keys[key] = id
+	}
+}
+
+// apply keeps key attachments in sync with committed events
+func (l *localLessor) apply(events []*Event) {
+	for _, ev := range events {
+		if ev.Type == EventTypeDelete {
+			l.attach(string(ev.Kv.Key), 0)
+		} else {
+			l.attach(string(ev.Kv.Key), ev.Kv.Lease)
+		}
+	}
+}
+
+// keysOf returns keys attached to lease id
+func (l *localLessor) keysOf(id LeaseID) (keys []string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, ok := l.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	for key := range lease.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (l *localLessor) remove(id LeaseID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if lease, ok := l.leases[id]; ok {
+		for key := range lease.keys {
+			delete(l.keys, key)
+		}
+		delete(l.leases, id)
+	}
+}
+
+func (l *localLessor) expired(now time.Time) (ids []LeaseID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for id, lease := range l.leases {
+		if now.After(lease.expiry) {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// checkLeases makes sure leases of put ops exist before a txn is applied
+func (l *localLessor) checkLeases(ops []Op) error {
+	for _, op := range ops {
+		if op.t == tPut && op.lease != 0 && !l.exists(op.lease) {
+			return ErrLeaseNotFound
+		}
+	}
+	return nil
+}
+
+// revokeLoop revokes expired leases until done is closed
+func revokeLoop(l *localLessor, revoke func(ctx context.Context, id LeaseID) error, done chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, id := range l.expired(now) {
+				if err := revoke(context.Background(), id); err != nil && err != ErrLeaseNotFound {
+					logrus.Errorf("revoke lease %d error: %s", id, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps state in process memory with the same revision, watch
+// and txn semantics as etcd. Nothing is persisted, it's intended for tests
+type MemoryBackend struct {
+	lock   sync.RWMutex
+	rev    int64
+	kvs    map[string]*KeyValue
+	hub    *watchHub
+	locker *localLocker
+	lessor *localLessor
+	done   chan struct{}
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{
+		kvs:    make(map[string]*KeyValue),
+		hub:    newWatchHub(),
+		locker: newLocalLocker(),
+		lessor: newLocalLessor(),
+		done:   make(chan struct{}),
+	}
+	go revokeLoop(b.lessor, b.Revoke, b.done)
+	return b
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error) {
+	op := OpGet(key, opts...)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return evalRange(op, b.rangeKeys(op)), nil
+}
+
+func (b *MemoryBackend) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := b.Txn(ctx).Then(OpPut(key, value, opts...)).Commit()
+	return err
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := b.Txn(ctx).Then(OpDelete(key, opts...)).Commit()
+	return err
+}
+
+func (b *MemoryBackend) Txn(ctx context.Context) Txn {
+	return &localTxn{commit: b.commit}
+}
+
+func (b *MemoryBackend) Watch(ctx context.Context, key string, opts ...OpOption) WatchChan {
+	return b.hub.watch(ctx, OpGet(key, opts...))
+}
+
+func (b *MemoryBackend) NewMutex(key string) (Mutex, error) {
+	return b.locker.newMutex(key), nil
+}
+
+func (b *MemoryBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	return b.lessor.grant(0, ttl, time.Now().Add(time.Duration(ttl)*time.Second)), nil
+}
+
+func (b *MemoryBackend) KeepAliveOnce(ctx context.Context, id LeaseID) error {
+	_, err := b.lessor.renew(id)
+	return err
+}
+
+func (b *MemoryBackend) Revoke(ctx context.Context, id LeaseID) error {
+	keys, err := b.lessor.keysOf(id)
+	if err != nil {
+		return err
+	}
+	var ops []Op
+	for _, key := range keys {
+		ops = append(ops, OpDelete(key))
+	}
+	if _, err := b.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	b.lessor.remove(id)
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	close(b.done)
+	return nil
+}
+
+// Revision returns the current revision of the backend
+func (b *MemoryBackend) Revision() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.rev
+}
+
+func (b *MemoryBackend) commit(t *localTxn) (*TxnResponse, error) {
+	b.lock.Lock()
+	resp := &TxnResponse{Succeeded: true}
+	for _, cmp := range t.cmps {
+		if !evalCmp(cmp, b.kvs[cmp.key]) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := t.then
+	if !resp.Succeeded {
+		ops = t.els
+	}
+	if err := b.lessor.checkLeases(ops); err != nil {
+		b.lock.Unlock()
+		return nil, err
+	}
+
+	var events []*Event
+	for _, op := range ops {
+		evs, err := b.apply(op, b.rev+1)
+		if err != nil {
+			b.lock.Unlock()
+			return nil, err
+		}
+		events = append(events, evs...)
+	}
+	if len(events) > 0 {
+		b.rev++
+	}
+	b.lessor.apply(events)
+	b.lock.Unlock()
+	b.hub.notify(events)
+	return resp, nil
+}
+
+func (b *MemoryBackend) apply(op Op, rev int64) (events []*Event, err error) {
+	switch op.t {
+	case tPut:
+		prev := b.kvs[op.key]
+		kv := &KeyValue{
+			Key:            []byte(op.key),
+			Value:          []byte(op.value),
+			CreateRevision: rev,
+			ModRevision:    rev,
+			Version:        1,
+			Lease:          op.lease,
+		}
+		if prev != nil {
+			kv.CreateRevision = prev.CreateRevision
+			kv.Version = prev.Version + 1
+		}
+		b.kvs[op.key] = kv
+		events = append(events, &Event{Type: EventTypePut, Kv: kv, PrevKv: prev})
+	case tDeleteRange:
+		for _, prev := range b.rangeKeys(op) {
+			delete(b.kvs, string(prev.Key))
+			events = append(events, &Event{
+				Type:   EventTypeDelete,
+				Kv:     &KeyValue{Key: prev.Key, ModRevision: rev},
+				PrevKv: prev,
+			})
+		}
+	default:
+		err = errors.New("read operations are not supported in txn")
+	}
+	return
+}
+
+// rangeKeys returns all keys in the range of op ordered by key
+func (b *MemoryBackend) rangeKeys(op Op) (kvs []*KeyValue) {
+	if !op.prefix && len(op.end) == 0 {
+		if kv, ok := b.kvs[op.key]; ok {
+			kvs = append(kvs, kv)
+		}
+		return
+	}
+	for k, kv := range b.kvs {
+		if op.match(k) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+	return
+}
@@ -0,0 +1,129 @@
+package store
+
+type opType int
+
+const (
+	tRange opType = iota
+	tPut
+	tDeleteRange
+)
+
+type SortTarget int
+
+const (
+	SortByKey SortTarget = iota
+	SortByVersion
+	SortByCreateRevision
+	SortByModRevision
+	SortByValue
+)
+
+type SortOrder int
+
+const (
+	SortNone SortOrder = iota
+	SortAscend
+	SortDescend
+)
+
+// Op is a single read or write operation
+type Op struct {
+	t            opType
+	key          string
+	value        string
+	prefix       bool
+	end          string
+	limit        int64
+	countOnly    bool
+	keysOnly     bool
+	prevKV       bool
+	minCreateRev int64
+	maxCreateRev int64
+	sortTarget   SortTarget
+	sortOrder    SortOrder
+	lease        LeaseID
+}
+
+type OpOption func(*Op)
+
+func OpPut(key, value string, opts ...OpOption) Op {
+	op := Op{t: tPut, key: key, value: value}
+	op.apply(opts)
+	return op
+}
+
+func OpDelete(key string, opts ...OpOption) Op {
+	op := Op{t: tDeleteRange, key: key}
+	op.apply(opts)
+	return op
+}
+
+func OpGet(key string, opts ...OpOption) Op {
+	op := Op{t: tRange, key: key}
+	op.apply(opts)
+	return op
+}
+
+func (op *Op) apply(opts []OpOption) {
+	for _, opt := range opts {
+		opt(op)
+	}
+}
+
+// Key returns the key the op targets
+func (op Op) Key() string {
+	return op.key
+}
+
+// WithPrefix operates on all keys with the prefix
+func WithPrefix() OpOption {
+	return func(op *Op) { op.prefix = true }
+}
+
+// WithRange operates on keys in the range [key, end)
+func WithRange(end string) OpOption {
+	return func(op *Op) { op.end = end }
+}
+
+// WithLimit limits the number of results to return, 0 means no limit
+func WithLimit(n int64) OpOption {
+	return func(op *Op) { op.limit = n }
+}
+
+// WithCountOnly returns only the count of keys
+func WithCountOnly() OpOption {
+	return func(op *Op) { op.countOnly = true }
+}
+
+// WithKeysOnly returns only the keys without values
+func WithKeysOnly() OpOption {
+	return func(op *Op) { op.keysOnly = true }
+}
+
+// WithPrevKV returns the previous key-value pair in watch events
+func WithPrevKV() OpOption {
+	return func(op *Op) { op.prevKV = true }
+}
+
+// WithMinCreateRev filters out keys with create revision less than rev
+func WithMinCreateRev(rev int64) OpOption {
+	return func(op *Op) { op.minCreateRev = rev }
+}
+
+// WithMaxCreateRev filters out keys with create revision greater than rev
+func WithMaxCreateRev(rev int64) OpOption {
+	return func(op *Op) { op.maxCreateRev = rev }
+}
+
+// WithLease attaches the put key to the lease
+func WithLease(id LeaseID) OpOption {
+	return func(op *Op) { op.lease = id }
+}
+
+// WithSort sorts the results by target in order
+func WithSort(target SortTarget, order SortOrder) OpOption {
+	return func(op *Op) {
+		op.sortTarget = target
+		op.sortOrder = order
+	}
+}
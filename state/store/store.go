@@ -0,0 +1,100 @@
+// Package store is the key-value abstraction the state package is built on.
+//
+// The surface mirrors the subset of the etcd v3 client that state relies on:
+// prefix ranges with create-revision filters, sorting and limits, count-only
+// queries, compare-and-swap transactions, prefix watches, leases and a leader
+// election mutex. Every backend must keep etcd's revision semantics, so that cursors
+// based on create revisions keep working regardless of where data is stored.
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrLeaseNotFound = errors.New("requested lease not found")
+
+// LeaseID identifies a lease, keys put with a lease are deleted when the
+// lease expires or is revoked. 0 means no lease
+type LeaseID int64
+
+type KeyValue struct {
+	Key            []byte
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Lease          LeaseID
+}
+
+type GetResponse struct {
+	Kvs   []*KeyValue
+	Count int64
+	More  bool
+}
+
+type TxnResponse struct {
+	Succeeded bool
+}
+
+type EventType int
+
+const (
+	EventTypePut EventType = iota
+	EventTypeDelete
+)
+
+type Event struct {
+	Type   EventType
+	Kv     *KeyValue
+	PrevKv *KeyValue
+}
+
+// IsCreate returns true if the event tells that the key is newly created
+func (e *Event) IsCreate() bool {
+	return e.Type == EventTypePut && e.Kv.CreateRevision == e.Kv.ModRevision
+}
+
+// IsModify returns true if the event tells that a new value is put on existing key
+func (e *Event) IsModify() bool {
+	return e.Type == EventTypePut && e.Kv.CreateRevision != e.Kv.ModRevision
+}
+
+type WatchResponse struct {
+	Events []*Event
+}
+
+type WatchChan <-chan WatchResponse
+
+// Txn is a compare-and-swap transaction, Then ops are applied when all
+// compares succeed, otherwise Else ops are applied
+type Txn interface {
+	If(cmps ...Cmp) Txn
+	Then(ops ...Op) Txn
+	Else(ops ...Op) Txn
+	Commit() (*TxnResponse, error)
+}
+
+// Mutex is a distributed lock used for leader election
+type Mutex interface {
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+	// Close releases the lock and resources held by the mutex
+	Close() error
+}
+
+type Backend interface {
+	Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error)
+	Put(ctx context.Context, key, value string, opts ...OpOption) error
+	Delete(ctx context.Context, key string, opts ...OpOption) error
+	Txn(ctx context.Context) Txn
+	Watch(ctx context.Context, key string, opts ...OpOption) WatchChan
+	NewMutex(key string) (Mutex, error)
+	// Grant creates a lease expiring after ttl seconds
+	Grant(ctx context.Context, ttl int64) (LeaseID, error)
+	// KeepAliveOnce renews the lease to its granted ttl
+	KeepAliveOnce(ctx context.Context, id LeaseID) error
+	// Revoke deletes the lease and all keys attached to it
+	Revoke(ctx context.Context, id LeaseID) error
+	Close() error
+}
@@ -0,0 +1,411 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// eachBackend runs fn against a fresh memory and bolt backend
+func eachBackend(t *testing.T, fn func(t *testing.T, b Backend)) {
+	backends := []struct {
+		name string
+		new  func(t *testing.T) Backend
+	}{
+		{"memory", func(t *testing.T) Backend { return NewMemoryBackend() }},
+		{"bolt", func(t *testing.T) Backend {
+			b, err := NewBoltBackend(filepath.Join(t.TempDir(), "lln.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}},
+	}
+	for _, bk := range backends {
+		t.Run(bk.name, func(t *testing.T) {
+			b := bk.new(t)
+			defer b.Close()
+			fn(t, b)
+		})
+	}
+}
+
+func mustPut(t *testing.T, b Backend, key, value string, opts ...OpOption) {
+	t.Helper()
+	if err := b.Put(context.Background(), key, value, opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustGet(t *testing.T, b Backend, key string, opts ...OpOption) *GetResponse {
+	t.Helper()
+	resp, err := b.Get(context.Background(), key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func keys(resp *GetResponse) (ks []string) {
+	for _, kv := range resp.Kvs {
+		ks = append(ks, string(kv.Key))
+	}
+	return
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPutRevisions(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		mustPut(t, b, "/a", "1")
+		mustPut(t, b, "/b", "1")
+		mustPut(t, b, "/a", "2")
+
+		a := mustGet(t, b, "/a").Kvs[0]
+		if string(a.Value) != "2" || a.CreateRevision != 1 || a.ModRevision != 3 || a.Version != 2 {
+			t.Fatalf("unexpected /a: %+v", a)
+		}
+		bk := mustGet(t, b, "/b").Kvs[0]
+		if bk.CreateRevision != 2 || bk.ModRevision != 2 || bk.Version != 1 {
+			t.Fatalf("unexpected /b: %+v", bk)
+		}
+		if resp := mustGet(t, b, "/c"); len(resp.Kvs) != 0 || resp.Count != 0 {
+			t.Fatalf("unexpected /c: %+v", resp)
+		}
+	})
+}
+
+func TestGetOptions(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		// create revisions 1..4 in reverse key order
+		for _, k := range []string{"/p/d", "/p/c", "/p/b", "/p/a"} {
+			mustPut(t, b, k, k)
+		}
+		mustPut(t, b, "/q", "q")
+
+		cases := []struct {
+			name  string
+			opts  []OpOption
+			keys  []string
+			count int64
+			more  bool
+		}{
+			{"prefix", []OpOption{WithPrefix()},
+				[]string{"/p/a", "/p/b", "/p/c", "/p/d"}, 4, false},
+			{"limit", []OpOption{WithPrefix(), WithLimit(2)},
+				[]string{"/p/a", "/p/b"}, 4, true},
+			{"sort create rev", []OpOption{WithPrefix(), WithSort(SortByCreateRevision, SortAscend)},
+				[]string{"/p/d", "/p/c", "/p/b", "/p/a"}, 4, false},
+			{"sort create rev descend", []OpOption{WithPrefix(), WithLimit(3),
+				WithSort(SortByCreateRevision, SortDescend)},
+				[]string{"/p/a", "/p/b", "/p/c"}, 4, true},
+			{"min create rev", []OpOption{WithPrefix(), WithMinCreateRev(3)},
+				[]string{"/p/a", "/p/b"}, 4, false},
+			{"max create rev", []OpOption{WithPrefix(), WithMaxCreateRev(2)},
+				[]string{"/p/c", "/p/d"}, 4, false},
+			{"count only", []OpOption{WithPrefix(), WithCountOnly()}, nil, 4, false},
+			{"single key", nil, []string{"/q"}, 1, false},
+		}
+		for _, c := range cases {
+			prefix := "/p/"
+			if c.name == "single key" {
+				prefix = "/q"
+			}
+			resp := mustGet(t, b, prefix, c.opts...)
+			if !equal(keys(resp), c.keys) || resp.Count != c.count || resp.More != c.more {
+				t.Errorf("%s: got %v count %d more %v, want %v count %d more %v",
+					c.name, keys(resp), resp.Count, resp.More, c.keys, c.count, c.more)
+			}
+		}
+
+		resp := mustGet(t, b, "/p/b", WithRange("/p/d"))
+		if ks := keys(resp); !equal(ks, []string{"/p/b", "/p/c"}) {
+			t.Errorf("range: got %v", ks)
+		}
+		resp = mustGet(t, b, "/p/b", WithRange("/q"), WithLimit(1), WithSort(SortByKey, SortDescend))
+		if ks := keys(resp); !equal(ks, []string{"/p/d"}) || !resp.More {
+			t.Errorf("range sort descend: got %v", ks)
+		}
+
+		resp = mustGet(t, b, "/p/a", WithKeysOnly())
+		if len(resp.Kvs) != 1 || resp.Kvs[0].Value != nil {
+			t.Errorf("keys only: unexpected %+v", resp.Kvs)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		for _, k := range []string{"/p/a", "/p/b", "/pq", "/x"} {
+			mustPut(t, b, k, "")
+		}
+		if err := b.Delete(context.Background(), "/x"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(context.Background(), "/p/", WithPrefix()); err != nil {
+			t.Fatal(err)
+		}
+		if ks := keys(mustGet(t, b, "/", WithPrefix())); !equal(ks, []string{"/pq"}) {
+			t.Fatalf("unexpected keys after delete: %v", ks)
+		}
+
+		// deleting a missing key doesn't bump the revision
+		mustPut(t, b, "/y", "")
+		if err := b.Delete(context.Background(), "/missing"); err != nil {
+			t.Fatal(err)
+		}
+		mustPut(t, b, "/z", "")
+		y, z := mustGet(t, b, "/y").Kvs[0], mustGet(t, b, "/z").Kvs[0]
+		if z.CreateRevision != y.CreateRevision+1 {
+			t.Fatalf("revision bumped by a noop delete: /y %d, /z %d", y.CreateRevision, z.CreateRevision)
+		}
+
+		// recreated keys start over
+		mustPut(t, b, "/x", "")
+		if x := mustGet(t, b, "/x").Kvs[0]; x.Version != 1 || x.CreateRevision != z.CreateRevision+1 {
+			t.Fatalf("unexpected recreated /x: %+v", x)
+		}
+	})
+}
+
+func TestTxnCompare(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		mustPut(t, b, "/k", "1")
+		mustPut(t, b, "/k", "2")
+		k := mustGet(t, b, "/k").Kvs[0]
+
+		cases := []struct {
+			name string
+			cmp  Cmp
+			ok   bool
+		}{
+			{"version =", Compare(Version("/k"), "=", 2), true},
+			{"version !=", Compare(Version("/k"), "!=", 2), false},
+			{"version >", Compare(Version("/k"), ">", 1), true},
+			{"version <", Compare(Version("/k"), "<", 2), false},
+			{"create rev =", Compare(CreateRevision("/k"), "=", k.CreateRevision), true},
+			{"mod rev =", Compare(ModRevision("/k"), "=", k.ModRevision), true},
+			{"stale mod rev", Compare(ModRevision("/k"), "=", k.CreateRevision), false},
+			{"missing key version = 0", Compare(Version("/missing"), "=", 0), true},
+			{"missing key mod rev = 0", Compare(ModRevision("/missing"), "=", 0), true},
+			{"missing key version > 0", Compare(Version("/missing"), ">", 0), false},
+		}
+		for _, c := range cases {
+			resp, err := b.Txn(context.Background()).If(c.cmp).
+				Then(OpPut("/then", c.name)).Else(OpPut("/else", c.name)).Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Succeeded != c.ok {
+				t.Errorf("%s: succeeded %v, want %v", c.name, resp.Succeeded, c.ok)
+			}
+			applied := "/else"
+			if c.ok {
+				applied = "/then"
+			}
+			if v := mustGet(t, b, applied).Kvs[0].Value; string(v) != c.name {
+				t.Errorf("%s: %s not applied", c.name, applied)
+			}
+		}
+	})
+}
+
+func TestTxnAtomic(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		mustPut(t, b, "/old", "")
+		_, err := b.Txn(context.Background()).
+			Then(OpPut("/a", "a"), OpPut("/b", "b"), OpDelete("/old")).Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, bk := mustGet(t, b, "/a").Kvs[0], mustGet(t, b, "/b").Kvs[0]
+		if a.ModRevision != bk.ModRevision || a.ModRevision != 2 {
+			t.Fatalf("ops of one txn must share a revision: %d, %d", a.ModRevision, bk.ModRevision)
+		}
+		if len(mustGet(t, b, "/old").Kvs) != 0 {
+			t.Fatal("/old not deleted")
+		}
+
+		// a failed compare applies nothing
+		resp, err := b.Txn(context.Background()).If(Compare(Version("/a"), "=", 0)).
+			Then(OpPut("/c", "c"), OpDelete("/a")).Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Succeeded || len(mustGet(t, b, "/c").Kvs) != 0 || len(mustGet(t, b, "/a").Kvs) != 1 {
+			t.Fatal("failed txn applied its ops")
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := b.Watch(ctx, "/w/", WithPrefix(), WithPrevKV())
+
+		mustPut(t, b, "/w/a", "1")
+		mustPut(t, b, "/other", "")
+		mustPut(t, b, "/w/a", "2")
+		if err := b.Delete(context.Background(), "/w/a"); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []struct {
+			typ    EventType
+			create bool
+			modify bool
+			value  string
+			prev   string
+		}{
+			{EventTypePut, true, false, "1", ""},
+			{EventTypePut, false, true, "2", "1"},
+			{EventTypeDelete, false, false, "", "2"},
+		}
+		var events []*Event
+		timeout := time.After(2 * time.Second)
+		for len(events) < len(want) {
+			select {
+			case resp := <-ch:
+				events = append(events, resp.Events...)
+			case <-timeout:
+				t.Fatalf("got %d events, want %d", len(events), len(want))
+			}
+		}
+		for i, w := range want {
+			e := events[i]
+			if e.Type != w.typ || e.IsCreate() != w.create || e.IsModify() != w.modify ||
+				string(e.Kv.Key) != "/w/a" || string(e.Kv.Value) != w.value {
+				t.Errorf("event %d: unexpected %+v", i, e.Kv)
+			}
+			var prev string
+			if e.PrevKv != nil {
+				prev = string(e.PrevKv.Value)
+			}
+			if prev != w.prev {
+				t.Errorf("event %d: prev %q, want %q", i, prev, w.prev)
+			}
+		}
+
+		cancel()
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Fatal("unexpected event after cancel")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("watch not closed after cancel")
+		}
+	})
+}
+
+func TestLease(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		ctx := context.Background()
+		short, err := b.Grant(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		long, err := b.Grant(ctx, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustPut(t, b, "/l/short", "", WithLease(short))
+		mustPut(t, b, "/l/long", "", WithLease(long))
+		mustPut(t, b, "/l/none", "")
+		if l := mustGet(t, b, "/l/short").Kvs[0].Lease; l != short {
+			t.Fatalf("lease %d, want %d", l, short)
+		}
+
+		if err := b.Put(ctx, "/l/bad", "", WithLease(short+long+100)); err != ErrLeaseNotFound {
+			t.Fatalf("put with unknown lease: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(mustGet(t, b, "/l/short").Kvs) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("key of the expired lease not deleted")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := b.KeepAliveOnce(ctx, short); err != ErrLeaseNotFound {
+			t.Fatalf("keep alive expired lease: %v", err)
+		}
+		if err := b.KeepAliveOnce(ctx, long); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Revoke(ctx, long); err != nil {
+			t.Fatal(err)
+		}
+		if ks := keys(mustGet(t, b, "/l/", WithPrefix())); !equal(ks, []string{"/l/none"}) {
+			t.Fatalf("unexpected keys after revoke: %v", ks)
+		}
+	})
+}
+
+func TestMutex(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		m1, _ := b.NewMutex("/election/test")
+		m2, _ := b.NewMutex("/election/test")
+		if err := m1.Lock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := m2.Lock(ctx); err == nil {
+			t.Fatal("second lock acquired while held")
+		}
+		if err := m1.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m2.Lock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		m2.Close()
+	})
+}
+
+func TestBoltPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lln.db")
+	b, err := NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, "/a", "1")
+	mustPut(t, b, "/a", "2")
+	lease, err := b.Grant(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, "/leased", "", WithLease(lease))
+	b.Close()
+
+	b, err = NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	mustPut(t, b, "/b", "")
+	a, bk := mustGet(t, b, "/a").Kvs[0], mustGet(t, b, "/b").Kvs[0]
+	if a.Version != 2 || a.ModRevision != 2 || bk.CreateRevision != 4 {
+		t.Fatalf("revisions not restored: /a %+v, /b %+v", a, bk)
+	}
+	if err := b.Revoke(context.Background(), lease); err != nil {
+		t.Fatalf("lease not restored: %v", err)
+	}
+	if len(mustGet(t, b, "/leased").Kvs) != 0 {
+		t.Fatal("leased key not deleted with the restored lease")
+	}
+}
@@ -0,0 +1,371 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rkonfj/lln/config"
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tTimeline             string = "/timeline/%s/%s"
+	tTimelineFanIn        string = "/timeline-fanin/%s"
+	lastTimelineCreateRev string = stateKey("/timeline-lastrev")
+	// ops per fan-out txn, etcd limits ops of a txn to 128 by default
+	fanOutBatchSize int = 100
+)
+
+// Timeline home timeline of user, merges statuses of the user and everyone
+// the user follows. statuses of users with few followers are fanned out to
+// the inbox of each follower on write, statuses of users with many followers
+// are fanned in on read. every source is ordered by the status create
+// revision, it is loaded in small batches while merging
+func Timeline(user *ActUser, opts *tools.PaginationOptions) (ss []*Status, more bool) {
+	if opts == nil {
+		opts = &tools.PaginationOptions{Size: 20}
+	}
+
+	followings := map[string]bool{user.ID: true}
+	followingPrefix := stateKey(fmt.Sprintf(tFollowingUser, user.ID, ""))
+	err := IterateWithPrefix(fmt.Sprintf(tFollowingUser, user.ID, ""), func(key string, _ []byte) {
+		followings[strings.TrimPrefix(key, followingPrefix)] = true
+	})
+	if err != nil {
+		logrus.Error("timeline load followings error: ", err)
+		return
+	}
+
+	linker := func(prefix string) timelineLoader {
+		return func(o *tools.PaginationOptions) ([]*Status, bool) {
+			return loadStatusByLinkerPagination(prefix, o)
+		}
+	}
+	loaders := []timelineLoader{
+		func(o *tools.PaginationOptions) ([]*Status, bool) { return loadInbox(user.ID, o) },
+		linker(stateKey(fmt.Sprintf("/%s/status/", user.ID))),
+	}
+	fanInPrefix := stateKey(fmt.Sprintf(tTimelineFanIn, ""))
+	err = IterateWithPrefix(fmt.Sprintf(tTimelineFanIn, ""), func(key string, _ []byte) {
+		uid := strings.TrimPrefix(key, fanInPrefix)
+		if uid != user.ID && followings[uid] {
+			loaders = append(loaders, linker(stateKey(fmt.Sprintf("/%s/status/", uid))))
+		}
+	})
+	if err != nil {
+		logrus.Error("timeline load fan-in users error: ", err)
+		return
+	}
+
+	// each source loads a share of the page, and more when it runs out
+	batch := opts.Size/int64(len(loaders)) + 1
+	sources := make([]*timelineSource, len(loaders))
+	for i, load := range loaders {
+		sources[i] = &timelineSource{load: load, after: opts.After, more: true}
+	}
+
+	seen := make(map[string]bool)
+	for int64(len(ss)) < opts.Size {
+		var next *timelineSource
+		for _, src := range sources {
+			src.fill(batch, opts.Ascend)
+			if len(src.buf) == 0 {
+				continue
+			}
+			if next == nil || newer(src.buf[0], next.buf[0]) != opts.Ascend {
+				next = src
+			}
+		}
+		if next == nil {
+			return ss, false
+		}
+		s := next.buf[0]
+		next.buf = next.buf[1:]
+		// unfollowed users remain in inbox, comments are not in timeline
+		if seen[s.ID] || !followings[s.User.ID] || len(s.RefStatus) > 0 {
+			continue
+		}
+		seen[s.ID] = true
+		ss = append(ss, s)
+	}
+	for _, src := range sources {
+		if len(src.buf) > 0 || src.more {
+			more = true
+		}
+	}
+	return
+}
+
+func newer(s1, s2 *Status) bool {
+	return s1.CreateRev > s2.CreateRev
+}
+
+type timelineLoader func(opts *tools.PaginationOptions) ([]*Status, bool)
+
+// timelineSource statuses of a timeline source ordered by create revision,
+// buffered from the cursor {after}
+type timelineSource struct {
+	load  timelineLoader
+	buf   []*Status
+	after int64
+	more  bool
+}
+
+// fill load the next batch when the buffer is drained
+func (src *timelineSource) fill(batch int64, ascend bool) {
+	if len(src.buf) > 0 || !src.more {
+		return
+	}
+	src.buf, src.more = src.load(&tools.PaginationOptions{After: src.after, Size: batch, Ascend: ascend})
+	if len(src.buf) > 0 {
+		src.after = src.buf[len(src.buf)-1].CreateRev
+	}
+}
+
+// inboxKey key of the status in the inbox of {uid}, inboxes are ordered by
+// the status create revision instead of the fan-out time
+func inboxKey(uid string, createRev int64) string {
+	return stateKey(fmt.Sprintf(tTimeline, uid, fmt.Sprintf("%020d", createRev)))
+}
+
+// loadInbox statuses fanned out to the inbox of {uid}, `opts.After` is a
+// status create revision like other status lists
+func loadInbox(uid string, opts *tools.PaginationOptions) (ss []*Status, more bool) {
+	prefix := stateKey(fmt.Sprintf(tTimeline, uid, ""))
+	// the inbox is in [prefix, prefix end)
+	start, end := prefix, prefix[:len(prefix)-1]+"0"
+	order := store.SortDescend
+	if opts.Ascend {
+		start = inboxKey(uid, opts.After+1)
+		order = store.SortAscend
+	} else if opts.After > 0 {
+		end = inboxKey(uid, opts.After)
+	}
+	resp, err := backend.Get(context.Background(), start,
+		store.WithRange(end),
+		store.WithLimit(opts.Size),
+		store.WithSort(store.SortByKey, order))
+	if err != nil {
+		logrus.Errorf("inbox %s pagination error: %s", uid, err)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		createRev, err := strconv.ParseInt(strings.TrimPrefix(string(kv.Key), prefix), 10, 64)
+		if err != nil {
+			logrus.Debugf("inbox key %s: %s", kv.Key, err)
+			continue
+		}
+		r, err := backend.Get(context.Background(), string(kv.Value))
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if len(r.Kvs) == 0 {
+			continue
+		}
+		s, err := unmarshalStatus(r.Kvs[0].Value, createRev)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		ss = append(ss, s)
+	}
+	return ss, resp.More
+}
+
+// fanOutStatus put status into (or remove from) inbox of the author's followers,
+// authors with followers more than the limit are marked as fan-in instead
+func fanOutStatus(s *Status, del bool) error {
+	if len(s.RefStatus) > 0 {
+		return nil
+	}
+	author := &User{ID: s.User.ID}
+	if !del && author.Followers() > config.Conf.Model.Timeline.FanOutFollowersLimit {
+		return backend.Put(context.Background(), stateKey(fmt.Sprintf(tTimelineFanIn, author.ID)), "")
+	}
+
+	statusKey := stateKey(fmt.Sprintf("/status/%s", s.ID))
+	followerPrefix := stateKey(fmt.Sprintf(tFollowUser, author.ID, ""))
+	var ops []store.Op
+	commit := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		_, err := backend.Txn(context.Background()).Then(ops...).Commit()
+		ops = ops[:0]
+		return err
+	}
+	var txnErr error
+	err := IterateWithPrefix(fmt.Sprintf(tFollowUser, author.ID, ""), func(key string, _ []byte) {
+		inboxKey := inboxKey(strings.TrimPrefix(key, followerPrefix), s.CreateRev)
+		if del {
+			ops = append(ops, store.OpDelete(inboxKey))
+		} else {
+			ops = append(ops, store.OpPut(inboxKey, statusKey))
+		}
+		if len(ops) >= fanOutBatchSize {
+			if err := commit(); err != nil {
+				txnErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	return txnErr
+}
+
+func keepTimelineFanOutLoop() {
+	mutex, err := backend.NewMutex(stateKey("/election/timeline"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Info("[timeline] act as leader")
+
+	if err := migrateInbox(); err != nil {
+		logrus.Error("[timeline] migrate inbox: ", err)
+		return
+	}
+
+	lastCreateRev, err := backend.Get(context.Background(), lastTimelineCreateRev)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	createRev := int64(0)
+
+	if lastCreateRev.Count > 0 {
+		createRev, err = strconv.ParseInt(string(lastCreateRev.Kvs[0].Value), 10, 64)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+	} else {
+		// fan out new statuses only on first run
+		resp, err := backend.Get(context.Background(), stateKey("/status/"),
+			store.WithPrefix(), store.WithLimit(1),
+			store.WithSort(store.SortByCreateRevision, store.SortDescend))
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if len(resp.Kvs) > 0 {
+			createRev = resp.Kvs[0].CreateRevision
+		}
+	}
+
+	rch := backend.Watch(context.Background(), stateKey("/status/"),
+		store.WithPrefix(), store.WithPrevKV())
+
+	// statuses created when the leader was absent
+	for {
+		resp, err := backend.Get(context.Background(), stateKey("/status/"),
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(createRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for _, kv := range resp.Kvs {
+			applyTimelineFanOut(kv, false)
+			createRev = kv.CreateRevision
+		}
+		if !resp.More {
+			break
+		}
+	}
+
+	for wresp := range rch {
+		for _, ev := range wresp.Events {
+			if ev.IsCreate() || ev.Type == store.EventTypeDelete {
+				del := ev.Type == store.EventTypeDelete
+				kv := ev.Kv
+				if del {
+					kv = ev.PrevKv
+				} else if kv.CreateRevision <= createRev {
+					continue
+				}
+				applyTimelineFanOut(kv, del)
+			}
+		}
+	}
+}
+
+func applyTimelineFanOut(kv *store.KeyValue, del bool) {
+	s, err := unmarshalStatus(kv.Value, kv.CreateRevision)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.Debugf("[timeline] fan out %s", kv.Key)
+	for i := 0; i < 10; i++ {
+		if err = fanOutStatus(s, del); err == nil {
+			break
+		}
+		logrus.Warnf("[timeline] retry fan out %s: %s", s.ID, err)
+	}
+	if err != nil {
+		logrus.Errorf("[timeline] fan out %s error: %s", s.ID, err)
+	}
+	if !del {
+		err = backend.Put(context.Background(), lastTimelineCreateRev, fmt.Sprintf("%d", kv.CreateRevision))
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// migrateInbox rekey inbox entries put by status id before inboxes were
+// ordered by the status create revision
+func migrateInbox() error {
+	migratedKey := stateKey("/timeline-inbox-migrated")
+	if countKeys(migratedKey) > 0 {
+		return nil
+	}
+	var ops []store.Op
+	var txnErr error
+	prefix := stateKey(fmt.Sprintf(tTimeline, "", ""))
+	err := IterateWithPrefix(fmt.Sprintf(tTimeline, "", ""), func(key string, value []byte) {
+		uid, id, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		if _, err := strconv.ParseInt(id, 10, 64); err == nil && len(id) == 20 {
+			return
+		}
+		ops = append(ops, store.OpDelete(key))
+		if _, createRev := getStatusBin(id); createRev > 0 {
+			ops = append(ops, store.OpPut(inboxKey(uid, createRev), string(value)))
+		}
+		if len(ops) >= fanOutBatchSize {
+			if _, err := backend.Txn(context.Background()).Then(ops...).Commit(); err != nil {
+				txnErr = err
+			}
+			ops = ops[:0]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if txnErr != nil {
+		return txnErr
+	}
+	ops = append(ops, store.OpPut(migratedKey, ""))
+	_, err = backend.Txn(context.Background()).Then(ops...).Commit()
+	return err
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rkonfj/lln/tools"
+)
+
+var (
+	SessionKindToken string = "token"
+
+	ScopeStatusWrite    string = "status:write"
+	ScopeLikesWrite     string = "likes:write"
+	ScopeBookmarksRead  string = "bookmarks:read"
+	ScopeBookmarksWrite string = "bookmarks:write"
+	ScopeFollowsWrite   string = "follows:write"
+	ScopeTimelineRead   string = "timeline:read"
+	ScopeMessagesRead   string = "messages:read"
+	ScopeMessagesWrite  string = "messages:write"
+	ScopeProfileWrite   string = "profile:write"
+	ScopeMediaWrite     string = "media:write"
+	ScopeReportsWrite   string = "reports:write"
+	ScopePollsWrite     string = "polls:write"
+
+	Scopes []string = []string{ScopeStatusWrite, ScopeLikesWrite, ScopeBookmarksRead,
+		ScopeBookmarksWrite, ScopeFollowsWrite, ScopeTimelineRead, ScopeMessagesRead,
+		ScopeMessagesWrite, ScopeProfileWrite, ScopeMediaWrite, ScopeReportsWrite, ScopePollsWrite}
+
+	// personal access tokens a user can hold
+	maxTokensPerUser int = 20
+)
+
+type TokenOptions struct {
+	Name   string
+	Scopes []string
+	// TTL the token never expires when 0
+	TTL time.Duration
+}
+
+// CreateToken create a personal access token of user {uid}. the api key
+// of the returned session is only available here
+func CreateToken(uid string, opts *TokenOptions) (*Session, error) {
+	if len(opts.Name) == 0 || len([]rune(opts.Name)) > 64 {
+		return nil, errors.New("name is required and at most 64 characters")
+	}
+	if len(opts.Scopes) == 0 {
+		return nil, errors.New("scopes are required")
+	}
+	for _, scope := range opts.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("invalid scope %s", scope)
+		}
+	}
+	if opts.TTL < 0 {
+		return nil, errors.New("invalid ttl")
+	}
+	if len(ListTokens(uid)) >= maxTokensPerUser {
+		return nil, fmt.Errorf("maximum %d tokens", maxTokensPerUser)
+	}
+	u := UserByID(uid)
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	s := &Session{
+		Kind:      SessionKindToken,
+		TokenName: opts.Name,
+		Scopes:    tools.Unique(opts.Scopes),
+	}
+	if opts.TTL > 0 {
+		s.ExpireTime = time.Now().Add(opts.TTL)
+	}
+	s.fillUser(u)
+	if err := DefaultSessionManager.Create(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListTokens personal access tokens of user {uid}
+func ListTokens(uid string) (tokens []*Session) {
+	for _, s := range DefaultSessionManager.List(uid) {
+		if s.IsToken() {
+			tokens = append(tokens, s)
+		}
+	}
+	return
+}
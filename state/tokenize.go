@@ -0,0 +1,71 @@
+package state
+
+import (
+	"strings"
+	"unicode"
+)
+
+type token struct {
+	term string
+	pos  int
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+// tokenize split text into lowercase terms. latin words and numbers are one
+// term each, CJK runs are segmented to bigrams. every term carries its
+// position, a word takes one position and a CJK character takes one position.
+// when indexing, CJK unigrams are emitted as well so that single character
+// queries can match
+func tokenize(text string, indexing bool) (tokens []token) {
+	pos := 0
+	var word []rune
+	var cjk []rune
+
+	flushWord := func() {
+		if len(word) == 0 {
+			return
+		}
+		tokens = append(tokens, token{term: strings.ToLower(string(word)), pos: pos})
+		pos++
+		word = word[:0]
+	}
+
+	flushCJK := func() {
+		if len(cjk) == 0 {
+			return
+		}
+		for i := range cjk {
+			if indexing || len(cjk) == 1 {
+				tokens = append(tokens, token{term: string(cjk[i]), pos: pos + i})
+			}
+			if i+1 < len(cjk) {
+				tokens = append(tokens, token{term: string(cjk[i : i+2]), pos: pos + i})
+			}
+		}
+		pos += len(cjk)
+		cjk = cjk[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return
+}
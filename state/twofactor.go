@@ -0,0 +1,342 @@
+package state
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	tTOTP        string = "/totp/%s"
+	tMFAFailures string = "/mfa-failures/%s/"
+
+	// preSessionTTL time a user has to enter the second factor after login
+	preSessionTTL time.Duration = 5 * time.Minute
+
+	totpIssuer string           = "lln"
+	totpPeriod int64            = 30
+	totpDigits int              = 6
+	totpSkew   int64            = 1
+	totpB32    *base32.Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	recoveryCodeCount int = 10
+	// a user can fail the second factor at most 10 times in 15 minutes
+	maxMFAFailures    int   = 10
+	mfaFailuresWindow int64 = 900
+)
+
+// TOTP the totp secret of a user, it's pending until enabled with a code
+type TOTP struct {
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+	// RecoveryCodes sha256 of unused recovery codes
+	RecoveryCodes []string `json:"recoveryCodes"`
+	// LastStep time step of the last accepted code, codes can't be reused
+	LastStep int64 `json:"lastStep"`
+	ModRev   int64 `json:"-"`
+}
+
+// TOTPEnrollment secret and otpauth uri to be added to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func totpKey(uid string) string {
+	return stateKey(fmt.Sprintf(tTOTP, uid))
+}
+
+func getTOTP(uid string) (*TOTP, error) {
+	resp, err := backend.Get(context.Background(), totpKey(uid))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	t := &TOTP{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, t); err != nil {
+		return nil, err
+	}
+	t.ModRev = resp.Kvs[0].ModRevision
+	return t, nil
+}
+
+// save the totp if not changed since loaded
+func (t *TOTP) save(uid string) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(totpKey(uid)), "=", t.ModRev)).
+		Then(store.OpPut(totpKey(uid), string(b))).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrTryAgainLater
+	}
+	return nil
+}
+
+// TOTPEnabled determine if user {uid} logs in with two-factor authentication
+func TOTPEnabled(uid string) bool {
+	t, err := getTOTP(uid)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	return t != nil && t.Enabled
+}
+
+// RecoveryCodesLeft unused recovery codes of user {uid}
+func RecoveryCodesLeft(uid string) int {
+	t, err := getTOTP(uid)
+	if err != nil || t == nil {
+		return 0
+	}
+	return len(t.RecoveryCodes)
+}
+
+// EnrollTOTP generate a new pending totp secret of user u
+func EnrollTOTP(u *User) (*TOTPEnrollment, error) {
+	t, err := getTOTP(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && t.Enabled {
+		return nil, ErrTOTPEnabled
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	pending := &TOTP{Secret: totpB32.EncodeToString(secret)}
+	if t != nil {
+		pending.ModRev = t.ModRev
+	}
+	if err := pending.save(u.ID); err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("secret", pending.Secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("period", strconv.FormatInt(totpPeriod, 10))
+	q.Set("digits", strconv.Itoa(totpDigits))
+	label := url.PathEscape(fmt.Sprintf("%s:%s", totpIssuer, u.UniqueName))
+	return &TOTPEnrollment{
+		Secret: pending.Secret,
+		URI:    fmt.Sprintf("otpauth://totp/%s?%s", label, q.Encode()),
+	}, nil
+}
+
+// EnableTOTP enable the pending totp of user {uid} with a code from the
+// authenticator app. the recovery codes are only returned here
+func EnableTOTP(uid, code string) ([]string, error) {
+	t, err := getTOTP(uid)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if t.Enabled {
+		return nil, ErrTOTPEnabled
+	}
+	step, ok := t.validate(code, time.Now())
+	if !ok {
+		return nil, ErrWrongCode
+	}
+	codes := t.newRecoveryCodes()
+	t.Enabled = true
+	t.LastStep = step
+	if err := t.save(uid); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP disable two-factor authentication of user {uid}, a totp or
+// recovery code is required
+func DisableTOTP(uid, code string) error {
+	if _, err := VerifySecondFactor(uid, code); err != nil {
+		return err
+	}
+	return Del(fmt.Sprintf(tTOTP, uid))
+}
+
+// RegenerateRecoveryCodes replace recovery codes of user {uid}, a totp or
+// recovery code is required, so a user without the authenticator can get
+// new codes with the last one
+func RegenerateRecoveryCodes(uid, code string) ([]string, error) {
+	t, err := VerifySecondFactor(uid, code)
+	if err != nil {
+		return nil, err
+	}
+	codes := t.newRecoveryCodes()
+	if err := t.save(uid); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor verify a totp or recovery code of user {uid}, the
+// code is consumed
+func VerifySecondFactor(uid, code string) (*TOTP, error) {
+	if mfaFailures(uid) >= maxMFAFailures {
+		return nil, ErrTooManyAttempts
+	}
+	t, err := getTOTP(uid)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || !t.Enabled {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if step, ok := t.validate(code, time.Now()); ok && step > t.LastStep {
+		t.LastStep = step
+	} else if i := t.recoveryCode(code); i >= 0 {
+		t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+	} else {
+		recordMFAFailure(uid)
+		return nil, ErrWrongCode
+	}
+	if err := t.save(uid); err != nil {
+		return nil, err
+	}
+	t, err = getTOTP(uid)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// VerifyLogin exchange the pre-session for a session with the second
+// factor {code}
+func VerifyLogin(pre *Session, code string, client *SessionClient) (*Session, error) {
+	if !pre.MFAPending {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if _, err := VerifySecondFactor(pre.ID, code); err != nil {
+		return nil, err
+	}
+	u := UserByID(pre.ID)
+	if u == nil {
+		return nil, fmt.Errorf("user %s not found", pre.ID)
+	}
+	if err := DefaultSessionManager.Revoke(pre.SID); err != nil {
+		return nil, err
+	}
+	return newLoginSession(u, client, true)
+}
+
+// UpgradeSession replace all sessions of user u with a session verified
+// by the second factor, used after two-factor authentication is enabled
+func UpgradeSession(u *User, client *SessionClient) (*Session, error) {
+	if err := DefaultSessionManager.Expire(u.ID); err != nil {
+		return nil, err
+	}
+	return newLoginSession(u, client, true)
+}
+
+// validate the code at time {now}, the matched time step is returned
+func (t *TOTP) validate(code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	secret, err := totpB32.DecodeString(t.Secret)
+	if err != nil {
+		logrus.Error("invalid totp secret: ", err)
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode rfc 6238 code of time step {step}
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+// newRecoveryCodes replace the recovery codes, plain codes are returned
+func (t *TOTP) newRecoveryCodes() (codes []string) {
+	t.RecoveryCodes = nil
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(randomString(10))
+		codes = append(codes, code)
+		t.RecoveryCodes = append(t.RecoveryCodes, hashRecoveryCode(code))
+	}
+	return
+}
+
+// recoveryCode index of the recovery code, -1 if not found
+func (t *TOTP) recoveryCode(code string) int {
+	hash := hashRecoveryCode(code)
+	for i, c := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hash)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func mfaFailures(uid string) int {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tMFAFailures, uid)),
+		store.WithPrefix(), store.WithCountOnly())
+	if err != nil {
+		logrus.Error(err)
+		return 0
+	}
+	return int(resp.Count)
+}
+
+// recordMFAFailure each failure is a key living for the failures window
+func recordMFAFailure(uid string) {
+	lease, err := backend.Grant(context.Background(), mfaFailuresWindow)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	key := stateKey(fmt.Sprintf(tMFAFailures, uid)) + randomString(8)
+	if err := backend.Put(context.Background(), key, "", store.WithLease(lease)); err != nil {
+		logrus.Error(err)
+	}
+}
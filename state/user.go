@@ -6,13 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/decred/base58"
+	"github.com/rkonfj/lln/state/store"
 	"github.com/rkonfj/lln/tools"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 var (
@@ -29,6 +31,8 @@ type ModifiableUser struct {
 	Bg         string `json:"bg"`
 	Locale     string `json:"locale"`
 	Bio        string `json:"bio"`
+	// Private switch the account to private or public, unchanged when nil
+	Private *bool `json:"private,omitempty"`
 }
 
 type User struct {
@@ -42,6 +46,7 @@ type User struct {
 	CreateTime   time.Time `json:"createTime"`
 	Bio          string    `json:"bio"`
 	VerifiedCode int64     `json:"verifiedCode"`
+	Private      bool      `json:"private"`
 	ModRev       int64     `json:"-"`
 }
 
@@ -52,16 +57,16 @@ func (u *User) Modify(mu ModifiableUser) error {
 	}
 	key := stateKey(fmt.Sprintf(tUser, u.ID))
 
-	ops := []clientv3.Op{}
-	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", u.ModRev)}
+	ops := []store.Op{}
+	cmps := []store.Cmp{store.Compare(store.ModRevision(key), "=", u.ModRev)}
 	if len(mu.UniqueName) > 0 {
 		oldUniqueNameKey := stateKey(fmt.Sprintf("/%s/%s", tools.UniqueName, u.UniqueName))
 		uniqueNameKey := stateKey(fmt.Sprintf("/%s/%s", tools.UniqueName, mu.UniqueName))
 		u.UniqueName = mu.UniqueName
 
-		cmps = append(cmps, clientv3.Compare(clientv3.Version(uniqueNameKey), "=", 0))
-		ops = append(ops, clientv3.OpDelete(oldUniqueNameKey))
-		ops = append(ops, clientv3.OpPut(uniqueNameKey, key))
+		cmps = append(cmps, store.Compare(store.Version(uniqueNameKey), "=", 0))
+		ops = append(ops, store.OpDelete(oldUniqueNameKey))
+		ops = append(ops, store.OpPut(uniqueNameKey, key))
 	}
 
 	if len(mu.Name) > 0 {
@@ -81,20 +86,37 @@ func (u *User) Modify(mu ModifiableUser) error {
 	}
 
 	u.Bio = mu.Bio
+	wasPrivate := u.Private
+	if mu.Private != nil {
+		u.Private = *mu.Private
+	}
 
 	b, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	ops = append(ops, clientv3.OpPut(key, string(b)))
+	ops = append(ops, store.OpPut(key, string(b)))
+	if mu.Private != nil {
+		privateKey := stateKey(fmt.Sprintf(tPrivateUser, u.ID))
+		if u.Private {
+			ops = append(ops, store.OpPut(privateKey, ""))
+		} else {
+			ops = append(ops, store.OpDelete(privateKey))
+		}
+	}
+	ops = append(ops, reindexUserOps(u)...)
 
-	txnResp, err := etcdClient.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
+	txnResp, err := backend.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
 	if err != nil {
 		return err
 	}
 	if !txnResp.Succeeded {
 		return errors.New("failed. unique name already exists")
 	}
+	if wasPrivate && !u.Private {
+		// new requests fail since the account is public, pending ones are approved
+		return approveFollowRequests(u.ToActUser())
+	}
 	return nil
 }
 
@@ -103,6 +125,74 @@ func (u *User) ListStatus(opts *tools.PaginationOptions) (ss []*Status, more boo
 	return loadStatusByLinkerPagination(stateKey(fmt.Sprintf("/%s/status/", u.ID)), opts)
 }
 
+// Follow a follow relation, CreateRev is the cursor for pagination
+type Follow struct {
+	User      *ActUser `json:"user"`
+	CreateRev int64    `json:"createRev"`
+}
+
+// ListFollowers list users following me
+func (u *User) ListFollowers(opts *tools.PaginationOptions) (follows []*Follow, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tFollowUser, u.ID, "")), opts)
+	return followsOf(kvs, stateKey(fmt.Sprintf(tFollowUser, u.ID, ""))), more
+}
+
+// ListFollowings list users I'm following
+func (u *User) ListFollowings(opts *tools.PaginationOptions) (follows []*Follow, more bool) {
+	kvs, more := loadByPagination(stateKey(fmt.Sprintf(tFollowingUser, u.ID, "")), opts)
+	return followsOf(kvs, stateKey(fmt.Sprintf(tFollowingUser, u.ID, ""))), more
+}
+
+// followsOf follows of relation keys ending with the user id, users are
+// loaded as they are now instead of when they followed
+func followsOf(kvs []*store.KeyValue, prefix string) (follows []*Follow) {
+	var ids []string
+	for _, kv := range kvs {
+		ids = append(ids, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+	users := usersByIDs(ids)
+	for i, kv := range kvs {
+		user := users[ids[i]]
+		if user == nil {
+			logrus.Errorf("not found user of %s", kv.Key)
+			continue
+		}
+		follows = append(follows, &Follow{User: user.ToActUser(), CreateRev: kv.CreateRevision})
+	}
+	return
+}
+
+// usersByIDs load users concurrently, missing users are absent in the map
+func usersByIDs(ids []string) map[string]*User {
+	users := make(map[string]*User, len(ids))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range tools.Unique(ids) {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if u := UserByID(id); u != nil {
+				lock.Lock()
+				users[id] = u
+				lock.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	return users
+}
+
+// ToActUser the user as actor
+func (u *User) ToActUser() *ActUser {
+	return &ActUser{
+		ID:           u.ID,
+		UniqueName:   u.UniqueName,
+		Name:         u.Name,
+		Picture:      u.Picture,
+		VerifiedCode: u.VerifiedCode,
+	}
+}
+
 // FollowingBy determine if {uid} is following me
 func (u *User) FollowingBy(user *ActUser) bool {
 	if user == nil {
@@ -113,8 +203,8 @@ func (u *User) FollowingBy(user *ActUser) bool {
 
 // Followers follower count
 func (u *User) Followers() int64 {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf(tFollowUser, u.ID, "")),
-		clientv3.WithPrefix(), clientv3.WithCountOnly())
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tFollowUser, u.ID, "")),
+		store.WithPrefix(), store.WithCountOnly())
 	if err != nil {
 		logrus.Errorf("FollowingBy etcd error: %s", err)
 		return 0
@@ -124,8 +214,8 @@ func (u *User) Followers() int64 {
 
 // Followings following count
 func (u *User) Followings() int64 {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf(tFollowingUser, u.ID, "")),
-		clientv3.WithPrefix(), clientv3.WithCountOnly())
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tFollowingUser, u.ID, "")),
+		store.WithPrefix(), store.WithCountOnly())
 	if err != nil {
 		logrus.Errorf("Followings etcd error: %s", err)
 		return 0
@@ -135,9 +225,9 @@ func (u *User) Followings() int64 {
 
 // Tweets tweet count
 func (u *User) Tweets() int64 {
-	resp, err := etcdClient.KV.Get(context.Background(),
+	resp, err := backend.Get(context.Background(),
 		stateKey(fmt.Sprintf("/%s/status/", u.ID)),
-		clientv3.WithPrefix(), clientv3.WithCountOnly())
+		store.WithPrefix(), store.WithCountOnly())
 	if err != nil {
 		logrus.Errorf("Tweets etcd error: %s", err)
 		return 0
@@ -145,29 +235,22 @@ func (u *User) Tweets() int64 {
 	return resp.Count
 }
 
-func (u *User) SetVerified(code int64) error {
+func (u *User) SetVerified(code int64, audit *AuditOptions) error {
 	key := stateKey(fmt.Sprintf(tUser, u.ID))
 	u.VerifiedCode = code
 	b, _ := json.Marshal(u)
-	resp, err := etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", u.ModRev)).
-		Then(clientv3.OpPut(key, string(b))).Commit()
-	if err != nil {
-		return err
-	}
-	if !resp.Succeeded {
-		return errors.New("try again later")
-	}
-	return nil
+	// the verified code is part of the rank in the user index
+	return commitAudited(audit,
+		[]store.Cmp{store.Compare(store.ModRevision(key), "=", u.ModRev)},
+		append(reindexUserOps(u), store.OpPut(key, string(b)))...)
 }
 
-func (u *User) Disable() error {
-	_, err := etcdClient.KV.Put(context.Background(), stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)), "")
-	return err
+func (u *User) Disable(audit *AuditOptions) error {
+	return commitAudited(audit, nil, store.OpPut(stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)), ""))
 }
 
 func (u *User) Disabled() bool {
-	r, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)))
+	r, err := backend.Get(context.Background(), stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)))
 	if err != nil {
 		logrus.Error(err)
 		return false
@@ -175,13 +258,18 @@ func (u *User) Disabled() bool {
 	return r.Count == 1
 }
 
-func (u *User) Enable() error {
-	_, err := etcdClient.KV.Delete(context.Background(), stateKey(fmt.Sprintf("/disabled/user/%s", u.ID)))
-	return err
+// Enable enable the user, users whose account is being deleted stay disabled
+func (u *User) Enable(audit *AuditOptions) error {
+	if accountDeleting(u.ID) {
+		return ErrAccountDeleting
+	}
+	return commitAudited(audit,
+		[]store.Cmp{store.Compare(store.Version(stateKey(fmt.Sprintf(tAccountDeletion, u.ID))), "=", 0)},
+		store.OpDelete(stateKey(fmt.Sprintf("/disabled/user/%s", u.ID))))
 }
 
 func Followed(u1, u2 string) bool {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf(tFollowUser, u2, u1)), clientv3.WithCountOnly())
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tFollowUser, u2, u1)), store.WithCountOnly())
 	if err != nil {
 		logrus.Errorf("FollowingBy error: %s", err)
 		return false
@@ -210,7 +298,7 @@ func UserByEmail(email string) *User {
 }
 
 func UserByID(userID string) *User {
-	resp, err := etcdClient.KV.Get(context.Background(), stateKey(fmt.Sprintf(tUser, userID)))
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tUser, userID)))
 	return castUser(resp, err)
 }
 
@@ -218,7 +306,7 @@ func UserByUniqueName(uniqueName string) *User {
 	return castUser(getPointerValue(stateKey(fmt.Sprintf("/uniqueName/%s", uniqueName))))
 }
 
-func castUser(resp *clientv3.GetResponse, err error) *User {
+func castUser(resp *store.GetResponse, err error) *User {
 	if err != nil {
 		logrus.Debug(err)
 		return nil
@@ -261,11 +349,12 @@ func NewUser(opts *UserOptions) (u *User, err error) {
 		if err != nil {
 			return nil, err
 		}
-		resp, err := etcdClient.Txn(context.Background()).
-			If(clientv3.Compare(clientv3.Version(uniqueNameKey), "=", 0)).
-			Then(clientv3.OpPut(userKey, string(b)),
-				clientv3.OpPut(emailKey, userKey),
-				clientv3.OpPut(uniqueNameKey, userKey)).
+		ops := []store.Op{store.OpPut(userKey, string(b)),
+			store.OpPut(emailKey, userKey),
+			store.OpPut(uniqueNameKey, userKey)}
+		resp, err := backend.Txn(context.Background()).
+			If(store.Compare(store.Version(uniqueNameKey), "=", 0)).
+			Then(append(ops, indexUserOps(u)...)...).
 			Commit()
 		if err != nil {
 			logrus.Debugf("name as uniqueName error: %s, fallback to generate", err)
@@ -281,10 +370,11 @@ func NewUser(opts *UserOptions) (u *User, err error) {
 	if err != nil {
 		return
 	}
-	resp, err := etcdClient.Txn(context.Background()).
-		Then(clientv3.OpPut(userKey, string(b)),
-			clientv3.OpPut(emailKey, userKey),
-			clientv3.OpPut(uniqueNameKey, userKey)).
+	ops := []store.Op{store.OpPut(userKey, string(b)),
+		store.OpPut(emailKey, userKey),
+		store.OpPut(uniqueNameKey, userKey)}
+	resp, err := backend.Txn(context.Background()).
+		Then(append(ops, indexUserOps(u)...)...).
 		Commit()
 	if err != nil {
 		return nil, err
@@ -307,17 +397,43 @@ func FollowUser(user *ActUser, uniqueName string) error {
 		return err
 	}
 
-	delOps := []clientv3.Op{clientv3.OpDelete(followUserKey), clientv3.OpDelete(followingUserKey)}
-	newOps := []clientv3.Op{clientv3.OpPut(followUserKey, string(b)),
-		clientv3.OpPut(followingUserKey, stateKey(fmt.Sprintf(tUser, targetUser.ID)))}
+	if Followed(user.ID, targetUser.ID) {
+		_, err = backend.Txn(context.Background()).
+			Then(store.OpDelete(followUserKey), store.OpDelete(followingUserKey)).Commit()
+		if err == nil {
+			rerankUser(targetUser.ID)
+		}
+		return err
+	}
+
+	if targetUser.Private {
+		return requestFollow(user, targetUser)
+	}
+
+	newOps := []store.Op{store.OpPut(followUserKey, string(b)),
+		store.OpPut(followingUserKey, stateKey(fmt.Sprintf(tUser, targetUser.ID)))}
 	newOps = append(newOps, newMessageOps(MsgOptions{
 		from:     user,
 		toUID:    targetUser.ID,
 		msgType:  MsgTypeFollow,
 		targetID: targetUser.ID,
 	})...)
-	_, err = etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.Version(followUserKey), ">", 0)).
-		Then(delOps...).Else(newOps...).Commit()
-	return err
+	// the account may be switched to private meanwhile
+	privateKey := stateKey(fmt.Sprintf(tPrivateUser, targetUser.ID))
+	resp, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(followUserKey), "=", 0),
+			store.Compare(store.Version(privateKey), "=", 0),
+			notBlocked(targetUser.ID, user.ID)).
+		Then(newOps...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		if countKeys(privateKey) > 0 {
+			return requestFollow(user, targetUser)
+		}
+		return blockedOr(ErrTryAgainLater, blockKey(targetUser.ID, user.ID))
+	}
+	rerankUser(targetUser.ID)
+	return nil
 }
@@ -0,0 +1,335 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rkonfj/lln/state/store"
+	"github.com/rkonfj/lln/tools"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// tIndexUser the value is the rank of the user, see userRank
+	tIndexUser      string = "/index/user/%s/%s"
+	tIndexUserTerms string = "/index/userterms/%s"
+	// index entries of the highest rank scanned per user search pass
+	maxUserCandidates int64 = 256
+)
+
+const (
+	matchExact = iota
+	matchPrefix
+	matchFuzzy
+)
+
+// normalizeUserTerm lowercase s and drop all chars except letters and digits
+func normalizeUserTerm(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// userTerms terms a user can be found by: unique name, display name and
+// every word in display name
+func userTerms(u *User) []string {
+	terms := []string{normalizeUserTerm(u.UniqueName), normalizeUserTerm(u.Name)}
+	for _, w := range strings.Fields(u.Name) {
+		terms = append(terms, normalizeUserTerm(w))
+	}
+	var ret []string
+	for _, t := range terms {
+		if len(t) > 0 {
+			ret = append(ret, t)
+		}
+	}
+	return tools.Unique(ret)
+}
+
+// userRank rank of user u in the user index, verified users first then the
+// most followed. it's fixed width so that ranks are sorted by value
+func userRank(u *User) string {
+	return fmt.Sprintf("%019d%019d", max(u.VerifiedCode, 0), u.Followers())
+}
+
+// indexUserOps build ops to put user into the user index
+func indexUserOps(u *User) []store.Op {
+	rank := userRank(u)
+	terms := userTerms(u)
+	var ops []store.Op
+	for _, t := range terms {
+		ops = append(ops, store.OpPut(stateKey(fmt.Sprintf(tIndexUser, t, u.ID)), rank))
+	}
+	b, _ := json.Marshal(terms)
+	return append(ops, store.OpPut(stateKey(fmt.Sprintf(tIndexUserTerms, u.ID)), string(b)))
+}
+
+// indexedUserTerms terms of user uid in the user index
+func indexedUserTerms(uid string) (terms []string) {
+	resp, err := backend.Get(context.Background(), stateKey(fmt.Sprintf(tIndexUserTerms, uid)))
+	if err != nil {
+		logrus.Error("load user terms error: ", err)
+		return
+	}
+	if resp.Count == 0 {
+		return
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &terms); err != nil {
+		logrus.Error("load user terms error: ", err)
+	}
+	return
+}
+
+// unindexUserOps build ops to remove user from the user index
+func unindexUserOps(uid string) []store.Op {
+	ops := []store.Op{store.OpDelete(stateKey(fmt.Sprintf(tIndexUserTerms, uid)))}
+	for _, t := range indexedUserTerms(uid) {
+		ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tIndexUser, t, uid))))
+	}
+	return ops
+}
+
+// reindexUserOps build ops to replace index entries of user u. a key can
+// not be deleted and put in the same txn, so only stale terms are deleted
+func reindexUserOps(u *User) []store.Op {
+	newTerms := map[string]bool{}
+	for _, t := range userTerms(u) {
+		newTerms[t] = true
+	}
+	var ops []store.Op
+	for _, t := range indexedUserTerms(u.ID) {
+		if !newTerms[t] {
+			ops = append(ops, store.OpDelete(stateKey(fmt.Sprintf(tIndexUser, t, u.ID))))
+		}
+	}
+	return append(ops, indexUserOps(u)...)
+}
+
+// rerankUser refresh the rank of user {uid} in the user index, it's called
+// when followers of the user changed
+func rerankUser(uid string) {
+	u := UserByID(uid)
+	if u == nil {
+		return
+	}
+	_, err := backend.Txn(context.Background()).
+		If(store.Compare(store.Version(stateKey(fmt.Sprintf(tIndexUserTerms, uid))), ">", 0),
+			store.Compare(store.ModRevision(stateKey(fmt.Sprintf(tUser, uid))), "=", u.ModRev)).
+		Then(indexUserOps(u)...).Commit()
+	if err != nil {
+		logrus.Errorf("rerank user %s error: %s", uid, err)
+	}
+}
+
+// editDistance optimal string alignment distance between a and b, it's the
+// levenshtein distance counting adjacent transpositions as one edit
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// fuzzyPrefixMatch determine if term starts with something close to query
+func fuzzyPrefixMatch(query, term []rune) bool {
+	maxDistance := 1
+	if len(query) >= 6 {
+		maxDistance = 2
+	}
+	for l := len(query) - maxDistance; l <= len(query)+maxDistance; l++ {
+		if l <= 0 || l > len(term) {
+			continue
+		}
+		if editDistance(query, term[:l]) <= maxDistance {
+			return true
+		}
+	}
+	return false
+}
+
+type userCandidate struct {
+	uid   string
+	match int
+	rank  string
+}
+
+// SearchUsers find users by unique name or display name prefix, tolerating
+// small typos. results are ranked by match quality, then by the rank in the
+// index. disabled users are not found
+func SearchUsers(query string, size int64) (users []*ActUser) {
+	q := normalizeUserTerm(query)
+	if len(q) == 0 {
+		return
+	}
+	qRunes := []rune(q)
+
+	prefixLen := len(stateKey("/index/user/"))
+	best := make(map[string]*userCandidate)
+	collect := func(prefix string, fuzzy bool) error {
+		resp, err := backend.Get(context.Background(),
+			stateKey(fmt.Sprintf("/index/user/%s", prefix)),
+			store.WithPrefix(), store.WithLimit(maxUserCandidates),
+			store.WithSort(store.SortByValue, store.SortDescend))
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)[prefixLen:]
+			i := strings.LastIndex(key, "/")
+			if i < 0 {
+				continue
+			}
+			term, uid := key[:i], key[i+1:]
+			match := -1
+			switch {
+			case term == q:
+				match = matchExact
+			case strings.HasPrefix(term, q):
+				match = matchPrefix
+			case fuzzy && fuzzyPrefixMatch(qRunes, []rune(term)):
+				match = matchFuzzy
+			}
+			if match < 0 {
+				continue
+			}
+			if c, ok := best[uid]; !ok || match < c.match {
+				best[uid] = &userCandidate{uid: uid, match: match, rank: string(kv.Value)}
+			}
+		}
+		return nil
+	}
+
+	if err := collect(q, false); err != nil {
+		logrus.Error("search users error: ", err)
+		return
+	}
+	// not enough, tolerate typos in candidates sharing the first character
+	if int64(len(best)) < size {
+		if err := collect(string(qRunes[0]), true); err != nil {
+			logrus.Error("search users error: ", err)
+			return
+		}
+	}
+
+	var candidates []*userCandidate
+	for _, c := range best {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.match != b.match {
+			return a.match < b.match
+		}
+		if a.rank != b.rank {
+			return a.rank > b.rank
+		}
+		return a.uid < b.uid
+	})
+
+	// users are loaded only until the page is full
+	for _, c := range candidates {
+		if int64(len(users)) >= size {
+			break
+		}
+		u := UserByID(c.uid)
+		if u == nil || u.Disabled() {
+			continue
+		}
+		users = append(users, u.ToActUser())
+	}
+	return
+}
+
+// rebuildUserIndex index users created before user search was available
+func rebuildUserIndex() {
+	mutex, err := backend.NewMutex(stateKey("/election/index/user"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Close()
+
+	if err := mutex.Lock(context.Background()); err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer mutex.Unlock(context.Background())
+
+	// users indexed before ranks were stored in the index are indexed again
+	rankedKey := stateKey("/index/user-ranked")
+	ranked := countKeys(rankedKey) > 0
+	indexed, failed := 0, false
+	var lastCreateRev int64
+	for {
+		resp, err := backend.Get(context.Background(), stateKey("/user/"),
+			store.WithPrefix(),
+			store.WithLimit(1024),
+			store.WithMinCreateRev(lastCreateRev+1),
+			store.WithSort(store.SortByCreateRevision, store.SortAscend))
+		if err != nil {
+			logrus.Error("[user-index] ", err)
+			return
+		}
+		for _, kv := range resp.Kvs {
+			lastCreateRev = kv.CreateRevision
+			// skip follow relations under the user prefix
+			if strings.Count(string(kv.Key), "/") != strings.Count(stateKey(fmt.Sprintf(tUser, "")), "/") {
+				continue
+			}
+			u := &User{}
+			if err := json.Unmarshal(kv.Value, u); err != nil {
+				logrus.Debug(err)
+				continue
+			}
+			cmps := []store.Cmp{store.Compare(store.ModRevision(string(kv.Key)), "=", kv.ModRevision)}
+			if ranked {
+				termsKey := stateKey(fmt.Sprintf(tIndexUserTerms, u.ID))
+				cmps = append(cmps, store.Compare(store.Version(termsKey), "=", 0))
+			}
+			r, err := backend.Txn(context.Background()).
+				If(cmps...).Then(reindexUserOps(u)...).Commit()
+			if err != nil {
+				logrus.Error("[user-index] ", err)
+				failed = true
+				continue
+			}
+			if r.Succeeded {
+				indexed++
+			}
+		}
+		if !resp.More {
+			break
+		}
+	}
+	if !ranked && !failed {
+		if err := backend.Put(context.Background(), rankedKey, ""); err != nil {
+			logrus.Error("[user-index] ", err)
+		}
+	}
+	logrus.Infof("[user-index] %d users indexed", indexed)
+}
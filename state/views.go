@@ -5,22 +5,22 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/rkonfj/lln/state/store"
 	"github.com/sirupsen/logrus"
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func updateViewCount(statusID string, count int) error {
 	key := stateKey(fmt.Sprintf("/views/status/%s", statusID))
-	resp, err := etcdClient.KV.Get(context.Background(), key)
+	resp, err := backend.Get(context.Background(), key)
 	if err != nil {
 		return err
 	}
 
 	if resp.Count == 0 {
 		logrus.Debug("create views key ", key)
-		r, err := etcdClient.Txn(context.Background()).
-			If(clientv3.Compare(clientv3.Version(key), "=", 0)).
-			Then(clientv3.OpPut(key, fmt.Sprintf("%d", count))).Commit()
+		r, err := backend.Txn(context.Background()).
+			If(store.Compare(store.Version(key), "=", 0)).
+			Then(store.OpPut(key, fmt.Sprintf("%d", count))).Commit()
 		if err != nil {
 			return err
 		}
@@ -33,9 +33,9 @@ func updateViewCount(statusID string, count int) error {
 	logrus.Debug("update views key ", key)
 	views, _ := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
 
-	r, err := etcdClient.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
-		Then(clientv3.OpPut(key, fmt.Sprintf("%d", count+int(views)))).Commit()
+	r, err := backend.Txn(context.Background()).
+		If(store.Compare(store.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+		Then(store.OpPut(key, fmt.Sprintf("%d", count+int(views)))).Commit()
 	if err != nil {
 		return err
 	}
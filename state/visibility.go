@@ -0,0 +1,41 @@
+package state
+
+import "slices"
+
+const (
+	// VisibilityPublic visible to everyone and listed in explore, search and labels
+	VisibilityPublic string = "public"
+	// VisibilityUnlisted visible to everyone, but not listed
+	VisibilityUnlisted string = "unlisted"
+	// VisibilityFollowers visible to followers of the author only
+	VisibilityFollowers string = "followers"
+	// VisibilityMentioned visible to users mentioned in the status only
+	VisibilityMentioned string = "mentioned"
+)
+
+var Visibilities = []string{VisibilityPublic, VisibilityUnlisted, VisibilityFollowers, VisibilityMentioned}
+
+// Listed determine if the status can be listed in explore, search and labels
+func (s *Status) Listed() bool {
+	return len(s.Visibility) == 0 || s.Visibility == VisibilityPublic
+}
+
+// InAudience determine if {viewer} is in the audience of the status
+// visibility. it doesn't check if the author is a private account
+func (s *Status) InAudience(viewer *ActUser) bool {
+	if viewer != nil && viewer.ID == s.User.ID {
+		return true
+	}
+	switch s.Visibility {
+	case VisibilityFollowers:
+		return viewer != nil && Followed(viewer.ID, s.User.ID)
+	case VisibilityMentioned:
+		return viewer != nil && slices.Contains(s.Mentions, viewer.ID)
+	}
+	return true
+}
+
+// VisibleTo determine if {viewer} can see the status
+func (s *Status) VisibleTo(viewer *ActUser) bool {
+	return s.InAudience(viewer) && CanView(viewer, s.User.ID)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,8 +19,12 @@ import (
 )
 
 type StatusOptions struct {
-	Content   []*state.StatusFragment `json:"content" binding:"required"`
-	RefStatus string                  `json:"prev"`
+	Content    []*state.StatusFragment `json:"content" binding:"required"`
+	RefStatus  string                  `json:"prev"`
+	Visibility string                  `json:"visibility"`
+	Quote      string                  `json:"quote"`
+	// PublishTime schedule the status to publish later
+	PublishTime *time.Time `json:"publishTime"`
 }
 
 type Status struct {
@@ -37,6 +43,16 @@ type Status struct {
 	Bookmarked bool                    `json:"bookmarked"`
 	Followed   bool                    `json:"followed"`
 	Disabled   bool                    `json:"disabled"`
+	Removed    bool                    `json:"removed,omitempty"`
+	Visibility string                  `json:"visibility,omitempty"`
+	EditTime   *time.Time              `json:"editTime,omitempty"`
+	Edited     bool                    `json:"edited"`
+	Reposts    int64                   `json:"reposts"`
+	Quotes     int64                   `json:"quotes"`
+	Reposted   bool                    `json:"reposted"`
+	Repost     *Status                 `json:"repost,omitempty"`
+	Quote      *Status                 `json:"quote,omitempty"`
+	Voted      []int                   `json:"voted,omitempty"`
 }
 
 func (s *Status) Overview() string {
@@ -77,10 +93,16 @@ func statusComments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	comments, more := state.StatusComments(chi.URLParam(r, tools.StatusID), opts)
 	user := currentSessionUser(r)
+	parent := state.GetStatus(chi.URLParam(r, tools.StatusID))
+	if parent != nil && !parent.VisibleTo(user) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	comments, more := state.StatusComments(chi.URLParam(r, tools.StatusID), opts)
 	var ss []*Status
-	for _, c := range comments {
+	for _, c := range filterInvisible(comments, user) {
 		s := castStatus(c, user)
 		ss = append(ss, s)
 		meta, err := state.NewCommentsRecommandMeta(s.ID)
@@ -89,7 +111,7 @@ func statusComments(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		rc := meta.Recommand()
-		if rc != nil {
+		if rc != nil && rc.VisibleTo(user) {
 			s.Next = castStatus(rc, user)
 		}
 	}
@@ -98,7 +120,7 @@ func statusComments(w http.ResponseWriter, r *http.Request) {
 
 func chainStatus(statusID string, sessionUser *state.ActUser) *Status {
 	status := state.GetStatus(statusID)
-	if status == nil {
+	if status == nil || !status.VisibleTo(sessionUser) || orphanRepost(status) {
 		return nil
 	}
 	s := castStatus(status, sessionUser)
@@ -129,14 +151,20 @@ func userStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ss, more := u.ListStatus(opts)
 	user := currentSessionUser(r)
+	if !state.CanView(user, u.ID) {
+		w.WriteHeader(errorStatusCode(state.ErrPrivateAccount))
+		fmt.Fprint(w, state.ErrPrivateAccount.Error())
+		return
+	}
+
+	ss, more := u.ListStatus(opts)
 	var ret []*Status
-	for _, s := range ss {
+	for _, s := range filterInvisible(ss, user) {
 		status := castStatus(s, user)
 		if len(s.RefStatus) > 0 {
 			prev := state.GetStatus(s.RefStatus)
-			if prev != nil {
+			if prev != nil && prev.VisibleTo(user) {
 				status.RefStatus = castStatus(prev, user)
 			}
 		}
@@ -149,46 +177,203 @@ func likeStatus(w http.ResponseWriter, r *http.Request) {
 	var ssion = r.Context().Value(tools.KeySession).(*state.Session)
 	err := state.LikeStatus(ssion.ToUser(), chi.URLParam(r, tools.StatusID))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatusCode(err))
 		w.Write([]byte(err.Error()))
 	}
 }
 
+func repostStatus(w http.ResponseWriter, r *http.Request) {
+	err := state.RepostStatus(currentSessionUser(r), chi.URLParam(r, tools.StatusID))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+	}
+}
+
+type VoteOptions struct {
+	Choices []int `json:"choices"`
+}
+
+func votePoll(w http.ResponseWriter, r *http.Request) {
+	req := &VoteOptions{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	user := currentSessionUser(r)
+	err := state.VotePoll(user, chi.URLParam(r, tools.StatusID), req.Choices)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(chainStatus(chi.URLParam(r, tools.StatusID), user))
+}
+
 func newStatus(w http.ResponseWriter, r *http.Request) {
-	var ssion = r.Context().Value(tools.KeySession).(*state.Session)
+	opts, err := checkArgsStatus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !opts.PublishTime.IsZero() {
+		d, err := state.ScheduleStatus(opts)
+		if err != nil {
+			w.WriteHeader(errorStatusCode(err))
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(d)
+		return
+	}
+
+	s, err := state.NewStatus(opts)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func editStatus(w http.ResponseWriter, r *http.Request) {
+	s := state.GetStatus(chi.URLParam(r, tools.StatusID))
+	if s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	req := &StatusOptions{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		fmt.Fprint(w, err.Error())
 		return
 	}
 
-	if req.Content == nil || len(req.Content) == 0 {
+	opts, err := parseStatusContent(req.Content, time.Now())
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("content is required"))
+		fmt.Fprint(w, err.Error())
 		return
 	}
+	opts.User = currentSessionUser(r)
 
-	if err := config.Conf.Model.Status.RestrictContentList(len(req.Content)); err != nil {
+	if s.Labels == nil {
+		// statuses posted before labels were recorded
+		for _, f := range s.Content {
+			if f.Type != "text" {
+				continue
+			}
+			for _, m := range labelsRegex.FindAllStringSubmatch(f.Value, -1) {
+				s.Labels = append(s.Labels, m[1])
+			}
+		}
+	}
+
+	if err := s.Edit(opts); err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(castStatus(s, opts.User))
+}
+
+func statusRevisions(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err.Error())
 		return
 	}
+	s := state.GetStatus(chi.URLParam(r, tools.StatusID))
+	if s == nil || !s.VisibleTo(currentSessionUser(r)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	revisions, more := s.ListRevisions(opts)
+	json.NewEncoder(w).Encode(L{V: revisions, More: more})
+}
+
+// checkArgsStatus decode and validate the new status request of the session
+// user, it is used by new statuses and drafts
+func checkArgsStatus(r *http.Request) (*state.StatusOptions, error) {
+	req := &StatusOptions{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+
+	if len(req.Visibility) > 0 && !slices.Contains(state.Visibilities, req.Visibility) {
+		return nil, fmt.Errorf("visibility: one of %s", strings.Join(state.Visibilities, ", "))
+	}
+
+	start := time.Now()
+	if req.PublishTime != nil {
+		if !req.PublishTime.After(start) {
+			return nil, errors.New("publishTime: must be in the future")
+		}
+		start = req.PublishTime.UTC().Truncate(time.Second)
+	}
 
-	for _, f := range req.Content {
+	opts, err := parseStatusContent(req.Content, start)
+	if err != nil {
+		return nil, err
+	}
+	opts.RefStatus = req.RefStatus
+	opts.User = currentSessionUser(r)
+	opts.Visibility = req.Visibility
+	opts.QuoteStatus = req.Quote
+	if req.PublishTime != nil {
+		opts.PublishTime = start
+	}
+	return opts, nil
+}
+
+// parseStatusContent validate the status content with the status config,
+// then derive labels, mentions and images from it. polls are open from
+// {start}, the time the status is published
+func parseStatusContent(content []*state.StatusFragment, start time.Time) (*state.StatusOptions, error) {
+	if len(content) == 0 {
+		return nil, errors.New("content is required")
+	}
+
+	if err := config.Conf.Model.Status.RestrictContentList(len(content)); err != nil {
+		return nil, err
+	}
+
+	for _, f := range content {
 		if err := config.Conf.Model.Status.RestrictContent(f.Value); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, err.Error())
-			return
+			return nil, err
+		}
+	}
+
+	var polls int
+	for _, f := range content {
+		if f.Type != "poll" {
+			continue
+		}
+		if polls++; polls > 1 {
+			return nil, errors.New("poll: maximum 1 poll")
 		}
+		if f.Poll == nil {
+			return nil, errors.New("poll: options are required")
+		}
+		closeTime := f.Poll.CloseTime.UTC().Truncate(time.Second)
+		if err := config.Conf.Model.Status.RestrictPoll(f.Poll.Options, closeTime.Sub(start)); err != nil {
+			return nil, err
+		}
+		f.Poll = &state.Poll{Options: f.Poll.Options, Multiple: f.Poll.Multiple, CloseTime: closeTime}
+		// clients without poll support render the options as a list
+		f.Value = "- " + strings.Join(f.Poll.Options, "\n- ")
 	}
 
 	opts := &state.StatusOptions{
-		Content:   req.Content,
-		RefStatus: req.RefStatus,
-		User:      ssion.ToUser(),
-		Labels:    []string{},
+		Content: content,
+		Labels:  []string{},
 	}
 	var overviewRestricted bool
 	var sf []*state.StatusFragment
@@ -198,9 +383,7 @@ func newStatus(w http.ResponseWriter, r *http.Request) {
 		}
 		if !overviewRestricted {
 			if err := config.Conf.Model.Status.RestrictOverview(f.Value); err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprint(w, err.Error())
-				return
+				return nil, err
 			}
 			overviewRestricted = true
 		}
@@ -245,36 +428,39 @@ func newStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if imgCount > 4 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("maximum 4 images, %d", imgCount)))
-		return
+		return nil, fmt.Errorf("maximum 4 images, %d", imgCount)
 	}
 
 	opts.Content = append(opts.Content, sf...)
+	return opts, nil
+}
 
-	s, err := state.NewStatus(opts)
-	if err != nil {
+func deleteStatus(w http.ResponseWriter, r *http.Request) {
+	s := state.GetStatus(chi.URLParam(r, tools.StatusID))
+	if s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	uid := r.Context().Value(tools.KeySessionUID).(string)
+	if err := s.Delete(uid); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	json.NewEncoder(w).Encode(s)
 }
 
-func deleteStatus(w http.ResponseWriter, r *http.Request) {
+// removeStatus delete a status of any user by moderators, statuses with
+// comments are stripped instead
+func removeStatus(w http.ResponseWriter, r *http.Request) {
 	s := state.GetStatus(chi.URLParam(r, tools.StatusID))
 	if s == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	uid := r.Context().Value(tools.KeySessionUID).(string)
-	if tools.Contains(config.Conf.Admins, uid) {
-		uid = s.User.ID
-	}
-
-	if err := s.Delete(uid); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := state.RemoveStatus(s, audit(r, "deleteStatus", "status", s.ID, s, nil)); err != nil {
+		w.WriteHeader(errorStatusCode(err))
 		w.Write([]byte(err.Error()))
 		return
 	}
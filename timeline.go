@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+func timeline(w http.ResponseWriter, r *http.Request) {
+	opts, err := tools.URLPaginationOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	user := currentSessionUser(r)
+	ss, more := state.Timeline(user, opts)
+	var ret []*Status
+	for _, s := range filterInvisible(ss, user) {
+		ret = append(ret, castStatus(s, user))
+	}
+	json.NewEncoder(w).Encode(L{V: ret, More: more})
+}
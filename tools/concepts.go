@@ -7,6 +7,10 @@ var (
 	UniqueName    string = "uniqueName"
 	StatusID      string = "statusID"
 	UID           string = "uid"
+	ReportID      string = "reportID"
+	Role          string = "role"
+	SessionID     string = "sid"
+	DraftID       string = "draftID"
 	KeySession    CtxKey = "session"
 	KeySessionUID CtxKey = "sessionUID"
 )
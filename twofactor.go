@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rkonfj/lln/state"
+	"github.com/rkonfj/lln/tools"
+)
+
+type TwoFactorRequest struct {
+	// Code totp or recovery code
+	Code string `json:"code"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+type TOTPEnabled struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	// Session replaces all sessions of the user
+	Session *state.Session `json:"session"`
+}
+
+func decodeTwoFactorRequest(w http.ResponseWriter, r *http.Request) *TwoFactorRequest {
+	req := &TwoFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return nil
+	}
+	return req
+}
+
+// verifyLogin exchange the pre-session in the Authorization header for a
+// session with the second factor
+func verifyLogin(w http.ResponseWriter, r *http.Request) {
+	pre := state.DefaultSessionManager.Load(r.Header.Get("Authorization"))
+	if pre == nil || !pre.MFAPending {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	req := decodeTwoFactorRequest(w, r)
+	if req == nil {
+		return
+	}
+	s, err := state.VerifyLogin(pre, req.Code, sessionClient(r))
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: s})
+}
+
+func twoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	json.NewEncoder(w).Encode(R{V: TwoFactorStatus{
+		Enabled:           state.TOTPEnabled(ssion.ID),
+		RecoveryCodesLeft: state.RecoveryCodesLeft(ssion.ID),
+	}})
+}
+
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	u := state.UserByID(ssion.ID)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	enrollment, err := state.EnrollTOTP(u)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: enrollment})
+}
+
+// enableTOTP enable two-factor authentication, other sessions of the user
+// are logged out and the current session is replaced by a verified one
+func enableTOTP(w http.ResponseWriter, r *http.Request) {
+	req := decodeTwoFactorRequest(w, r)
+	if req == nil {
+		return
+	}
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	codes, err := state.EnableTOTP(ssion.ID, req.Code)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	u := state.UserByID(ssion.ID)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s, err := state.UpgradeSession(u, sessionClient(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: TOTPEnabled{RecoveryCodes: codes, Session: s}})
+}
+
+// disableTOTP disable two-factor authentication, all sessions of the user
+// are logged out
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	req := decodeTwoFactorRequest(w, r)
+	if req == nil {
+		return
+	}
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	if err := state.DisableTOTP(ssion.ID, req.Code); err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	state.DefaultSessionManager.Expire(ssion.ID)
+}
+
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	req := decodeTwoFactorRequest(w, r)
+	if req == nil {
+		return
+	}
+	ssion := r.Context().Value(tools.KeySession).(*state.Session)
+	codes, err := state.RegenerateRecoveryCodes(ssion.ID, req.Code)
+	if err != nil {
+		w.WriteHeader(errorStatusCode(err))
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(R{V: codes})
+}